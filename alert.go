@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// Alert is raised whenever a monitored value crosses a configured rule.
+type Alert struct {
+	Rule      string
+	Message   string
+	Value     float64
+	Threshold float64
+	Tags      map[string]string
+	Time      time.Time
+}
+
+func (a *Alert) String() string {
+	return fmt.Sprintf("alert %s: %s (value %v, threshold %v)", a.Rule, a.Message, a.Value, a.Threshold)
+}
+
+// Point converts the alert into an "alert" measurement.
+func (a *Alert) Point(host string) (*client.Point, error) {
+	tags := map[string]string{
+		"host": host,
+		"rule": a.Rule,
+	}
+	for k, v := range a.Tags {
+		tags[k] = v
+	}
+	return client.NewPoint(
+		"alert",
+		tags,
+		map[string]interface{}{
+			"message":   a.Message,
+			"value":     a.Value,
+			"threshold": a.Threshold,
+		},
+		a.Time,
+	)
+}
+
+// Log writes the alert to the standard logger.
+func (a *Alert) Log() {
+	log.Println(a)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ArchiveEntry is a single recorded Torch response. Archives are stored as
+// JSON lines, gzip compressed if the file name ends with ".gz".
+type ArchiveEntry struct {
+	Time     time.Time       `json:"time"`
+	Path     string          `json:"path"`
+	Duration time.Duration   `json:"duration"`
+	Status   int             `json:"status,omitempty"`
+	Body     json.RawMessage `json:"body,omitempty"`
+	Text     string          `json:"text,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// Recorder is a http.RoundTripper that appends every response to an archive.
+type Recorder struct {
+	next http.RoundTripper
+
+	mu   sync.Mutex
+	file *os.File
+	gz   *gzip.Writer
+	enc  *json.Encoder
+}
+
+// NewRecorder creates the archive at path and records the responses of next.
+func NewRecorder(path string, next http.RoundTripper) (*Recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{
+		next: next,
+		file: f,
+		enc:  json.NewEncoder(f),
+	}
+	if strings.HasSuffix(path, ".gz") {
+		r.gz = gzip.NewWriter(f)
+		r.enc = json.NewEncoder(r.gz)
+	}
+	return r, nil
+}
+
+// RoundTrip returns the response of next. A response that could not be
+// recorded is still returned, the recording error is only logged.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := r.next.RoundTrip(req)
+	entry := ArchiveEntry{
+		Time: start,
+		Path: req.URL.Path,
+	}
+	if err != nil {
+		entry.Duration = time.Since(start)
+		entry.Error = err.Error()
+		r.record(&entry)
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	entry.Duration = time.Since(start)
+	if err != nil {
+		entry.Error = err.Error()
+		r.record(&entry)
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	entry.Status = res.StatusCode
+	if json.Valid(body) {
+		entry.Body = body
+	} else {
+		entry.Text = string(body)
+	}
+	r.record(&entry)
+	return res, nil
+}
+
+func (r *Recorder) record(entry *ArchiveEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.enc.Encode(entry)
+	if err == nil && r.gz != nil {
+		err = r.gz.Flush()
+	}
+	if err != nil {
+		log.Printf("record %s: %v", entry.Path, err)
+	}
+}
+
+// Close flushes and closes the archive.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.gz != nil {
+		if err := r.gz.Close(); err != nil {
+			r.file.Close()
+			return err
+		}
+	}
+	return r.file.Close()
+}
+
+// ReadArchive reads all entries of an archive. An archive that ends early,
+// like one whose recorder was killed before Close wrote the gzip trailer,
+// ends after its last complete entry.
+func ReadArchive(path string) ([]ArchiveEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = bufio.NewReader(f)
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var entries []ArchiveEntry
+	dec := json.NewDecoder(r)
+	for {
+		var entry ArchiveEntry
+		err := dec.Decode(&entry)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "archive entry %d", len(entries)+1)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Replayer is a http.RoundTripper answering requests from an archive instead
+// of a live Torch server. The responses of each path are returned in recorded
+// order and start over once exhausted.
+type Replayer struct {
+	// Pace delays every response by its recorded duration.
+	Pace bool
+
+	mu      sync.Mutex
+	entries map[string][]ArchiveEntry
+	next    map[string]int
+}
+
+func NewReplayer(entries []ArchiveEntry) *Replayer {
+	r := &Replayer{
+		entries: make(map[string][]ArchiveEntry),
+		next:    make(map[string]int),
+	}
+	for _, entry := range entries {
+		r.entries[entry.Path] = append(r.entries[entry.Path], entry)
+	}
+	return r
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	entry, ok := r.take(req.URL.Path)
+	if !ok {
+		return response(req, http.StatusNotFound, nil), nil
+	}
+	if r.Pace {
+		time.Sleep(entry.Duration)
+	}
+	if entry.Error != "" {
+		return nil, errors.New(entry.Error)
+	}
+	body := []byte(entry.Body)
+	if entry.Text != "" {
+		body = []byte(entry.Text)
+	}
+	return response(req, entry.Status, body), nil
+}
+
+func (r *Replayer) take(path string) (ArchiveEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries := r.entries[path]
+	if len(entries) == 0 {
+		return ArchiveEntry{}, false
+	}
+	i := r.next[path]
+	r.next[path] = (i + 1) % len(entries)
+	return entries[i], true
+}
+
+func response(req *http.Request, code int, body []byte) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
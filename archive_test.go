@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var fixtureGrids = []TorchMetricsSessionGrid{
+	{
+		DisplayName:                       "Red Ship",
+		EntityId:                          101,
+		GridSize:                          "Large",
+		BlocksCount:                       850,
+		Mass:                              1200000.5,
+		LinearSpeed:                       42.5,
+		DistanceToPlayer:                  120.25,
+		OwnerSteamID:                      76561197960287930,
+		OwnerDisplayName:                  "Alice",
+		OwnerFactionTag:                   "R\\ED",
+		OwnerFactionName:                  "Red Dawn",
+		IsPowered:                         true,
+		PCU:                               9000,
+		DampenersEnabled:                  true,
+		ConveyorSystemInventoryBlockCount: 25,
+		ConveyorSystemEndpointBlockCount:  30,
+		ConveyorSystemLineCount:           40,
+		ConveyorSystemConnectorCount:      2,
+	},
+	{
+		DisplayName:      "Static Grid 4711",
+		EntityId:         102,
+		GridSize:         "Small",
+		BlocksCount:      12,
+		Mass:             900,
+		DistanceToPlayer: 5000,
+		PCU:              80,
+		IsConcealed:      true,
+		IsStatic:         true,
+	},
+}
+
+func newReplayTorch(t *testing.T, entries []ArchiveEntry) *TorchMetrics {
+	torch, err := NewTorchMetrics(testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torch.SetTransport(NewReplayer(entries))
+	return torch
+}
+
+func TestReplaySessionGrids(t *testing.T) {
+	entries, err := readFixtures("testdata/torch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	torch := newReplayTorch(t, entries)
+
+	// The responses of a path start over once exhausted.
+	for i := 0; i < 2; i++ {
+		grids, err := torch.SessionGrids()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(grids, fixtureGrids) {
+			t.Errorf("got grids\n%+v\nwant\n%+v", grids, fixtureGrids)
+		}
+	}
+	if _, err := torch.SessionFactions(); err != nil {
+		t.Fatal(err)
+	}
+	if err := torch.get("session/unknown", &struct{}{}); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("got %v for an unrecorded path, want 404", err)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	entries, err := readFixtures("testdata/torch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries = append(entries, ArchiveEntry{Path: "/metrics/v1/broken", Error: "connection refused"})
+	torch := newReplayTorch(t, entries)
+	path := filepath.Join(dir, "torch.jsonl.gz")
+	recorder, err := NewRecorder(path, torch.client.Transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torch.SetTransport(recorder)
+
+	if _, err := torch.SessionGrids(); err != nil {
+		t.Fatal(err)
+	}
+	if err := torch.get("broken", &struct{}{}); err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("got %v, want the transport error", err)
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Responses that can no longer be recorded are still answered.
+	if _, err := torch.SessionGrids(); err != nil {
+		t.Errorf("response lost to a recording error: %v", err)
+	}
+
+	recorded, err := ReadArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded) != 2 || recorded[1].Path != "/metrics/v1/broken" || recorded[1].Error != "connection refused" {
+		t.Fatalf("unexpected archive: %+v", recorded)
+	}
+	grids, err := newReplayTorch(t, recorded).SessionGrids()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(grids, fixtureGrids) {
+		t.Errorf("got replayed grids\n%+v\nwant\n%+v", grids, fixtureGrids)
+	}
+}
+
+func TestReadArchiveUnclosed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	entries, err := readFixtures("testdata/torch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	torch := newReplayTorch(t, entries)
+	path := filepath.Join(dir, "torch.jsonl.gz")
+	recorder, err := NewRecorder(path, torch.client.Transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torch.SetTransport(recorder)
+	for i := 0; i < 2; i++ {
+		if _, err := torch.SessionGrids(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A recorder killed before Close never writes the gzip trailer.
+	recorded, err := ReadArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded) != 2 {
+		t.Errorf("got %d entries, want 2", len(recorded))
+	}
+	recorder.file.Close()
+}
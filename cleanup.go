@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/pkg/errors"
+)
+
+// Reasons a grid is a cleanup candidate.
+const (
+	CleanupUnowned     = "unowned"
+	CleanupOwnerAbsent = "owner_absent"
+	CleanupUnpowered   = "unpowered"
+	// CleanupStationary never makes a grid a candidate on its own, static
+	// bases do not move either, but ranks candidates higher.
+	CleanupStationary = "stationary"
+)
+
+// cleanupStationarySpeed is the speed in m/s below which a grid counts as
+// stationary.
+const cleanupStationarySpeed = 0.1
+
+// CleanupTracker is a sink that follows the grids of consecutive snapshots
+// and when players were last seen, to report grids that are candidates for a
+// manual cleanup: unowned grids, grids whose owner has not been seen for
+// Absent, and grids that have been unpowered for After. It never removes
+// anything.
+//
+// The state is saved to Path, if set, at most once a minute, so absences
+// span restarts of the exporter and the cleanup command can read it.
+type CleanupTracker struct {
+	After  time.Duration
+	Absent time.Duration
+	Path   string
+	Clock  Clock
+	// Grids returns the grids the grid points of a batch were made of,
+	// usually TorchMetrics.LastSessionGrids, which tells grids apart by
+	// entity ID.
+	Grids func() []TorchMetricsSessionGrid
+
+	mu    sync.Mutex
+	state cleanupState
+	saved time.Time
+}
+
+type cleanupState struct {
+	// Started is when tracking began, owners never seen since count as
+	// absent from then.
+	Started time.Time                 `json:"started"`
+	Updated time.Time                 `json:"updated"`
+	Players map[string]*cleanupPlayer `json:"players"`
+	Grids   map[string]*cleanupGrid   `json:"grids"`
+}
+
+type cleanupPlayer struct {
+	LastSeen time.Time `json:"last_seen"`
+	Online   bool      `json:"online"`
+}
+
+type cleanupGrid struct {
+	EntityID         string    `json:"entity_id"`
+	DisplayName      string    `json:"display_name"`
+	OwnerSteamID     string    `json:"owner_steam_id"`
+	OwnerDisplayName string    `json:"owner_display_name"`
+	OwnerFactionTag  string    `json:"owner_faction_tag"`
+	GridSize         string    `json:"grid_size"`
+	Static           bool      `json:"static"`
+	Blocks           int64     `json:"blocks"`
+	PCU              int64     `json:"pcu"`
+	FirstSeen        time.Time `json:"first_seen"`
+	UnpoweredSince   time.Time `json:"unpowered_since"`
+	StationarySince  time.Time `json:"stationary_since"`
+}
+
+// NewCleanupTracker loads the state saved at path, if any.
+func NewCleanupTracker(path string, after, absent time.Duration, clock Clock) (*CleanupTracker, error) {
+	c := &CleanupTracker{
+		After:  after,
+		Absent: absent,
+		Path:   path,
+		Clock:  clock,
+		state: cleanupState{
+			Started: clock.Now(),
+			Players: make(map[string]*cleanupPlayer),
+			Grids:   make(map[string]*cleanupGrid),
+		},
+	}
+	if path == "" {
+		return c, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &c.state); err != nil {
+		return nil, errors.Wrapf(err, "cleanup state %s", path)
+	}
+	return c, nil
+}
+
+func (c *CleanupTracker) Name() string {
+	return "cleanup"
+}
+
+func (c *CleanupTracker) Write(points []*client.Point) error {
+	now := c.Clock.Now()
+	var grids map[string]*cleanupGrid
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, pt := range points {
+		switch pt.Name() {
+		case "players":
+			ts := pt.Time()
+			if ts.IsZero() {
+				ts = now
+			}
+			c.player(pt.Tags()["steam_id"], ts).Online = pt.Tags()["type"] == PlayerJoined
+		case "grid":
+			if grids != nil || c.Grids == nil {
+				continue
+			}
+			grids = make(map[string]*cleanupGrid)
+			for _, g := range c.Grids() {
+				grid := c.observeGrid(g, now)
+				grids[grid.EntityID] = grid
+			}
+		}
+	}
+	if grids == nil {
+		return nil
+	}
+
+	// Every run of the grids collector reports all of them, grids missing
+	// from a snapshot are gone.
+	c.state.Grids = grids
+	c.state.Updated = now
+	for _, p := range c.state.Players {
+		if p.Online {
+			p.LastSeen = now
+		}
+	}
+	if c.Path != "" && now.Sub(c.saved) >= time.Minute {
+		if err := c.save(); err != nil {
+			return err
+		}
+		c.saved = now
+	}
+	return nil
+}
+
+// player returns the tracked player id, seen at ts.
+func (c *CleanupTracker) player(id string, ts time.Time) *cleanupPlayer {
+	p, ok := c.state.Players[id]
+	if !ok {
+		p = &cleanupPlayer{}
+		c.state.Players[id] = p
+	}
+	if ts.After(p.LastSeen) {
+		p.LastSeen = ts
+	}
+	return p
+}
+
+// observeGrid updates the tracked grid g, seen at now.
+//
+// Players online before the exporter started never join, so only building
+// gives them away: an owner whose grid changed its blocks or PCU since the
+// last snapshot was online and counts as seen.
+func (c *CleanupTracker) observeGrid(g TorchMetricsSessionGrid, now time.Time) *cleanupGrid {
+	id := fmt.Sprint(g.EntityId)
+	grid, ok := c.state.Grids[id]
+	if !ok {
+		grid = &cleanupGrid{EntityID: id, FirstSeen: now}
+	} else if g.OwnerSteamID != 0 && (grid.Blocks != int64(g.BlocksCount) || grid.PCU != int64(g.PCU)) {
+		c.player(fmt.Sprint(g.OwnerSteamID), now)
+	}
+	grid.DisplayName = g.DisplayName
+	grid.OwnerSteamID = fmt.Sprint(g.OwnerSteamID)
+	grid.OwnerDisplayName = g.OwnerDisplayName
+	grid.OwnerFactionTag = strings.Replace(g.OwnerFactionTag, "\\", "", -1)
+	grid.GridSize = g.GridSize
+	grid.Static = g.IsStatic
+	grid.Blocks = int64(g.BlocksCount)
+	grid.PCU = int64(g.PCU)
+
+	if g.IsPowered {
+		grid.UnpoweredSince = time.Time{}
+	} else if grid.UnpoweredSince.IsZero() {
+		grid.UnpoweredSince = now
+	}
+	if g.LinearSpeed >= cleanupStationarySpeed {
+		grid.StationarySince = time.Time{}
+	} else if grid.StationarySince.IsZero() {
+		grid.StationarySince = now
+	}
+	return grid
+}
+
+// save writes the state atomically, so a crash never leaves a partial
+// state behind.
+func (c *CleanupTracker) save() error {
+	b, err := json.Marshal(c.state)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(c.Path, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+	return errors.Wrap(err, "cleanup state")
+}
+
+// CleanupCandidate is a grid that may be cleaned up, with the reasons why.
+type CleanupCandidate struct {
+	Rank             int        `json:"rank"`
+	EntityID         string     `json:"entity_id"`
+	DisplayName      string     `json:"display_name"`
+	OwnerSteamID     string     `json:"owner_steam_id"`
+	OwnerDisplayName string     `json:"owner_display_name"`
+	OwnerFactionTag  string     `json:"owner_faction_tag"`
+	GridSize         string     `json:"grid_size"`
+	Blocks           int64      `json:"blocks"`
+	PCU              int64      `json:"pcu"`
+	Reasons          []string   `json:"reasons"`
+	OwnerLastSeen    *time.Time `json:"owner_last_seen,omitempty"`
+	UnpoweredSince   *time.Time `json:"unpowered_since,omitempty"`
+	StationarySince  *time.Time `json:"stationary_since,omitempty"`
+}
+
+// CleanupReport lists the candidates of the latest snapshot, the ones with
+// the most reasons and then the most PCU first.
+type CleanupReport struct {
+	Time       time.Time          `json:"time"`
+	Candidates []CleanupCandidate `json:"candidates"`
+}
+
+func (c *CleanupTracker) Report() *CleanupReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Durations are measured up to the latest snapshot, which keeps the
+	// report of a saved state stable.
+	now := c.state.Updated
+	report := &CleanupReport{Time: now, Candidates: []CleanupCandidate{}}
+	for _, grid := range c.state.Grids {
+		candidate := CleanupCandidate{
+			EntityID:         grid.EntityID,
+			DisplayName:      grid.DisplayName,
+			OwnerSteamID:     grid.OwnerSteamID,
+			OwnerDisplayName: grid.OwnerDisplayName,
+			OwnerFactionTag:  grid.OwnerFactionTag,
+			GridSize:         grid.GridSize,
+			Blocks:           grid.Blocks,
+			PCU:              grid.PCU,
+			Reasons:          []string{},
+		}
+		if grid.OwnerSteamID == "" || grid.OwnerSteamID == "0" {
+			candidate.Reasons = append(candidate.Reasons, CleanupUnowned)
+		} else {
+			lastSeen := c.state.Started
+			p := c.state.Players[grid.OwnerSteamID]
+			if p != nil {
+				lastSeen = p.LastSeen
+				candidate.OwnerLastSeen = &lastSeen
+			}
+			if (p == nil || !p.Online) && now.Sub(lastSeen) >= c.Absent {
+				candidate.Reasons = append(candidate.Reasons, CleanupOwnerAbsent)
+			}
+		}
+		if since := grid.UnpoweredSince; !since.IsZero() && now.Sub(since) >= c.After {
+			candidate.Reasons = append(candidate.Reasons, CleanupUnpowered)
+			candidate.UnpoweredSince = &since
+		}
+		if len(candidate.Reasons) == 0 {
+			continue
+		}
+		if since := grid.StationarySince; !grid.Static && !since.IsZero() && now.Sub(since) >= c.After {
+			candidate.Reasons = append(candidate.Reasons, CleanupStationary)
+			candidate.StationarySince = &since
+		}
+		report.Candidates = append(report.Candidates, candidate)
+	}
+
+	candidates := report.Candidates
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if len(a.Reasons) != len(b.Reasons) {
+			return len(a.Reasons) > len(b.Reasons)
+		}
+		if a.PCU != b.PCU {
+			return a.PCU > b.PCU
+		}
+		return a.EntityID < b.EntityID
+	})
+	for i := range candidates {
+		candidates[i].Rank = i + 1
+	}
+	return report
+}
+
+// Register serves the report as JSON at /cleanup.
+func (c *CleanupTracker) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/cleanup", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Report())
+	})
+}
+
+// cleanupCommand prints the cleanup report of a saved state. It returns the
+// exit code.
+func cleanupCommand(c *CleanupTracker, args []string) int {
+	fs := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	format := fs.String("format", "table", "output format: table or json")
+	fs.Parse(args)
+
+	report := c.Report()
+	var err error
+	switch *format {
+	case "table":
+		err = report.writeTable(os.Stdout)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	default:
+		err = fmt.Errorf("unknown format %q", *format)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func (r *CleanupReport) writeTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "RANK\tGRID\tENTITY\tOWNER\tFACTION\tBLOCKS\tPCU\tREASONS")
+	for _, c := range r.Candidates {
+		owner := c.OwnerDisplayName
+		if owner == "" {
+			owner = "-"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n",
+			c.Rank, c.DisplayName, c.EntityID, owner, c.OwnerFactionTag, c.Blocks, c.PCU, strings.Join(c.Reasons, ","))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%d candidates as of %s\n", len(r.Candidates), r.Time.UTC().Format(time.RFC3339))
+	return err
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCleanupTracker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cleanup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cleanup.json")
+
+	h, f, clock := newFakeTorchHarness(t)
+	c, err := NewCleanupTracker(path, 24*time.Hour, 48*time.Hour, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Grids = h.torch.LastSessionGrids
+	h.exporter.Sinks = append(h.exporter.Sinks, c)
+
+	f.SpawnGrid(TorchMetricsSessionGrid{EntityId: 1, DisplayName: "Derelict", PCU: 50})
+	f.SpawnGrid(TorchMetricsSessionGrid{EntityId: 2, DisplayName: "Alice Base", OwnerSteamID: 1, OwnerDisplayName: "Alice", PCU: 9000, IsPowered: true, IsStatic: true})
+	f.SpawnGrid(TorchMetricsSessionGrid{EntityId: 3, DisplayName: "Bob Ship", OwnerSteamID: 2, OwnerDisplayName: "Bob", PCU: 800, IsPowered: true, LinearSpeed: 5})
+	f.SpawnGrid(TorchMetricsSessionGrid{EntityId: 4, DisplayName: "Bob Wreck", OwnerSteamID: 2, OwnerDisplayName: "Bob", PCU: 500})
+	f.Join(1)
+	f.Join(2)
+	f.Leave(2)
+	h.exporter.Tick()
+	if n := len(c.Report().Candidates); n != 1 {
+		t.Errorf("got %d candidates on the first day, want only the unowned grid", n)
+	}
+
+	clock.Advance(72 * time.Hour)
+	h.exporter.Tick()
+
+	mux := http.NewServeMux()
+	c.Register(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/cleanup", nil))
+	var report CleanupReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, candidate := range report.Candidates {
+		got = append(got, candidate.DisplayName+" "+strings.Join(candidate.Reasons, ","))
+	}
+	want := []string{
+		"Bob Wreck owner_absent,unpowered,stationary",
+		"Derelict unowned,unpowered,stationary",
+		"Bob Ship owner_absent",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got candidates %q, want %q", got, want)
+	}
+	if seen := report.Candidates[0].OwnerLastSeen; seen == nil || !seen.Equal(testEpoch) {
+		t.Errorf("owner last seen %v, want %s", seen, testEpoch)
+	}
+
+	// The saved state gives the same report, e.g. to the cleanup command.
+	saved, err := NewCleanupTracker(path, 24*time.Hour, 48*time.Hour, NewFakeClock(testEpoch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved.Report(), c.Report()) {
+		t.Errorf("saved state reports\n%+v\nwant\n%+v", saved.Report(), c.Report())
+	}
+	var table bytes.Buffer
+	if err := saved.Report().writeTable(&table); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(table.String(), "\n"); len(lines) != 6 || !strings.HasPrefix(lines[1], "1     Bob Wreck") || !strings.HasPrefix(lines[4], "3 candidates as of 2018-11-07T12:00:00Z") {
+		t.Errorf("unexpected table:\n%s", table.String())
+	}
+}
+
+func TestCleanupTrackerOnlineAtStart(t *testing.T) {
+	h, f, clock := newFakeTorchHarness(t)
+	c, err := NewCleanupTracker("", 24*time.Hour, 48*time.Hour, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Grids = h.torch.LastSessionGrids
+	h.exporter.Sinks = append(h.exporter.Sinks, c)
+
+	// Carol and Dave were online before the exporter started, only Carol
+	// keeps building.
+	f.SpawnGrid(TorchMetricsSessionGrid{EntityId: 1, DisplayName: "Carol Base", OwnerSteamID: 3, OwnerDisplayName: "Carol", BlocksCount: 10, PCU: 100, IsPowered: true})
+	f.SpawnGrid(TorchMetricsSessionGrid{EntityId: 2, DisplayName: "Dave Base", OwnerSteamID: 4, OwnerDisplayName: "Dave", BlocksCount: 10, PCU: 100, IsPowered: true})
+	h.collect("grids")
+	clock.Advance(71 * time.Hour)
+	f.SpawnGrid(TorchMetricsSessionGrid{EntityId: 1, DisplayName: "Carol Base", OwnerSteamID: 3, OwnerDisplayName: "Carol", BlocksCount: 20, PCU: 150, IsPowered: true})
+	h.collect("grids")
+	clock.Advance(time.Hour)
+	h.collect("grids")
+
+	var got []string
+	for _, candidate := range c.Report().Candidates {
+		got = append(got, candidate.DisplayName+" "+strings.Join(candidate.Reasons, ","))
+	}
+	if want := []string{"Dave Base owner_absent,stationary"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got candidates %q, want %q", got, want)
+	}
+}
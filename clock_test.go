@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+func TestFakeClockTicker(t *testing.T) {
+	c := NewFakeClock(testEpoch)
+	ticker := c.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	c.Advance(9 * time.Second)
+	select {
+	case tick := <-ticker.C():
+		t.Fatalf("early tick at %s", tick)
+	default:
+	}
+
+	// Like time.Ticker, ticks that are not received are dropped.
+	c.Advance(31 * time.Second)
+	if tick := <-ticker.C(); !tick.Equal(testEpoch.Add(10 * time.Second)) {
+		t.Errorf("tick at %s, want %s", tick, testEpoch.Add(10*time.Second))
+	}
+	select {
+	case tick := <-ticker.C():
+		t.Fatalf("dropped tick delivered at %s", tick)
+	default:
+	}
+
+	ticker.Stop()
+	if n := c.Tickers(); n != 0 {
+		t.Errorf("%d tickers after Stop", n)
+	}
+}
+
+func TestFakeClockAfter(t *testing.T) {
+	c := NewFakeClock(testEpoch)
+	after := c.After(time.Minute)
+
+	c.Advance(59 * time.Second)
+	select {
+	case <-after:
+		t.Fatal("fired early")
+	default:
+	}
+	c.Advance(time.Second)
+	if now := <-after; !now.Equal(testEpoch.Add(time.Minute)) {
+		t.Errorf("fired at %s", now)
+	}
+	if n := c.Waiters(); n != 0 {
+		t.Errorf("%d waiters left", n)
+	}
+}
+
+func TestExporterRunFakeClock(t *testing.T) {
+	clock := NewFakeClock(testEpoch)
+	sink := NewMemorySink()
+	collected := make(chan time.Time)
+	e := &Exporter{
+		Collectors: []*Collector{stubCollector("stub", clock, collected)},
+		Sinks:      []Sink{sink},
+		Interval:   10 * time.Second,
+		Stats:      NewStats(),
+		Clock:      clock,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- e.Run(ctx) }()
+	for clock.Tickers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	clock.Advance(10 * time.Second)
+	if at := <-collected; !at.Equal(testEpoch.Add(10 * time.Second)) {
+		t.Errorf("collected at %s", at)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Run returned %v", err)
+	}
+}
+
+func TestExporterRunSkipsBusyCollector(t *testing.T) {
+	clock := NewFakeClock(testEpoch)
+	collected := make(chan time.Time)
+	release := make(chan struct{})
+	blocking := &Collector{
+		Name: "blocking",
+		Collect: func() ([]*client.Point, error) {
+			collected <- clock.Now()
+			<-release
+			return nil, nil
+		},
+	}
+	e := &Exporter{
+		Collectors: []*Collector{blocking},
+		Interval:   10 * time.Second,
+		Stats:      NewStats(),
+		Clock:      clock,
+	}
+	// waitFor polls the stats of the collector until ok or a second passed.
+	waitFor := func(what string, ok func(CollectorStats) bool) {
+		deadline := time.Now().Add(time.Second)
+		for !ok(e.Stats.Snapshot().Collectors["blocking"]) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s: %+v", what, e.Stats.Snapshot().Collectors["blocking"])
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- e.Run(ctx) }()
+	for clock.Tickers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	clock.Advance(10 * time.Second)
+	<-collected
+	// Ticks while the collector is still running are skipped, not queued.
+	for skipped := int64(1); skipped <= 2; skipped++ {
+		clock.Advance(10 * time.Second)
+		waitFor("a skipped tick", func(c CollectorStats) bool { return c.SkippedTicks == skipped })
+	}
+
+	close(release)
+	waitFor("the scrape", func(c CollectorStats) bool { return c.Scrapes == 1 })
+	clock.Advance(10 * time.Second)
+	if at := <-collected; !at.Equal(testEpoch.Add(40 * time.Second)) {
+		t.Errorf("collected at %s after the skipped ticks", at)
+	}
+	if skipped := e.Stats.Snapshot().Collectors["blocking"].SkippedTicks; skipped != 2 {
+		t.Errorf("got %d skipped ticks, want 2", skipped)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Run returned %v", err)
+	}
+}
+
+func stubCollector(name string, clock Clock, collected chan<- time.Time) *Collector {
+	return &Collector{
+		Name: name,
+		Collect: func() ([]*client.Point, error) {
+			collected <- clock.Now()
+			return nil, nil
+		},
+	}
+}
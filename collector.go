@@ -0,0 +1,503 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// Collector scrapes a single Torch endpoint and converts the response into
+// points for the sinks.
+type Collector struct {
+	Name    string
+	Collect func() ([]*client.Point, error)
+}
+
+// NewCollectors returns a collector for every endpoint of the Torch metrics
+// plugin. Points are tagged with host and timestamped by clock.
+func NewCollectors(t *TorchMetrics, host string, saves *SaveMonitor, clock Clock) []*Collector {
+	return []*Collector{
+		{Name: "server", Collect: func() ([]*client.Point, error) {
+			info, err := t.Server()
+			if err != nil {
+				return nil, err
+			}
+			return serverPoints(host, info, saves, clock.Now())
+		}},
+		{Name: "load", Collect: func() ([]*client.Point, error) {
+			loads, err := t.Load()
+			if err != nil {
+				return nil, err
+			}
+			return loadPoints(host, loads, clock.Now())
+		}},
+		{Name: "process", Collect: func() ([]*client.Point, error) {
+			process, err := t.Process()
+			if err != nil {
+				return nil, err
+			}
+			return processPoints(host, process, clock.Now())
+		}},
+		{Name: "events", Collect: func() ([]*client.Point, error) {
+			events, err := t.Events()
+			if err != nil {
+				return nil, err
+			}
+			return eventPoints(host, events, clock.Now())
+		}},
+		{Name: "players", Collect: func() ([]*client.Point, error) {
+			events, err := t.PlayerEvents()
+			if err != nil {
+				return nil, err
+			}
+			return playerPoints(host, events, clock.Now())
+		}},
+		{Name: "grids", Collect: func() ([]*client.Point, error) {
+			grids, err := t.SessionGrids()
+			if err != nil {
+				return nil, err
+			}
+			return gridPoints(host, grids)
+		}},
+		{Name: "asteroids", Collect: func() ([]*client.Point, error) {
+			asteroids, err := t.SessionAsteroids()
+			if err != nil {
+				return nil, err
+			}
+			return voxelPoints(host, "asteroid", asteroids)
+		}},
+		{Name: "planets", Collect: func() ([]*client.Point, error) {
+			planets, err := t.SessionPlanets()
+			if err != nil {
+				return nil, err
+			}
+			return voxelPoints(host, "planet", planets)
+		}},
+		{Name: "factions", Collect: func() ([]*client.Point, error) {
+			factions, err := t.SessionFactions()
+			if err != nil {
+				return nil, err
+			}
+			return factionPoints(host, factions)
+		}},
+		{Name: "floating_objects", Collect: func() ([]*client.Point, error) {
+			floatingObjects, err := t.SessionFloatingObjects()
+			if err != nil {
+				return nil, err
+			}
+			return floatingObjectPoints(host, floatingObjects)
+		}},
+	}
+}
+
+func serverPoints(host string, info *TorchMetricServer, saves *SaveMonitor, now time.Time) ([]*client.Point, error) {
+	var points []*client.Point
+
+	ready := 0
+	if info.IsReady {
+		ready++
+	}
+	pt, err := client.NewPoint(
+		"server",
+		map[string]string{
+			"host":        host,
+			"server_name": info.ServerName,
+			"version":     info.Version,
+			"world_name":  info.WorldName,
+			"block_limit": info.BlockLimitEnabled,
+		},
+		map[string]interface{}{
+			"sim_speed":             info.SimSpeed,
+			"players":               info.Players,
+			"sim_cpu_load":          info.SimulationCpuLoad,
+			"total_time":            info.TotalTime,
+			"used_pcu":              info.UsedPCU,
+			"ready":                 ready,
+			"max_blocks_per_player": info.MaxBlocksPerPlayer,
+			"max_factions_count":    info.MaxFactionsCount,
+			"max_floating_objects":  info.MaxFloatingObjects,
+			"max_grid_size":         info.MaxGridSize,
+			"max_players":           info.MaxPlayers,
+			"block_limit":           info.BlockLimitEnabled,
+			"total_pcu":             info.TotalPCU,
+			"mod_count":             info.ModCount,
+			"save_duration":         info.SaveDuration,
+		},
+		now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	points = append(points, pt)
+
+	saveTags := map[string]string{
+		"host":       host,
+		"world_name": info.WorldName,
+	}
+	if save := saves.Observe(info.SaveDuration, now); save != nil {
+		slow := 0
+		alert := saves.Alert(save)
+		if alert != nil {
+			slow++
+		}
+		pt, err := client.NewPoint(
+			"save",
+			saveTags,
+			map[string]interface{}{
+				"duration": save.Duration.Seconds(),
+				"slow":     slow,
+			},
+			save.Time,
+		)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, pt)
+
+		if alert != nil {
+			alert.Tags = saveTags
+			alert.Log()
+			pt, err := alert.Point(host)
+			if err != nil {
+				return nil, err
+			}
+			points = append(points, pt)
+		}
+	}
+	pt, err = client.NewPoint(
+		"save_stats",
+		saveTags,
+		map[string]interface{}{
+			"count": saves.Count(),
+			"p50":   saves.Percentile(50).Seconds(),
+			"p95":   saves.Percentile(95).Seconds(),
+		},
+		now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	points = append(points, pt)
+
+	return points, nil
+}
+
+func loadPoints(host string, loads []TorchMetricsLoad, now time.Time) ([]*client.Point, error) {
+	var points []*client.Point
+	for _, load := range loads {
+		var occurred time.Time
+		if load.MillisecondsInThePast > 0 {
+			occurred = now.Add(time.Millisecond * time.Duration(load.MillisecondsInThePast) * -1)
+		}
+		pt, err := client.NewPoint(
+			"load",
+			map[string]string{
+				"host": host,
+			},
+			map[string]interface{}{
+				"server_cpu_load":           load.ServerCPULoad,
+				"server_cpu_load_smooth":    load.ServerCPULoadSmooth,
+				"server_simulation_ratio":   load.ServerSimulationRatio,
+				"server_thread_load":        load.ServerThreadLoad,
+				"server_thread_load_smooth": load.ServerThreadLoadSmooth,
+			},
+			occurred,
+		)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, pt)
+	}
+	return points, nil
+}
+
+func processPoints(host string, process *TorchMetricsProcess, now time.Time) ([]*client.Point, error) {
+	pt, err := client.NewPoint(
+		"process",
+		map[string]string{
+			"host": host,
+		},
+		map[string]interface{}{
+			"private_memory_size64":         process.PrivateMemorySize64,
+			"virtual_memory_size64":         process.VirtualMemorySize64,
+			"working_set64":                 process.WorkingSet64,
+			"nonpaged_system_memory_size64": process.NonpagedSystemMemorySize64,
+			"paged_memory_size64":           process.PagedMemorySize64,
+			"paged_system_memory_size64":    process.PagedSystemMemorySize64,
+			"peak_paged_memory_size64":      process.PeakPagedMemorySize64,
+			"peak_virtual_memory_size64":    process.PeakVirtualMemorySize64,
+			"peak_working_set64":            process.PeakWorkingSet64,
+			"gc_latency_mode":               process.GCLatencyMode,
+			"gc_total_memory":               process.GCTotalMemory,
+			"gc_max_generation":             process.GCMaxGeneration,
+			"gc_collection_count0":          process.GCCollectionCount0,
+			"gc_collection_count1":          process.GCCollectionCount1,
+			"gc_collection_count2":          process.GCCollectionCount2,
+		},
+		now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return []*client.Point{pt}, nil
+}
+
+func eventPoints(host string, events []TorchMetricsEvent, now time.Time) ([]*client.Point, error) {
+	var points []*client.Point
+	for _, event := range events {
+		var occurred time.Time
+		if event.SecondsInThePast > 0 {
+			occurred = now.Add(time.Second * time.Duration(event.SecondsInThePast) * -1)
+		}
+		pt, err := client.NewPoint(
+			"events",
+			map[string]string{
+				"host": host,
+				"type": event.Type,
+			},
+			map[string]interface{}{
+				"text": event.Text,
+				"tags": strings.Join(event.Tags, ","),
+			},
+			occurred,
+		)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, pt)
+	}
+	return points, nil
+}
+
+func playerPoints(host string, events []TorchPlayerEvent, now time.Time) ([]*client.Point, error) {
+	var points []*client.Point
+	for _, event := range events {
+		var occurred time.Time
+		if event.MillisecondsInThePast > 0 {
+			occurred = now.Add(time.Millisecond * time.Duration(event.MillisecondsInThePast) * -1)
+		}
+		pt, err := client.NewPoint(
+			"players",
+			map[string]string{
+				"host":     host,
+				"type":     event.Type,
+				"steam_id": fmt.Sprint(event.SteamID),
+			},
+			map[string]interface{}{
+				"value": 1,
+			},
+			occurred,
+		)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, pt)
+	}
+	return points, nil
+}
+
+func gridPoints(host string, grids []TorchMetricsSessionGrid) ([]*client.Point, error) {
+	var points []*client.Point
+	for _, grid := range grids {
+		powered := 0
+		concealed := 0
+		dampenersEnabled := 0
+		isStatic := 0
+		if grid.IsPowered {
+			powered++
+		}
+		if grid.IsConcealed {
+			concealed++
+		}
+		if grid.DampenersEnabled {
+			dampenersEnabled++
+		}
+		if grid.IsStatic {
+			isStatic++
+		}
+		pt, err := client.NewPoint(
+			"grid",
+			map[string]string{
+				"host":                host,
+				"owner_steam_id":      fmt.Sprint(grid.OwnerSteamID),
+				"owner_display_name":  grid.OwnerDisplayName,
+				"owner_faction_tag":   strings.Replace(grid.OwnerFactionTag, "\\", "", -1),
+				"owner_faction_name":  grid.OwnerFactionName,
+				"display_name":        grid.DisplayName,
+				"filter_is_powered":   toStringBool(grid.IsPowered),
+				"grid_size":           grid.GridSize,
+				"filter_is_concealed": toStringBool(grid.IsConcealed),
+				"filter_is_static":    toStringBool(grid.IsStatic),
+			},
+			map[string]interface{}{
+				"blocks_count":                   grid.BlocksCount,
+				"is_powered":                     powered,
+				"linear_speed":                   grid.LinearSpeed,
+				"mass":                           grid.Mass,
+				"pcu":                            grid.PCU,
+				"is_concealed":                   concealed,
+				"dampeners_enabled":              dampenersEnabled,
+				"is_static":                      isStatic,
+				"conveyor_connector_count":       grid.ConveyorSystemConnectorCount,
+				"conveyor_endpoint_block_count":  grid.ConveyorSystemEndpointBlockCount,
+				"conveyor_inventory_block_count": grid.ConveyorSystemInventoryBlockCount,
+				"conveyor_line_count":            grid.ConveyorSystemLineCount,
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, pt)
+	}
+	return points, nil
+}
+
+// gridsFromPoints turns the grid points of a batch back into the grids they
+// were made of, all but the EntityId and DistanceToPlayer the points leave
+// out. ok reports whether the batch holds grid points at all.
+func gridsFromPoints(points []*client.Point) (grids []TorchMetricsSessionGrid, ok bool, err error) {
+	for _, pt := range points {
+		if pt.Name() != "grid" {
+			continue
+		}
+		ok = true
+		fields, err := pt.Fields()
+		if err != nil {
+			return nil, ok, err
+		}
+		number := func(field string) float64 {
+			v, _ := fieldValue(fields[field])
+			return v
+		}
+		tags := pt.Tags()
+		owner, _ := strconv.ParseInt(tags["owner_steam_id"], 10, 64)
+		grids = append(grids, TorchMetricsSessionGrid{
+			DisplayName:                       tags["display_name"],
+			GridSize:                          tags["grid_size"],
+			BlocksCount:                       int(number("blocks_count")),
+			Mass:                              number("mass"),
+			LinearSpeed:                       number("linear_speed"),
+			OwnerSteamID:                      owner,
+			OwnerDisplayName:                  tags["owner_display_name"],
+			OwnerFactionTag:                   tags["owner_faction_tag"],
+			OwnerFactionName:                  tags["owner_faction_name"],
+			IsPowered:                         tags["filter_is_powered"] == "yes",
+			PCU:                               int(number("pcu")),
+			IsConcealed:                       tags["filter_is_concealed"] == "yes",
+			DampenersEnabled:                  number("dampeners_enabled") != 0,
+			IsStatic:                          tags["filter_is_static"] == "yes",
+			ConveyorSystemInventoryBlockCount: int(number("conveyor_inventory_block_count")),
+			ConveyorSystemEndpointBlockCount:  int(number("conveyor_endpoint_block_count")),
+			ConveyorSystemLineCount:           int(number("conveyor_line_count")),
+			ConveyorSystemConnectorCount:      int(number("conveyor_connector_count")),
+		})
+	}
+	return grids, ok, nil
+}
+
+func voxelPoints(host, kind string, voxels []TorchMetricsSessionAsteroidOrPlanet) ([]*client.Point, error) {
+	pt, err := client.NewPoint(
+		"voxel",
+		map[string]string{
+			"host": host,
+			"kind": kind,
+		},
+		map[string]interface{}{
+			"value": len(voxels),
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return []*client.Point{pt}, nil
+}
+
+func factionPoints(host string, factions []TorchMetricsSessionFaction) ([]*client.Point, error) {
+	var points []*client.Point
+	for _, faction := range factions {
+		npconly := 0
+		acceptHumans := 0
+		autoAcceptMember := 0
+		autoAcceptPeace := 0
+		enableFriendlyFire := 0
+		if faction.NPCOnly {
+			npconly++
+		}
+		if faction.AcceptHumans {
+			acceptHumans++
+		}
+		if faction.AutoAcceptMember {
+			autoAcceptMember++
+		}
+		if faction.AutoAcceptPeace {
+			autoAcceptPeace++
+		}
+		if faction.EnableFriendlyFire {
+			enableFriendlyFire++
+		}
+		pt, err := client.NewPoint(
+			"faction",
+			map[string]string{
+				"host":                        host,
+				"faction_id":                  fmt.Sprint(faction.FactionId),
+				"founder_id":                  fmt.Sprint(faction.FounderId),
+				"name":                        faction.Name,
+				"tag":                         strings.Replace(faction.Tag, "\\", "", -1),
+				"filter_accept_humans":        toStringBool(faction.AcceptHumans),
+				"filter_auto_accept_member":   toStringBool(faction.AutoAcceptMember),
+				"filter_auto_accept_peace":    toStringBool(faction.AutoAcceptPeace),
+				"filter_enable_friendly_fire": toStringBool(faction.EnableFriendlyFire),
+				"filter_npc_only":             toStringBool(faction.NPCOnly),
+			},
+			map[string]interface{}{
+				"npc_only":             npconly,
+				"auto_accept_humans":   acceptHumans,
+				"auto_accept_member":   autoAcceptMember,
+				"auto_accept_peace":    autoAcceptPeace,
+				"enable_friendly_fire": enableFriendlyFire,
+				"member_count":         faction.MemberCount,
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, pt)
+	}
+	return points, nil
+}
+
+func floatingObjectPoints(host string, floatingObjects []TorchMetricsSessionFloatingObject) ([]*client.Point, error) {
+	var points []*client.Point
+	for _, floatingObject := range floatingObjects {
+		pt, err := client.NewPoint(
+			"floating_object",
+			map[string]string{
+				"host":         host,
+				"display_name": floatingObject.TypeDisplayName,
+				"kind":         floatingObject.Kind,
+			},
+			map[string]interface{}{
+				"distance_to_player": floatingObject.DistanceToPlayer,
+				"linear_speed":       floatingObject.LinearSpeed,
+				"mass":               floatingObject.Mass,
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, pt)
+	}
+	return points, nil
+}
+
+func toStringBool(val bool) string {
+	switch val {
+	case true:
+		return "yes"
+	default:
+		return "no"
+	}
+}
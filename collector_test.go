@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCollectorsGolden(t *testing.T) {
+	h := newHarness(t, "testdata/torch")
+	for name := range h.collectors {
+		t.Run(name, func(t *testing.T) {
+			checkGolden(t, name, h.collect(name))
+		})
+	}
+}
+
+func TestGridsFromPoints(t *testing.T) {
+	grids := []TorchMetricsSessionGrid{
+		{DisplayName: "Base", GridSize: "Large", BlocksCount: 900, Mass: 12.5, LinearSpeed: 3, OwnerSteamID: 76561197960287930, OwnerDisplayName: "Alice", OwnerFactionTag: "RED", OwnerFactionName: "Red Dawn", IsPowered: true, PCU: 9000, DampenersEnabled: true, IsStatic: true, ConveyorSystemInventoryBlockCount: 1, ConveyorSystemEndpointBlockCount: 2, ConveyorSystemLineCount: 3, ConveyorSystemConnectorCount: 4},
+		{DisplayName: "Drone", GridSize: "Small", IsConcealed: true},
+	}
+	points, err := gridPoints(testHost, grids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok, err := gridsFromPoints(points)
+	if err != nil || !ok {
+		t.Fatalf("got %v %v", ok, err)
+	}
+	if !reflect.DeepEqual(got, grids) {
+		t.Errorf("got\n%+v\nwant\n%+v", got, grids)
+	}
+	if _, ok, _ := gridsFromPoints(nil); ok {
+		t.Error("grids in an empty batch")
+	}
+}
+
+func TestServerCollectorSaves(t *testing.T) {
+	h, f, _ := newFakeTorchHarness(t)
+
+	if got := h.collect("server"); strings.Contains(got, "\nsave,") {
+		t.Errorf("first scrape reported a save:\n%s", got)
+	}
+
+	f.Save(7500 * time.Millisecond)
+	h.clock.Advance(h.exporter.Interval)
+	got := h.collect("server")
+	for _, want := range []string{
+		"save,host=http://torch:8080,world_name=Fake\\ World duration=7.5,slow=1i",
+		"alert,host=http://torch:8080,rule=save_duration,world_name=Fake\\ World message=\"world save took 7.5s\",threshold=5,value=7.5",
+		"save_stats,host=http://torch:8080,world_name=Fake\\ World count=1i,p50=7.5,p95=7.5",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+}
+
+func TestFakeTorchPipeline(t *testing.T) {
+	h, f, clock := newFakeTorchHarness(t)
+
+	f.Join(76561197960287930)
+	clock.Advance(4 * time.Second)
+	f.SpawnGrid(TorchMetricsSessionGrid{DisplayName: "Ship", EntityId: 1, PCU: 500, IsPowered: true})
+
+	if got := h.collect("players"); !strings.Contains(got, "players,host=http://torch:8080,steam_id=76561197960287930,type=Joined value=1i 1541332800000000000") {
+		t.Errorf("unexpected player points:\n%s", got)
+	}
+	if got := h.collect("players"); got != "" {
+		t.Errorf("player events were returned twice:\n%s", got)
+	}
+	if got := h.collect("grids"); !strings.Contains(got, "display_name=Ship,filter_is_concealed=no,filter_is_powered=yes") {
+		t.Errorf("unexpected grid points:\n%s", got)
+	}
+	if got := h.collect("server"); !strings.Contains(got, "players=1i") || !strings.Contains(got, "used_pcu=500i") {
+		t.Errorf("unexpected server points:\n%s", got)
+	}
+
+	f.Restart(0)
+	if got := h.collect("players"); !strings.Contains(got, "type=Left") {
+		t.Errorf("restart did not disconnect players:\n%s", got)
+	}
+}
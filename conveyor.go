@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/pkg/errors"
+)
+
+// ConveyorWeights weigh the conveyor counts of a grid into its conveyor
+// complexity score, the best predictor of sim lag Torch reports.
+type ConveyorWeights struct {
+	Lines       float64
+	Endpoints   float64
+	Inventories float64
+	Connectors  float64
+}
+
+// DefaultConveyorWeights count every conveyor line, endpoint, inventory and
+// connector once.
+var DefaultConveyorWeights = ConveyorWeights{Lines: 1, Endpoints: 1, Inventories: 1, Connectors: 1}
+
+// ParseConveyorWeights parses comma separated key=value pairs, e.g.
+// "lines=1,inventories=2". Missing keys keep their default weight.
+func ParseConveyorWeights(s string) (ConveyorWeights, error) {
+	w := DefaultConveyorWeights
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return w, errors.Errorf("conveyor weight %q is not key=value", pair)
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil {
+			return w, errors.Wrapf(err, "conveyor weight %q", pair)
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "lines":
+			w.Lines = v
+		case "endpoints":
+			w.Endpoints = v
+		case "inventories":
+			w.Inventories = v
+		case "connectors":
+			w.Connectors = v
+		default:
+			return w, errors.Errorf("unknown conveyor weight %q", kv[0])
+		}
+	}
+	return w, nil
+}
+
+func (w ConveyorWeights) String() string {
+	return fmt.Sprintf("lines=%v,endpoints=%v,inventories=%v,connectors=%v", w.Lines, w.Endpoints, w.Inventories, w.Connectors)
+}
+
+// Score returns the conveyor complexity of a grid.
+func (w ConveyorWeights) Score(grid TorchMetricsSessionGrid) float64 {
+	return w.Lines*float64(grid.ConveyorSystemLineCount) +
+		w.Endpoints*float64(grid.ConveyorSystemEndpointBlockCount) +
+		w.Inventories*float64(grid.ConveyorSystemInventoryBlockCount) +
+		w.Connectors*float64(grid.ConveyorSystemConnectorCount)
+}
+
+// ConveyorRanker is a processor that scores the conveyor complexity of every
+// grid of a grids scrape and sums it up per owner and faction. The Top
+// grids, owners and factions are added as "conveyor_grid", "conveyor_owner"
+// and "conveyor_faction" points with their rank, so admins know which bases
+// to look at first. The scores of the others are not written.
+//
+// Grids and owners scoring above GridThreshold and OwnerThreshold raise
+// an alert, once until they drop below again, whether they are in the Top
+// or not. 0 disables the alerts.
+type ConveyorRanker struct {
+	Weights        ConveyorWeights
+	Top            int
+	GridThreshold  float64
+	OwnerThreshold float64
+	Clock          Clock
+
+	host    string
+	mu      sync.Mutex
+	alerted map[string]bool
+}
+
+func NewConveyorRanker(host string, top int, clock Clock) *ConveyorRanker {
+	return &ConveyorRanker{
+		Weights: DefaultConveyorWeights,
+		Top:     top,
+		Clock:   clock,
+		host:    host,
+		alerted: make(map[string]bool),
+	}
+}
+
+func (r *ConveyorRanker) Name() string {
+	return "conveyors"
+}
+
+func (r *ConveyorRanker) Process(points []*client.Point) ([]*client.Point, error) {
+	grids, ok, err := gridsFromPoints(points)
+	if err != nil || !ok {
+		return points, err
+	}
+	ranked, err := r.Rank(grids, r.Clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	return append(points[:len(points):len(points)], ranked...), nil
+}
+
+// conveyorTotal is the summed up score of an owner or faction.
+type conveyorTotal struct {
+	key   string
+	tags  map[string]string
+	score float64
+	grids int
+	max   float64
+}
+
+func (t *conveyorTotal) add(score float64) {
+	t.score += score
+	t.grids++
+	if score > t.max {
+		t.max = score
+	}
+}
+
+// Rank scores grids and returns the rankings and alerts at now.
+func (r *ConveyorRanker) Rank(grids []TorchMetricsSessionGrid, now time.Time) ([]*client.Point, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	type scored struct {
+		grid  TorchMetricsSessionGrid
+		tag   string
+		score float64
+	}
+	all := make([]scored, 0, len(grids))
+	owners := make(map[string]*conveyorTotal)
+	factions := make(map[string]*conveyorTotal)
+	for _, grid := range grids {
+		s := scored{grid, strings.Replace(grid.OwnerFactionTag, "\\", "", -1), r.Weights.Score(grid)}
+		all = append(all, s)
+
+		if grid.OwnerSteamID != 0 {
+			id := fmt.Sprint(grid.OwnerSteamID)
+			if owners[id] == nil {
+				owners[id] = &conveyorTotal{key: id, tags: map[string]string{
+					"host":               r.host,
+					"owner_steam_id":     id,
+					"owner_display_name": grid.OwnerDisplayName,
+					"owner_faction_tag":  s.tag,
+				}}
+			}
+			owners[id].add(s.score)
+		}
+		if s.tag != "" {
+			if factions[s.tag] == nil {
+				factions[s.tag] = &conveyorTotal{key: s.tag, tags: map[string]string{
+					"host":         r.host,
+					"faction_tag":  s.tag,
+					"faction_name": grid.OwnerFactionName,
+				}}
+			}
+			factions[s.tag].add(s.score)
+		}
+	}
+
+	var points []*client.Point
+	sort.SliceStable(all, func(i, j int) bool { return all[i].score > all[j].score })
+	for i, s := range all {
+		if i >= r.Top {
+			break
+		}
+		pt, err := client.NewPoint(
+			"conveyor_grid",
+			map[string]string{
+				"host":               r.host,
+				"display_name":       s.grid.DisplayName,
+				"owner_display_name": s.grid.OwnerDisplayName,
+				"owner_faction_tag":  s.tag,
+			},
+			map[string]interface{}{
+				"rank":        i + 1,
+				"score":       s.score,
+				"lines":       s.grid.ConveyorSystemLineCount,
+				"endpoints":   s.grid.ConveyorSystemEndpointBlockCount,
+				"inventories": s.grid.ConveyorSystemInventoryBlockCount,
+				"connectors":  s.grid.ConveyorSystemConnectorCount,
+			},
+			now,
+		)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, pt)
+	}
+	for _, ranking := range []struct {
+		measurement string
+		totals      map[string]*conveyorTotal
+	}{
+		{"conveyor_owner", owners},
+		{"conveyor_faction", factions},
+	} {
+		ranked, err := r.rankTotals(ranking.measurement, ranking.totals, now)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, ranked...)
+	}
+
+	// Alert on everything above a threshold, not only the top.
+	var alerts []*Alert
+	alerted := make(map[string]bool)
+	if r.GridThreshold > 0 {
+		for _, s := range all {
+			if s.score <= r.GridThreshold {
+				continue
+			}
+			key := "grid:" + fmt.Sprint(s.grid.OwnerSteamID) + ":" + s.grid.DisplayName
+			alerted[key] = true
+			if r.alerted[key] {
+				continue
+			}
+			alerts = append(alerts, &Alert{
+				Rule:      "conveyor_grid",
+				Message:   fmt.Sprintf("grid %s of %s has a conveyor score of %v", s.grid.DisplayName, s.grid.OwnerDisplayName, s.score),
+				Value:     s.score,
+				Threshold: r.GridThreshold,
+				Tags: map[string]string{
+					"display_name":       s.grid.DisplayName,
+					"owner_display_name": s.grid.OwnerDisplayName,
+				},
+			})
+		}
+	}
+	if r.OwnerThreshold > 0 {
+		for _, owner := range sortedConveyorTotals(owners) {
+			if owner.score <= r.OwnerThreshold {
+				continue
+			}
+			key := "owner:" + owner.key
+			alerted[key] = true
+			if r.alerted[key] {
+				continue
+			}
+			alerts = append(alerts, &Alert{
+				Rule:      "conveyor_owner",
+				Message:   fmt.Sprintf("grids of %s have a conveyor score of %v", owner.tags["owner_display_name"], owner.score),
+				Value:     owner.score,
+				Threshold: r.OwnerThreshold,
+				Tags: map[string]string{
+					"owner_steam_id":     owner.key,
+					"owner_display_name": owner.tags["owner_display_name"],
+				},
+			})
+		}
+	}
+	r.alerted = alerted
+	for _, alert := range alerts {
+		alert.Time = now
+		alert.Log()
+		pt, err := alert.Point(r.host)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, pt)
+	}
+	return points, nil
+}
+
+func (r *ConveyorRanker) rankTotals(measurement string, totals map[string]*conveyorTotal, now time.Time) ([]*client.Point, error) {
+	var points []*client.Point
+	for i, t := range sortedConveyorTotals(totals) {
+		if i >= r.Top {
+			break
+		}
+		pt, err := client.NewPoint(
+			measurement,
+			t.tags,
+			map[string]interface{}{
+				"rank":      i + 1,
+				"score":     t.score,
+				"grids":     t.grids,
+				"max_score": t.max,
+			},
+			now,
+		)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, pt)
+	}
+	return points, nil
+}
+
+// sortedConveyorTotals orders totals by score, ties by key.
+func sortedConveyorTotals(totals map[string]*conveyorTotal) []*conveyorTotal {
+	sorted := make([]*conveyorTotal, 0, len(totals))
+	for _, t := range totals {
+		sorted = append(sorted, t)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].score != sorted[j].score {
+			return sorted[i].score > sorted[j].score
+		}
+		return sorted[i].key < sorted[j].key
+	})
+	return sorted
+}
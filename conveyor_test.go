@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseConveyorWeights(t *testing.T) {
+	w, err := ParseConveyorWeights("inventories=2, connectors=4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ConveyorWeights{Lines: 1, Endpoints: 1, Inventories: 2, Connectors: 4}); w != want {
+		t.Errorf("got %v, want %v", w, want)
+	}
+	if w, err := ParseConveyorWeights(DefaultConveyorWeights.String()); err != nil || w != DefaultConveyorWeights {
+		t.Errorf("defaults do not round trip: %v %v", w, err)
+	}
+	for _, s := range []string{"lines", "pipes=1", "lines=many"} {
+		if _, err := ParseConveyorWeights(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestConveyorRanker(t *testing.T) {
+	r := NewConveyorRanker(testHost, 2, NewFakeClock(testEpoch))
+	r.Weights = ConveyorWeights{Lines: 1, Endpoints: 1, Inventories: 2, Connectors: 4}
+	r.GridThreshold = 300
+	r.OwnerThreshold = 150
+
+	grids := []TorchMetricsSessionGrid{
+		{EntityId: 1, DisplayName: "Base", OwnerSteamID: 3, OwnerDisplayName: "Carol", OwnerFactionTag: "R\\ED", OwnerFactionName: "Red Dawn", ConveyorSystemLineCount: 300, ConveyorSystemInventoryBlockCount: 40},
+		{EntityId: 2, DisplayName: "Hauler", OwnerSteamID: 1, OwnerDisplayName: "Alice", OwnerFactionTag: "R\\ED", OwnerFactionName: "Red Dawn", ConveyorSystemLineCount: 50},
+		{EntityId: 3, DisplayName: "Outpost", OwnerSteamID: 1, OwnerDisplayName: "Alice", OwnerFactionTag: "R\\ED", OwnerFactionName: "Red Dawn", ConveyorSystemEndpointBlockCount: 100, ConveyorSystemConnectorCount: 5},
+		{EntityId: 4, DisplayName: "Drone", ConveyorSystemLineCount: 10},
+	}
+	rank := func() string {
+		points, err := r.Rank(grids, testEpoch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sink := NewMemorySink()
+		sink.Write(points)
+		return sink.LineProtocol()
+	}
+
+	got := rank()
+	for _, want := range []string{
+		"conveyor_grid,display_name=Base,host=http://torch:8080,owner_display_name=Carol,owner_faction_tag=RED connectors=0i,endpoints=0i,inventories=40i,lines=300i,rank=1i,score=380 ",
+		"conveyor_grid,display_name=Outpost,host=http://torch:8080,owner_display_name=Alice,owner_faction_tag=RED connectors=5i,endpoints=100i,inventories=0i,lines=0i,rank=2i,score=120 ",
+		"conveyor_owner,host=http://torch:8080,owner_display_name=Carol,owner_faction_tag=RED,owner_steam_id=3 grids=1i,max_score=380,rank=1i,score=380 ",
+		"conveyor_owner,host=http://torch:8080,owner_display_name=Alice,owner_faction_tag=RED,owner_steam_id=1 grids=2i,max_score=120,rank=2i,score=170 ",
+		"conveyor_faction,faction_name=Red\\ Dawn,faction_tag=RED,host=http://torch:8080 grids=3i,max_score=380,rank=1i,score=550 ",
+		"alert,display_name=Base,host=http://torch:8080,owner_display_name=Carol,rule=conveyor_grid message=\"grid Base of Carol has a conveyor score of 380\",threshold=300,value=380 ",
+		"alert,host=http://torch:8080,owner_display_name=Carol,owner_steam_id=3,rule=conveyor_owner message=\"grids of Carol have a conveyor score of 380\",threshold=150,value=380 ",
+		"alert,host=http://torch:8080,owner_display_name=Alice,owner_steam_id=1,rule=conveyor_owner message=\"grids of Alice have a conveyor score of 170\",threshold=150,value=170 ",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "Hauler") || strings.Contains(got, "Drone") {
+		t.Errorf("grids beyond the top 2 were ranked:\n%s", got)
+	}
+
+	if got := rank(); strings.Contains(got, "alert,") {
+		t.Errorf("repeated alerts:\n%s", got)
+	}
+	// Below the threshold and back again alerts again.
+	grids[0].ConveyorSystemLineCount = 100
+	rank()
+	grids[0].ConveyorSystemLineCount = 300
+	if got := rank(); !strings.Contains(got, "rule=conveyor_grid") {
+		t.Errorf("no alert after dropping below the threshold:\n%s", got)
+	}
+
+	// As a processor, the rankings follow the grid points of a scrape.
+	points, err := gridPoints(testHost, grids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	processed, err := r.Process(points)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(processed) - len(points); n != 5 {
+		t.Errorf("got %d conveyor points, want 5", n)
+	}
+	if processed, _ := r.Process(processed[:0]); len(processed) != 0 {
+		t.Errorf("ranked a batch without grids: %v", processed)
+	}
+
+	// Alerts need no rankings.
+	r = NewConveyorRanker(testHost, 0, NewFakeClock(testEpoch))
+	r.GridThreshold = 300
+	got = rank()
+	if !strings.Contains(got, "rule=conveyor_grid") || strings.Contains(got, "conveyor_grid,") || strings.Contains(got, "conveyor_owner,") {
+		t.Errorf("want only the grid alert without a top:\n%s", got)
+	}
+}
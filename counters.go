@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// TorchCounters are the cumulative fields reported by Torch. They are not
+// derived by default, as their _delta and _rate fields change the schema of
+// the points.
+const TorchCounters = "server.total_time,process.gc_collection_count0,process.gc_collection_count1,process.gc_collection_count2"
+
+// counterStale is how long a series may go unseen before its last sample is
+// forgotten.
+const counterStale = time.Hour
+
+// ParseCounters parses a comma separated list of measurement.field counters
+// into the fields per measurement.
+func ParseCounters(s string) (map[string][]string, error) {
+	counters := make(map[string][]string)
+	for _, counter := range strings.Split(s, ",") {
+		counter = strings.TrimSpace(counter)
+		if counter == "" {
+			continue
+		}
+		i := strings.Index(counter, ".")
+		if i <= 0 || i == len(counter)-1 {
+			return nil, fmt.Errorf("counter %q is not measurement.field", counter)
+		}
+		counters[counter[:i]] = append(counters[counter[:i]], counter[i+1:])
+	}
+	return counters, nil
+}
+
+// CounterRates is a processor that derives per-interval changes of
+// cumulative counters: for every configured field it adds <field>_delta,
+// the increase since the previous point of the same series, and
+// <field>_rate, that increase per second.
+//
+// A counter that went down was reset and counts from zero again: the delta
+// is its current value. So are all counters of a host whose previous sample
+// was taken before a server restart, even if they already grew past their
+// old value. A restart shows as a drop of server.total_time, which is game
+// time and grows slower than the clock while the sim speed is below 1, so
+// only the drop counts. The first point of a series has nothing to compare
+// to and gets no derived fields.
+type CounterRates struct {
+	Counters map[string][]string
+	Clock    Clock
+
+	mu   sync.Mutex
+	last map[string]counterSample
+	// server is the last server.total_time of a host, restarted the time
+	// of the last server point before its server restarted.
+	server    map[string]counterSample
+	restarted map[string]time.Time
+}
+
+type counterSample struct {
+	value float64
+	time  time.Time
+}
+
+func NewCounterRates(counters map[string][]string, clock Clock) *CounterRates {
+	return &CounterRates{
+		Counters:  counters,
+		Clock:     clock,
+		last:      make(map[string]counterSample),
+		server:    make(map[string]counterSample),
+		restarted: make(map[string]time.Time),
+	}
+}
+
+func (c *CounterRates) Name() string {
+	return "counters"
+}
+
+func (c *CounterRates) Process(points []*client.Point) ([]*client.Point, error) {
+	now := c.Clock.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	processed := make([]*client.Point, len(points))
+	copy(processed, points)
+	for i, pt := range points {
+		counters := c.Counters[pt.Name()]
+		if len(counters) == 0 && pt.Name() != "server" {
+			continue
+		}
+		fields, err := pt.Fields()
+		if err != nil {
+			return nil, err
+		}
+		ts := pt.Time()
+		if ts.IsZero() {
+			ts = now
+		}
+		tags := pt.Tags()
+		host := tags["host"]
+		if uptime, ok := fieldValue(fields["total_time"]); ok && pt.Name() == "server" {
+			if last, ok := c.server[host]; ok && uptime < last.value {
+				c.restarted[host] = last.time
+			}
+			c.server[host] = counterSample{value: uptime, time: ts}
+		}
+		restarted, wasRestarted := c.restarted[host]
+		derived := false
+		for _, field := range counters {
+			value, ok := fieldValue(fields[field])
+			if !ok {
+				continue
+			}
+			key := storeKey(pt.Name(), field, tags)
+			last, seen := c.last[key]
+			c.last[key] = counterSample{value: value, time: ts}
+			if !seen {
+				continue
+			}
+			delta := value - last.value
+			if delta < 0 || wasRestarted && !last.time.After(restarted) {
+				log.Printf("counter %s reset from %v to %v", key, last.value, value)
+				delta = value
+			}
+			fields[field+"_delta"] = delta
+			if elapsed := ts.Sub(last.time).Seconds(); elapsed > 0 {
+				fields[field+"_rate"] = delta / elapsed
+			}
+			derived = true
+		}
+		if !derived {
+			continue
+		}
+		enriched, err := client.NewPoint(pt.Name(), tags, fields, pt.Time())
+		if err != nil {
+			return nil, err
+		}
+		processed[i] = enriched
+	}
+
+	for key, last := range c.last {
+		if now.Sub(last.time) > counterStale {
+			delete(c.last, key)
+		}
+	}
+	return processed, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+func TestParseCounters(t *testing.T) {
+	counters, err := ParseCounters(TorchCounters + ", exporter_sink.writes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := counters["process"]; len(got) != 3 || got[2] != "gc_collection_count2" {
+		t.Errorf("unexpected process counters %q", got)
+	}
+	if got := counters["exporter_sink"]; len(got) != 1 || got[0] != "writes" {
+		t.Errorf("unexpected exporter_sink counters %q", got)
+	}
+	for _, s := range []string{"total_time", ".total_time", "server."} {
+		if _, err := ParseCounters(s); err == nil {
+			t.Errorf("parsed %q", s)
+		}
+	}
+}
+
+func TestCounterRates(t *testing.T) {
+	h, f, clock := newFakeTorchHarness(t)
+	counters, err := ParseCounters(TorchCounters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.exporter.Processors = []Processor{NewCounterRates(counters, clock)}
+
+	if got := h.collect("process"); strings.Contains(got, "_delta") {
+		t.Errorf("derived fields on the first scrape:\n%s", got)
+	}
+	h.collect("server")
+
+	clock.Advance(10 * time.Second)
+	f.CollectGarbage(2)
+	f.CollectGarbage(0)
+	got := h.collect("process")
+	for _, want := range []string{
+		"gc_collection_count0_delta=2,gc_collection_count0_rate=0.2,",
+		"gc_collection_count1_delta=1,gc_collection_count1_rate=0.1,",
+		"gc_collection_count2_delta=1,gc_collection_count2_rate=0.1,",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %s in\n%s", want, got)
+		}
+	}
+	if got := h.collect("server"); !strings.Contains(got, "total_time_delta=10,total_time_rate=1,") {
+		t.Errorf("unexpected server point\n%s", got)
+	}
+
+	// A restart resets the counters, deltas count from zero.
+	clock.Advance(10 * time.Minute)
+	h.collect("process")
+	h.collect("server")
+	f.Restart(time.Minute)
+	clock.Advance(2 * time.Minute)
+	f.CollectGarbage(0)
+	got = h.collect("process")
+	if !strings.Contains(got, "gc_collection_count0_delta=1,") || !strings.Contains(got, "gc_collection_count2_delta=0,") {
+		t.Errorf("unexpected process point after a restart\n%s", got)
+	}
+	if got := h.collect("server"); !strings.Contains(got, "total_time_delta=60,total_time_rate=0.5,") {
+		t.Errorf("unexpected server point after a restart\n%s", got)
+	}
+
+	// Counters that grew past their old value by the next scrape are reset
+	// all the same, the drop of the uptime gives the restart away.
+	clock.Advance(30 * time.Minute)
+	f.CollectGarbage(2)
+	f.CollectGarbage(2)
+	if got := h.collect("process"); !strings.Contains(got, "gc_collection_count2=2i,") {
+		t.Fatalf("unexpected process point before a long restart\n%s", got)
+	}
+	if got := h.collect("server"); !strings.Contains(got, "total_time=1860i,") {
+		t.Fatalf("unexpected server point before a long restart\n%s", got)
+	}
+	f.Restart(time.Minute)
+	clock.Advance(20 * time.Minute)
+	for i := 0; i < 5; i++ {
+		f.CollectGarbage(2)
+	}
+	if got := h.collect("server"); !strings.Contains(got, "total_time=1140i,total_time_delta=1140,") {
+		t.Errorf("unexpected server point after a long restart\n%s", got)
+	}
+	if got := h.collect("process"); !strings.Contains(got, "gc_collection_count2=5i,gc_collection_count2_delta=5,") {
+		t.Errorf("unexpected process point after a long restart\n%s", got)
+	}
+}
+
+func TestCounterRatesSlowSimSpeed(t *testing.T) {
+	c := NewCounterRates(map[string][]string{"process": {"gc_collection_count2"}}, NewFakeClock(testEpoch))
+	scrape := func(elapsed time.Duration, uptime, count int) string {
+		ts := testEpoch.Add(elapsed)
+		server, err := client.NewPoint("server", map[string]string{"host": testHost}, map[string]interface{}{"total_time": uptime}, ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		process, err := client.NewPoint("process", map[string]string{"host": testHost}, map[string]interface{}{"gc_collection_count2": count}, ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		processed, err := c.Process([]*client.Point{server, process})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return processed[1].String()
+	}
+
+	// At a sim speed of 0.5 the game time of a freshly started server
+	// falls behind the scrape interval, which is no restart.
+	scrape(0, 2, 1)
+	if got := scrape(10*time.Second, 7, 3); !strings.Contains(got, "gc_collection_count2_delta=2,") {
+		t.Errorf("reset without a restart: %s", got)
+	}
+	if got := scrape(20*time.Second, 3, 4); !strings.Contains(got, "gc_collection_count2_delta=4,") {
+		t.Errorf("no reset after a restart: %s", got)
+	}
+	if got := scrape(30*time.Second, 8, 6); !strings.Contains(got, "gc_collection_count2_delta=2,") {
+		t.Errorf("reset twice after a restart: %s", got)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+const (
+	dashboardTop    = 10
+	dashboardEvents = 25
+)
+
+// dashboardSeries are the fields whose history is shown as sparklines.
+var dashboardSeries = map[string][]string{
+	"server": {"sim_speed", "sim_cpu_load", "players", "used_pcu"},
+	"load":   {"server_cpu_load", "server_thread_load", "server_simulation_ratio"},
+}
+
+// Dashboard is a sink that keeps what the collectors fetched in memory and
+// serves it as a live web page: the current server state, the history of
+// the server and load values in Store for sparklines, the biggest grids and
+// factions and the most recent events.
+type Dashboard struct {
+	Store *Store
+	Clock Clock
+
+	mu       sync.Mutex
+	server   map[string]interface{}
+	grids    []map[string]interface{}
+	factions []map[string]interface{}
+	events   *dashboardRing
+}
+
+func NewDashboard(store *Store, clock Clock) *Dashboard {
+	return &Dashboard{
+		Store:  store,
+		Clock:  clock,
+		events: newDashboardRing(dashboardEvents),
+	}
+}
+
+func (d *Dashboard) Name() string {
+	return "dashboard"
+}
+
+func (d *Dashboard) Write(points []*client.Point) error {
+	now := d.Clock.Now()
+	var grids, factions []map[string]interface{}
+	var sawGrids, sawFactions bool
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, pt := range points {
+		entry, err := pointEntry(pt, now)
+		if err != nil {
+			return err
+		}
+		switch pt.Name() {
+		case "server":
+			d.server = entry
+		case "grid":
+			sawGrids = true
+			grids = append(grids, entry)
+		case "faction":
+			sawFactions = true
+			factions = append(factions, entry)
+		default:
+			if occurrences[pt.Name()] {
+				d.events.add(entry)
+			}
+		}
+	}
+
+	// Every run of the grids and factions collectors reports all of them.
+	if sawGrids {
+		d.grids = dashboardTopN(grids, "pcu")
+	}
+	if sawFactions {
+		d.factions = dashboardTopN(factions, "member_count")
+	}
+	return nil
+}
+
+func dashboardTopN(entries []map[string]interface{}, field string) []map[string]interface{} {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, _ := fieldValue(entries[i][field])
+		b, _ := fieldValue(entries[j][field])
+		return a > b
+	})
+	if len(entries) > dashboardTop {
+		entries = entries[:dashboardTop]
+	}
+	return entries
+}
+
+type dashboardData struct {
+	Time     time.Time                `json:"time"`
+	Server   map[string]interface{}   `json:"server"`
+	History  map[string][]StorePoint  `json:"history"`
+	Grids    []map[string]interface{} `json:"grids"`
+	Factions []map[string]interface{} `json:"factions"`
+	Events   []map[string]interface{} `json:"events"`
+}
+
+// Data returns everything the dashboard shows.
+func (d *Dashboard) Data() *dashboardData {
+	data := &dashboardData{
+		Time:    d.Clock.Now(),
+		History: make(map[string][]StorePoint),
+	}
+	for measurement, fields := range dashboardSeries {
+		for _, field := range fields {
+			series, _ := d.Store.Query(StoreQuery{Measurement: measurement, Field: field})
+			for _, s := range series {
+				data.History[field] = append(data.History[field], s.Points...)
+			}
+			// Series of changed tags, e.g. a new version, interleave.
+			history := data.History[field]
+			sort.SliceStable(history, func(i, j int) bool { return history[i].Time.Before(history[j].Time) })
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	data.Server = d.server
+	data.Grids = d.grids
+	data.Factions = d.factions
+	events := d.events.list()
+	// Newest first.
+	for i := len(events) - 1; i >= 0; i-- {
+		data.Events = append(data.Events, events[i].(map[string]interface{}))
+	}
+	return data
+}
+
+// Register adds the dashboard page at /dashboard and its data at
+// /dashboard/data to mux.
+func (d *Dashboard) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/dashboard", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, dashboardHTML)
+	})
+	mux.HandleFunc("/dashboard/data", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d.Data())
+	})
+}
+
+// dashboardRing keeps the last values added to it.
+type dashboardRing struct {
+	values []interface{}
+	next   int
+	full   bool
+}
+
+func newDashboardRing(size int) *dashboardRing {
+	return &dashboardRing{values: make([]interface{}, size)}
+}
+
+func (r *dashboardRing) add(v interface{}) {
+	if len(r.values) == 0 {
+		return
+	}
+	r.values[r.next] = v
+	r.next = (r.next + 1) % len(r.values)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// list returns the values oldest first.
+func (r *dashboardRing) list() []interface{} {
+	if !r.full {
+		return append([]interface{}(nil), r.values[:r.next]...)
+	}
+	return append(append([]interface{}(nil), r.values[r.next:]...), r.values[:r.next]...)
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Space Engineers</title>
+<style>
+body { font-family: sans-serif; background: #15181d; color: #d8dee9; margin: 1.5em; }
+h1 { font-size: 1.4em; margin: 0 0 .2em; }
+h2 { font-size: 1em; color: #88c0d0; margin: 0 0 .5em; }
+.sub { color: #7b8594; margin-bottom: 1.2em; }
+.cards { display: flex; flex-wrap: wrap; gap: 1em; margin-bottom: 1.2em; }
+.card { background: #1f242c; border-radius: 6px; padding: .8em 1em; min-width: 13em; }
+.value { font-size: 1.8em; }
+.bar { background: #2e3440; height: .5em; border-radius: 3px; margin-top: .4em; }
+.bar div { background: #a3be8c; height: 100%; border-radius: 3px; }
+.grid { display: grid; grid-template-columns: repeat(auto-fit, minmax(26em, 1fr)); gap: 1em; }
+table { border-collapse: collapse; width: 100%; font-size: .9em; }
+td, th { text-align: left; padding: .2em .5em; border-bottom: 1px solid #2e3440; }
+td.n, th.n { text-align: right; }
+svg { display: block; margin-top: .4em; }
+</style>
+</head>
+<body>
+<h1 id="name">Space Engineers</h1>
+<div class="sub" id="world"></div>
+<div class="cards">
+  <div class="card"><h2>Sim speed</h2><div class="value" id="sim_speed">-</div><svg id="spark_sim_speed" width="200" height="40"></svg></div>
+  <div class="card"><h2>Players</h2><div class="value" id="players">-</div><svg id="spark_players" width="200" height="40"></svg></div>
+  <div class="card"><h2>PCU</h2><div class="value" id="pcu">-</div><div class="bar"><div id="pcu_bar" style="width:0"></div></div><svg id="spark_used_pcu" width="200" height="40"></svg></div>
+  <div class="card"><h2>CPU load</h2><div class="value" id="cpu">-</div><svg id="spark_server_cpu_load" width="200" height="40"></svg></div>
+  <div class="card"><h2>Thread load</h2><div class="value" id="thread">-</div><svg id="spark_server_thread_load" width="200" height="40"></svg></div>
+</div>
+<div class="grid">
+  <div class="card"><h2>Biggest grids</h2><table id="grids"></table></div>
+  <div class="card"><h2>Biggest factions</h2><table id="factions"></table></div>
+  <div class="card"><h2>Recent events</h2><table id="events"></table></div>
+</div>
+<script>
+function esc(s) {
+  return String(s === undefined ? "" : s).replace(/[&<>"]/g, function(c) {
+    return {"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;"}[c];
+  });
+}
+function num(v, digits) {
+  return v === undefined ? "-" : Number(v).toLocaleString(undefined, {maximumFractionDigits: digits || 0});
+}
+function latest(points) {
+  return points && points.length ? points[points.length - 1].value : undefined;
+}
+function spark(id, points) {
+  var svg = document.getElementById(id), values = (points || []).map(function(p) { return p.value; });
+  if (values.length < 2) { svg.innerHTML = ""; return; }
+  var min = Math.min.apply(null, values), max = Math.max.apply(null, values), range = max - min || 1;
+  var points = values.map(function(v, i) {
+    return (i * 200 / (values.length - 1)).toFixed(1) + "," + (38 - (v - min) * 36 / range).toFixed(1);
+  });
+  svg.innerHTML = '<polyline fill="none" stroke="#88c0d0" stroke-width="1.5" points="' + points.join(" ") + '"/>';
+}
+function table(id, head, rows) {
+  document.getElementById(id).innerHTML = "<tr>" + head.map(function(h) {
+    return "<th" + (h[1] ? ' class="n"' : "") + ">" + h[0] + "</th>";
+  }).join("") + "</tr>" + rows.map(function(r) {
+    return "<tr>" + r.map(function(c, i) {
+      return "<td" + (head[i][1] ? ' class="n"' : "") + ">" + esc(c) + "</td>";
+    }).join("") + "</tr>";
+  }).join("");
+}
+function render(d) {
+  var s = d.server || {}, cpu = latest(d.history.server_cpu_load), thread = latest(d.history.server_thread_load);
+  document.getElementById("name").textContent = s.server_name || "Space Engineers";
+  document.getElementById("world").textContent = [s.world_name, s.version, "updated " + new Date(d.time).toLocaleTimeString()].filter(Boolean).join(" · ");
+  document.getElementById("sim_speed").textContent = num(s.sim_speed, 2);
+  document.getElementById("players").textContent = num(s.players) + " / " + num(s.max_players);
+  document.getElementById("pcu").textContent = num(s.used_pcu) + " / " + num(s.total_pcu);
+  document.getElementById("pcu_bar").style.width = s.total_pcu ? Math.min(100, 100 * s.used_pcu / s.total_pcu) + "%" : "0";
+  document.getElementById("cpu").textContent = cpu === undefined ? "-" : num(cpu, 1) + "%";
+  document.getElementById("thread").textContent = thread === undefined ? "-" : num(thread, 1) + "%";
+  ["sim_speed", "players", "used_pcu", "server_cpu_load", "server_thread_load"].forEach(function(field) {
+    spark("spark_" + field, d.history[field]);
+  });
+  table("grids", [["Grid"], ["Owner"], ["Blocks", 1], ["PCU", 1], ["Mass (t)", 1]], (d.grids || []).map(function(g) {
+    return [g.display_name, g.owner_display_name, num(g.blocks_count), num(g.pcu), num(g.mass / 1000, 1)];
+  }));
+  table("factions", [["Tag"], ["Name"], ["Members", 1]], (d.factions || []).map(function(f) {
+    return [f.tag, f.name, num(f.member_count)];
+  }));
+  table("events", [["Time"], ["Type"], ["Details"]], (d.events || []).map(function(e) {
+    return [new Date(e.time).toLocaleTimeString(), e.type || e.rule || e.measurement, e.text || e.message || e.steam_id || ""];
+  }));
+}
+function refresh() {
+  fetch("dashboard/data").then(function(r) { return r.json(); }).then(render).catch(function() {});
+}
+refresh();
+setInterval(refresh, 5000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+func TestDashboard(t *testing.T) {
+	h := newHarness(t, "testdata/torch")
+	store := NewStore(30*time.Second, h.clock)
+	d := NewDashboard(store, h.clock)
+	h.exporter.Sinks = append(h.exporter.Sinks, store, d)
+
+	// Of four scrapes, the first is beyond the history of 30s.
+	for i := 0; i < 4; i++ {
+		h.exporter.Tick()
+		h.clock.Advance(10 * time.Second)
+	}
+
+	mux := http.NewServeMux()
+	d.Register(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/dashboard/data", nil))
+	var data struct {
+		Server   map[string]interface{}
+		History  map[string][]StorePoint
+		Grids    []map[string]interface{}
+		Factions []map[string]interface{}
+		Events   []map[string]interface{}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &data); err != nil {
+		t.Fatal(err)
+	}
+
+	if data.Server["server_name"] != "Fankserver" || data.Server["used_pcu"] != 154320.0 {
+		t.Errorf("unexpected server %v", data.Server)
+	}
+	if n := len(data.History["sim_speed"]); n != 3 {
+		t.Fatalf("got %d sim speed samples, want 3", n)
+	}
+	if first := data.History["sim_speed"][0].Time; !first.Equal(testEpoch.Add(10 * time.Second)) {
+		t.Errorf("oldest sample from %s, want the second scrape", first)
+	}
+	cpu := data.History["server_cpu_load"]
+	if len(cpu) == 0 || cpu[len(cpu)-1].Value != 60.4 {
+		t.Errorf("unexpected cpu load history %v", cpu)
+	}
+	if len(data.Grids) != 2 || data.Grids[0]["display_name"] != "Red Ship" {
+		t.Errorf("unexpected grids %v", data.Grids)
+	}
+	if len(data.Factions) != 2 || data.Factions[0]["tag"] != "RED" {
+		t.Errorf("unexpected factions %v", data.Factions)
+	}
+	if len(data.Events) == 0 || data.Events[0]["measurement"] == nil {
+		t.Errorf("unexpected events %v", data.Events)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/dashboard", nil))
+	if !strings.Contains(w.Body.String(), "dashboard/data") {
+		t.Error("dashboard page does not load its data")
+	}
+}
+
+func TestDashboardHistoryOrder(t *testing.T) {
+	clock := NewFakeClock(testEpoch)
+	store := NewStore(time.Hour, clock)
+	d := NewDashboard(store, clock)
+
+	// An update and a rollback leave two series of the server version.
+	var points []*client.Point
+	for i, version := range []string{"1.188", "1.189", "1.188"} {
+		pt, err := client.NewPoint("server", map[string]string{"host": testHost, "version": version}, map[string]interface{}{"sim_speed": float64(i)}, testEpoch.Add(time.Duration(i-2)*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		points = append(points, pt)
+	}
+	if err := store.Write(points); err != nil {
+		t.Fatal(err)
+	}
+	history := d.Data().History["sim_speed"]
+	if len(history) != 3 {
+		t.Fatalf("got %d samples, want 3", len(history))
+	}
+	for i, p := range history {
+		if p.Value != float64(i) {
+			t.Errorf("got samples %v, want them by time", history)
+			break
+		}
+	}
+}
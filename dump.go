@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/pkg/errors"
+)
+
+// Dump formats.
+const (
+	DumpCSV     = "csv"
+	DumpParquet = "parquet"
+)
+
+// Dumper is a sink that writes the session grids and factions of every
+// grids and factions scrape to files, one file per table and snapshot named
+// <table>-<time>.<format>, e.g. grids-20181104T120000Z.csv. Every row holds
+// the snapshot time followed by all fields Torch reports, named like in the
+// Torch API. The points leave fields out, so the rows come from Grids and
+// Factions.
+type Dumper struct {
+	Dir    string
+	Format string
+	// Every is the minimum time between two snapshots of a table, 0 dumps
+	// every scrape.
+	Every time.Duration
+	// Keep is the number of snapshots kept per table, 0 keeps all.
+	Keep  int
+	Clock Clock
+	// Grids and Factions return the grids and factions the grid and
+	// faction points of a batch were made of, usually
+	// TorchMetrics.LastSessionGrids and LastSessionFactions. A nil func
+	// leaves its table out.
+	Grids    func() []TorchMetricsSessionGrid
+	Factions func() []TorchMetricsSessionFaction
+
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// NewDumper creates dir if it does not exist yet.
+func NewDumper(dir, format string, clock Clock) (*Dumper, error) {
+	if format != DumpCSV && format != DumpParquet {
+		return nil, errors.Errorf("unknown dump format %q", format)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "dump")
+	}
+	return &Dumper{
+		Dir:    dir,
+		Format: format,
+		Clock:  clock,
+		last:   make(map[string]time.Time),
+	}, nil
+}
+
+func (d *Dumper) Name() string {
+	return "dump"
+}
+
+// Write dumps the grids of a batch with grid points and the factions of a
+// batch with faction points, at most once per Every.
+func (d *Dumper) Write(points []*client.Point) error {
+	var grids, factions bool
+	for _, pt := range points {
+		switch pt.Name() {
+		case "grid":
+			grids = true
+		case "faction":
+			factions = true
+		}
+	}
+	now := d.Clock.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if grids && d.Grids != nil && d.due("grids", now) {
+		if err := d.write("grids", newDumpTable(now, d.Grids())); err != nil {
+			return err
+		}
+		d.last["grids"] = now
+	}
+	if factions && d.Factions != nil && d.due("factions", now) {
+		if err := d.write("factions", newDumpTable(now, d.Factions())); err != nil {
+			return err
+		}
+		d.last["factions"] = now
+	}
+	return nil
+}
+
+// due reports whether a snapshot of the table is due at now.
+func (d *Dumper) due(name string, now time.Time) bool {
+	last, ok := d.last[name]
+	return !ok || now.Sub(last) >= d.Every
+}
+
+func (d *Dumper) write(name string, table *dumpTable) error {
+	path := filepath.Join(d.Dir, name+"-"+table.time.UTC().Format("20060102T150405Z")+"."+d.Format)
+
+	// Readers never see partial dumps.
+	err := writeFileAtomic(path, func(w io.Writer) error {
+		if d.Format == DumpParquet {
+			return writeParquet(w, table)
+		}
+		return table.writeCSV(w)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "dump %s", name)
+	}
+	return d.rotate(name)
+}
+
+// rotate removes all but the newest Keep snapshots of a table.
+func (d *Dumper) rotate(name string) error {
+	if d.Keep <= 0 {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(d.Dir, name+"-*."+d.Format))
+	if err != nil {
+		return err
+	}
+	// The timestamps in the names sort chronologically.
+	sort.Strings(files)
+	for len(files) > d.Keep {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// dumpColumn is a column of a dump, its kind is one of reflect.String,
+// Int64, Float64 and Bool, or reflect.Struct for the snapshot time.
+type dumpColumn struct {
+	name string
+	kind reflect.Kind
+}
+
+type dumpTable struct {
+	time    time.Time
+	columns []dumpColumn
+	rows    [][]interface{}
+}
+
+// newDumpTable turns a slice of Torch structs into a table with a Time
+// column followed by a column per struct field. Integers are widened to
+// int64.
+func newDumpTable(now time.Time, slice interface{}) *dumpTable {
+	v := reflect.ValueOf(slice)
+	typ := v.Type().Elem()
+	t := &dumpTable{
+		time:    now,
+		columns: []dumpColumn{{"Time", reflect.Struct}},
+	}
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		name := field.Name
+		if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag != "" {
+			name = tag
+		}
+		kind := field.Type.Kind()
+		switch kind {
+		case reflect.Int, reflect.Int32, reflect.Int64, reflect.Uint64:
+			kind = reflect.Int64
+		}
+		t.columns = append(t.columns, dumpColumn{name, kind})
+	}
+
+	for i := 0; i < v.Len(); i++ {
+		elem := v.Index(i)
+		row := []interface{}{now}
+		for j := 0; j < elem.NumField(); j++ {
+			field := elem.Field(j)
+			switch t.columns[j+1].kind {
+			case reflect.Int64:
+				if field.Kind() == reflect.Uint64 {
+					row = append(row, int64(field.Uint()))
+				} else {
+					row = append(row, field.Int())
+				}
+			case reflect.String:
+				value := field.String()
+				// Torch escapes faction tags, the collectors strip that too.
+				if strings.HasSuffix(t.columns[j+1].name, "Tag") {
+					value = strings.Replace(value, "\\", "", -1)
+				}
+				row = append(row, value)
+			default:
+				row = append(row, field.Interface())
+			}
+		}
+		t.rows = append(t.rows, row)
+	}
+	return t
+}
+
+func (t *dumpTable) writeCSV(w io.Writer) error {
+	c := csv.NewWriter(w)
+	header := make([]string, len(t.columns))
+	for i, column := range t.columns {
+		header[i] = column.name
+	}
+	if err := c.Write(header); err != nil {
+		return err
+	}
+	for _, row := range t.rows {
+		record := make([]string, len(row))
+		for i, v := range row {
+			switch v := v.(type) {
+			case time.Time:
+				record[i] = v.UTC().Format(time.RFC3339)
+			case string:
+				record[i] = v
+			case int64:
+				record[i] = strconv.FormatInt(v, 10)
+			case float64:
+				record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+			case bool:
+				record[i] = strconv.FormatBool(v)
+			}
+		}
+		if err := c.Write(record); err != nil {
+			return err
+		}
+	}
+	c.Flush()
+	return c.Error()
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestDumper returns a dumper writing the grids and factions scrapes of
+// the harness to a directory the dumper creates in a temporary one.
+func newTestDumper(t *testing.T, format string) (*Dumper, *harness, string) {
+	h := newHarness(t, "testdata/torch")
+	dir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDumper(filepath.Join(dir, "dumps"), format, h.clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Grids = h.torch.LastSessionGrids
+	d.Factions = h.torch.LastSessionFactions
+	h.exporter.Sinks = append(h.exporter.Sinks, d)
+	return d, h, d.Dir
+}
+
+func TestDumperCSV(t *testing.T) {
+	_, h, dir := newTestDumper(t, DumpCSV)
+	defer os.RemoveAll(filepath.Dir(dir))
+
+	// Only grids and factions scrapes are dumped.
+	h.collect("server")
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Fatalf("server scrape dumped %v", files)
+	}
+	h.collect("grids")
+	h.collect("factions")
+	for _, name := range []string{"grids", "factions"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name+"-20181104T120000Z.csv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, "dump_"+name, string(b))
+	}
+}
+
+func TestDumperRotation(t *testing.T) {
+	d, h, dir := newTestDumper(t, DumpCSV)
+	defer os.RemoveAll(filepath.Dir(dir))
+	d.Every = time.Hour
+	d.Keep = 2
+
+	for i := 0; i < 4*6; i++ {
+		h.collect("grids")
+		h.collect("factions")
+		h.clock.Advance(10 * time.Minute)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"factions-20181104T140000Z.csv",
+		"factions-20181104T150000Z.csv",
+		"grids-20181104T140000Z.csv",
+		"grids-20181104T150000Z.csv",
+	}
+	if len(files) != len(want) {
+		t.Fatalf("got files %v, want %v", files, want)
+	}
+	for i, f := range files {
+		if filepath.Base(f) != want[i] {
+			t.Errorf("got file %s, want %s", filepath.Base(f), want[i])
+		}
+	}
+}
+
+// thriftFields is a Thrift struct decoded by field ID.
+type thriftFields map[int]interface{}
+
+// readThrift decodes a struct of the Thrift compact protocol, with binary
+// fields as strings, integers as int64, lists as []interface{} and structs
+// as thriftFields.
+func readThrift(t *testing.T, r *bytes.Reader) thriftFields {
+	fields := make(thriftFields)
+	last := 0
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b == 0 {
+			return fields
+		}
+		id := last + int(b>>4)
+		if b>>4 == 0 {
+			id = int(readThriftInt(t, r))
+		}
+		fields[id] = readThriftValue(t, r, b&0x0f)
+		last = id
+	}
+}
+
+func readThriftInt(t *testing.T, r *bytes.Reader) int64 {
+	v, err := binary.ReadVarint(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func readThriftValue(t *testing.T, r *bytes.Reader, typ byte) interface{} {
+	switch typ {
+	case thriftI32, thriftI64:
+		return readThriftInt(t, r)
+	case thriftBinary:
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	case thriftList:
+		b, err := r.ReadByte()
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := uint64(b >> 4)
+		if size == 15 {
+			if size, err = binary.ReadUvarint(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		list := []interface{}{}
+		for i := uint64(0); i < size; i++ {
+			list = append(list, readThriftValue(t, r, b&0x0f))
+		}
+		return list
+	case thriftStruct:
+		return readThrift(t, r)
+	}
+	t.Fatalf("unexpected thrift type %d", typ)
+	return nil
+}
+
+func TestDumperParquet(t *testing.T) {
+	_, h, dir := newTestDumper(t, DumpParquet)
+	defer os.RemoveAll(filepath.Dir(dir))
+
+	h.collect("grids")
+	b, err := ioutil.ReadFile(filepath.Join(dir, "grids-20181104T120000Z.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte("PAR1")) || !bytes.HasSuffix(b, []byte("PAR1")) {
+		t.Fatal("missing parquet magic")
+	}
+	footer := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	meta := readThrift(t, bytes.NewReader(b[len(b)-8-footer:len(b)-8]))
+
+	// FileMetaData: the schema root, then one element per column.
+	if meta[1] != int64(1) || meta[3] != int64(2) || meta[6] != "spaceengineers-metrics" {
+		t.Errorf("unexpected version %v, num_rows %v or created_by %v", meta[1], meta[3], meta[6])
+	}
+	schema := meta[2].([]interface{})
+	root := schema[0].(thriftFields)
+	if root[4] != "schema" || root[5] != int64(len(schema)-1) {
+		t.Errorf("unexpected schema root %v", root)
+	}
+	types := make(map[string]thriftFields)
+	for _, element := range schema[1:] {
+		column := element.(thriftFields)
+		types[column[4].(string)] = column
+	}
+	for _, tc := range []struct {
+		column    string
+		typ       int64
+		converted interface{}
+	}{
+		{"Time", parquetInt64, int64(parquetTimestampMillis)},
+		{"DisplayName", parquetByteArray, int64(parquetUTF8)},
+		{"EntityId", parquetInt64, nil},
+		{"Mass", parquetDouble, nil},
+		{"IsPowered", parquetBoolean, nil},
+	} {
+		column := types[tc.column]
+		if column[1] != tc.typ || column[3] != int64(parquetRequired) || column[6] != tc.converted {
+			t.Errorf("column %s: got %v, want type %d converted to %v", tc.column, column, tc.typ, tc.converted)
+		}
+	}
+
+	// A single row group, its chunks point to a data page each.
+	rowGroups := meta[4].([]interface{})
+	if len(rowGroups) != 1 {
+		t.Fatalf("got %d row groups, want 1", len(rowGroups))
+	}
+	rowGroup := rowGroups[0].(thriftFields)
+	chunks := rowGroup[1].([]interface{})
+	if len(chunks) != len(schema)-1 || rowGroup[3] != int64(2) {
+		t.Fatalf("got %d chunks of %v rows, want %d of 2", len(chunks), rowGroup[3], len(schema)-1)
+	}
+	var size int64
+	pages := make(map[string][]byte)
+	for _, chunk := range chunks {
+		column := chunk.(thriftFields)[3].(thriftFields)
+		name := column[3].([]interface{})[0].(string)
+		if column[1] != types[name][1] || column[4] != int64(parquetUncompressed) || column[5] != int64(2) {
+			t.Errorf("unexpected chunk of %s: %v", name, column)
+		}
+		offset := column[9].(int64)
+		r := bytes.NewReader(b[offset:])
+		header := readThrift(t, r)
+		data := header[5].(thriftFields)
+		if header[1] != int64(parquetDataPage) || data[1] != int64(2) || data[2] != int64(parquetPlain) {
+			t.Errorf("unexpected page header of %s: %v", name, header)
+		}
+		start := int64(len(b)) - int64(r.Len())
+		pages[name] = b[start : start+header[3].(int64)]
+		if end := start + header[3].(int64); column[7] != end-offset {
+			t.Errorf("chunk of %s is %v bytes, the page ends %d bytes in", name, column[7], end-offset)
+		}
+		size += column[7].(int64)
+	}
+	if rowGroup[2] != size {
+		t.Errorf("got a row group of %v bytes, the chunks sum up to %d", rowGroup[2], size)
+	}
+
+	// The snapshot time of both grids in milliseconds, and their names.
+	millis := make([]byte, 8)
+	binary.LittleEndian.PutUint64(millis, uint64(testEpoch.UnixNano()/int64(time.Millisecond)))
+	if got := pages["Time"]; !bytes.Equal(got, append(millis, millis...)) {
+		t.Errorf("got times %v", got)
+	}
+	var names bytes.Buffer
+	for _, name := range []string{"Red Ship", "Static Grid 4711"} {
+		binary.Write(&names, binary.LittleEndian, uint32(len(name)))
+		names.WriteString(name)
+	}
+	if got := pages["DisplayName"]; !bytes.Equal(got, names.Bytes()) {
+		t.Errorf("got display names %q", got)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/pkg/errors"
+)
+
+// eventEntries converts the occurrences among points (server events, player
+// joins and leaves, saves and alerts) into log entries, see pointEntry.
+func eventEntries(points []*client.Point, now time.Time) ([]map[string]interface{}, error) {
+	var entries []map[string]interface{}
+	for _, pt := range points {
+		if !occurrences[pt.Name()] {
+			continue
+		}
+		entry, err := pointEntry(pt, now)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// pointEntry flattens a point into an object holding its time, measurement
+// and all tags and fields. The comma separated tags of server events are
+// turned back into a list. Points without a timestamp are taken at now.
+func pointEntry(pt *client.Point, now time.Time) (map[string]interface{}, error) {
+	fields, err := pt.Fields()
+	if err != nil {
+		return nil, err
+	}
+	ts := pt.Time()
+	if ts.IsZero() {
+		ts = now
+	}
+
+	entry := map[string]interface{}{
+		"time":        ts.UTC().Format(time.RFC3339Nano),
+		"measurement": pt.Name(),
+	}
+	for k, v := range pt.Tags() {
+		entry[k] = v
+	}
+	for k, v := range fields {
+		entry[k] = v
+	}
+	switch pt.Name() {
+	case "players":
+		// Every player point counts as 1, which says nothing in a log.
+		delete(entry, "value")
+	case "events":
+		tags := []string{}
+		if s, _ := fields["tags"].(string); s != "" {
+			tags = strings.Split(s, ",")
+		}
+		entry["tags"] = tags
+	}
+	return entry, nil
+}
+
+// EventLogSink writes occurrences as JSON lines, one object per line with
+// the keys sorted.
+type EventLogSink struct {
+	Clock Clock
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewEventLogSink(w io.Writer, clock Clock) *EventLogSink {
+	return &EventLogSink{
+		Clock: clock,
+		w:     w,
+	}
+}
+
+func (s *EventLogSink) Name() string {
+	return "eventlog"
+}
+
+func (s *EventLogSink) Write(points []*client.Point) error {
+	entries, err := eventEntries(points, s.Clock.Now())
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.w.Write(b.Bytes())
+	return errors.Wrap(err, "eventlog")
+}
+
+// LokiSink pushes occurrences to the push API of Loki. Every entry is
+// logged as a JSON line into a stream labeled with the exporter host, the
+// measurement and the type of the occurrence (the rule for alerts).
+// Credentials can be part of the url.
+type LokiSink struct {
+	URL   string
+	Clock Clock
+
+	client *http.Client
+}
+
+func NewLokiSink(url string, clock Clock) *LokiSink {
+	return &LokiSink{
+		URL:    strings.TrimSuffix(url, "/") + "/loki/api/v1/push",
+		Clock:  clock,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *LokiSink) Name() string {
+	return "loki"
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+type lokiEntry struct {
+	time time.Time
+	line string
+}
+
+func (s *LokiSink) Write(points []*client.Point) error {
+	entries, err := eventEntries(points, s.Clock.Now())
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	byLabels := make(map[string]*lokiStream)
+	lines := make(map[string][]lokiEntry)
+	for _, entry := range entries {
+		// Points written by hand may come without a host.
+		host, _ := entry["host"].(string)
+		labels := map[string]string{
+			"host":        host,
+			"measurement": entry["measurement"].(string),
+		}
+		if t, _ := entry["type"].(string); t != "" {
+			labels["type"] = t
+		} else if rule, _ := entry["rule"].(string); rule != "" {
+			labels["type"] = rule
+		}
+		key := labels["host"] + "\x00" + labels["measurement"] + "\x00" + labels["type"]
+		if _, ok := byLabels[key]; !ok {
+			byLabels[key] = &lokiStream{Stream: labels}
+		}
+
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		ts, err := time.Parse(time.RFC3339Nano, entry["time"].(string))
+		if err != nil {
+			return err
+		}
+		lines[key] = append(lines[key], lokiEntry{ts, string(line)})
+	}
+
+	// Loki rejects entries that are older than the newest one of a stream,
+	// so each stream is sent in chronological order.
+	keys := make([]string, 0, len(byLabels))
+	for key := range byLabels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var push struct {
+		Streams []*lokiStream `json:"streams"`
+	}
+	for _, key := range keys {
+		stream := byLabels[key]
+		sort.SliceStable(lines[key], func(i, j int) bool { return lines[key][i].time.Before(lines[key][j].time) })
+		for _, e := range lines[key] {
+			stream.Values = append(stream.Values, [2]string{strconv.FormatInt(e.time.UnixNano(), 10), e.line})
+		}
+		push.Streams = append(push.Streams, stream)
+	}
+
+	body, err := json.Marshal(push)
+	if err != nil {
+		return err
+	}
+	res, err := s.client.Post(s.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "loki")
+	}
+	defer res.Body.Close()
+	response, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode/100 != 2 {
+		return errors.Errorf("loki: %s: %s", res.Status, bytes.TrimSpace(response))
+	}
+	return nil
+}
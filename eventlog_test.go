@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+func TestEventLogSink(t *testing.T) {
+	h := newHarness(t, "testdata/torch")
+	h.collect("events")
+	points := h.sink.Points()
+	h.collect("players")
+	points = append(points, h.sink.Points()...)
+
+	var b bytes.Buffer
+	if err := NewEventLogSink(&b, h.clock).Write(points); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "eventlog", b.String())
+}
+
+func TestLokiSink(t *testing.T) {
+	h := newHarness(t, "testdata/torch")
+	h.collect("events")
+	points := h.sink.Points()
+	h.collect("players")
+	points = append(points, h.sink.Points()...)
+
+	var push struct {
+		Streams []struct {
+			Stream map[string]string
+			Values [][2]string
+		}
+	}
+	loki := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/loki/api/v1/push" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected %s request with %q", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&push); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer loki.Close()
+
+	if err := NewLokiSink(loki.URL, h.clock).Write(points); err != nil {
+		t.Fatal(err)
+	}
+	if len(push.Streams) != 4 {
+		t.Fatalf("got %d streams, want one per measurement and type", len(push.Streams))
+	}
+	for _, s := range push.Streams {
+		if s.Stream["host"] != testHost || s.Stream["type"] == "" || len(s.Values) != 1 {
+			t.Errorf("unexpected stream %v with %d entries", s.Stream, len(s.Values))
+			continue
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(s.Values[0][1]), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry["type"] != s.Stream["type"] || entry["measurement"] != s.Stream["measurement"] {
+			t.Errorf("entry %s logged to stream %v", s.Values[0][1], s.Stream)
+		}
+	}
+
+	// A point without a host is pushed with an empty host label.
+	alert, err := client.NewPoint("alert", map[string]string{"rule": "manual"}, map[string]interface{}{"message": "restart at 20:00"}, testEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	push.Streams = nil
+	if err := NewLokiSink(loki.URL, h.clock).Write([]*client.Point{alert}); err != nil {
+		t.Fatal(err)
+	}
+	if len(push.Streams) != 1 || push.Streams[0].Stream["host"] != "" || push.Streams[0].Stream["type"] != "manual" {
+		t.Errorf("unexpected streams %v", push.Streams)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "entry out of order", http.StatusBadRequest)
+	}))
+	defer failing.Close()
+	if err := NewLokiSink(failing.URL, h.clock).Write(points); err == nil {
+		t.Error("expected error when loki rejects the push")
+	}
+}
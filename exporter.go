@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"golang.org/x/sync/errgroup"
+)
+
+// Processor rewrites the points of a collector run before they are written,
+// e.g. to add tags or derived points.
+type Processor interface {
+	Name() string
+	Process(points []*client.Point) ([]*client.Point, error)
+}
+
+// Exporter runs every collector on its own ticker and hands the collected
+// points through all processors to all sinks.
+type Exporter struct {
+	Collectors []*Collector
+	Processors []Processor
+	Sinks      []Sink
+	Interval   time.Duration
+	Stats      *Stats
+	// Clock drives the tickers and stats, RealClock if nil.
+	Clock Clock
+}
+
+func (e *Exporter) clock() Clock {
+	if e.Clock == nil {
+		return RealClock
+	}
+	return e.Clock
+}
+
+// Run blocks until ctx is done. Failing collectors and sinks are logged and
+// recorded in the stats but do not stop the exporter.
+func (e *Exporter) Run(ctx context.Context) error {
+	errWg, gCtx := errgroup.WithContext(ctx)
+	for _, c := range e.Collectors {
+		c := c
+		errWg.Go(func() error {
+			return e.loop(gCtx, c)
+		})
+	}
+	return errWg.Wait()
+}
+
+func (e *Exporter) loop(ctx context.Context, c *Collector) error {
+	var running int32
+	ticker := e.clock().NewTicker(e.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C():
+			if !atomic.CompareAndSwapInt32(&running, 0, 1) {
+				e.Stats.Skip(c.Name)
+				continue
+			}
+			go func() {
+				defer atomic.StoreInt32(&running, 0)
+				e.Collect(c)
+			}()
+		}
+	}
+}
+
+// Tick runs every collector once, one after the other. Unlike Run it is
+// deterministic, which makes it the scheduler of choice for tests.
+func (e *Exporter) Tick() {
+	for _, c := range e.Collectors {
+		e.Collect(c)
+	}
+}
+
+// Collect runs a single collector and writes its points to the sinks.
+func (e *Exporter) Collect(c *Collector) {
+	clock := e.clock()
+	start := clock.Now()
+	points, err := c.Collect()
+	end := clock.Now()
+	e.Stats.Scrape(c.Name, end.Sub(start), len(points), err, end)
+	if err != nil {
+		log.Printf("collector %s: %v", c.Name, err)
+		return
+	}
+	e.Write(points)
+}
+
+// Write hands points to every sink, after passing them through the
+// processors in order. A failing processor is logged and skipped.
+func (e *Exporter) Write(points []*client.Point) {
+	if len(points) == 0 {
+		return
+	}
+	for _, p := range e.Processors {
+		processed, err := p.Process(points)
+		if err != nil {
+			log.Printf("processor %s: %v", p.Name(), err)
+			continue
+		}
+		points = processed
+	}
+	clock := e.clock()
+	for _, s := range e.Sinks {
+		start := clock.Now()
+		err := s.Write(points)
+		end := clock.Now()
+		e.Stats.Write(s.Name(), end.Sub(start), len(points), err, end)
+		if d, ok := s.(DroppingSink); ok {
+			e.Stats.Drop(s.Name(), d.Dropped())
+		}
+		if err != nil {
+			log.Printf("sink %s: %v", s.Name(), err)
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FakeTorch serves the /metrics/v1 endpoints of the Torch metrics plugin from
+// an in-memory world, for local development and tests:
+//
+//	srv := httptest.NewServer(NewFakeTorch(RealClock))
+//	t, _ := NewTorchMetrics(srv.URL)
+//
+// Events and player events are returned once and then dropped, like the
+// plugin does. The load is derived from the sim speed on every request.
+type FakeTorch struct {
+	mu    sync.Mutex
+	clock Clock
+
+	server    TorchMetricServer
+	process   TorchMetricsProcess
+	grids     []TorchMetricsSessionGrid
+	factions  []TorchMetricsSessionFaction
+	asteroids []TorchMetricsSessionAsteroidOrPlanet
+	planets   []TorchMetricsSessionAsteroidOrPlanet
+	floating  []TorchMetricsSessionFloatingObject
+	online    map[uint64]bool
+
+	events  []fakeEvent
+	players []fakePlayerEvent
+
+	started time.Time
+	down    time.Time
+}
+
+type fakeEvent struct {
+	event TorchMetricsEvent
+	at    time.Time
+}
+
+type fakePlayerEvent struct {
+	event TorchPlayerEvent
+	at    time.Time
+}
+
+// NewFakeTorch returns a fake Torch server with an empty, running world whose
+// uptime and event ages are measured by clock.
+func NewFakeTorch(clock Clock) *FakeTorch {
+	f := &FakeTorch{clock: clock}
+	f.reset(clock.Now())
+	return f
+}
+
+func (f *FakeTorch) reset(now time.Time) {
+	f.server = TorchMetricServer{
+		Version:            "fake",
+		ServerName:         "Fake Server",
+		WorldName:          "Fake World",
+		IsReady:            true,
+		SimSpeed:           1,
+		MaxPlayers:         16,
+		MaxFactionsCount:   0,
+		MaxFloatingObjects: 56,
+		MaxGridSize:        50000,
+		MaxBlocksPerPlayer: 100000,
+		BlockLimitEnabled:  "PER_PLAYER",
+		TotalPCU:           200000,
+	}
+	f.process = TorchMetricsProcess{
+		PrivateMemorySize64: 2 << 30,
+		VirtualMemorySize64: 8 << 30,
+		WorkingSet64:        2 << 30,
+		GCMaxGeneration:     2,
+		GCTotalMemory:       1 << 30,
+	}
+	f.online = make(map[uint64]bool)
+	f.started = now
+}
+
+// Join lets a player join the server.
+func (f *FakeTorch) Join(steamID uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.online[steamID] = true
+	f.players = append(f.players, fakePlayerEvent{TorchPlayerEvent{Type: PlayerJoined, SteamID: steamID}, f.clock.Now()})
+}
+
+// Leave lets a player leave the server.
+func (f *FakeTorch) Leave(steamID uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.online, steamID)
+	f.players = append(f.players, fakePlayerEvent{TorchPlayerEvent{Type: PlayerLeft, SteamID: steamID}, f.clock.Now()})
+}
+
+// SpawnGrid adds a grid, replacing any grid with the same EntityId.
+func (f *FakeTorch) SpawnGrid(grid TorchMetricsSessionGrid) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.removeGrid(grid.EntityId)
+	f.grids = append(f.grids, grid)
+}
+
+// RemoveGrid removes the grid with the given EntityId.
+func (f *FakeTorch) RemoveGrid(entityID int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.removeGrid(entityID)
+}
+
+func (f *FakeTorch) removeGrid(entityID int64) {
+	for i, grid := range f.grids {
+		if grid.EntityId == entityID {
+			f.grids = append(f.grids[:i], f.grids[i+1:]...)
+			return
+		}
+	}
+}
+
+// AddFaction adds a faction, replacing any faction with the same FactionId.
+func (f *FakeTorch) AddFaction(faction TorchMetricsSessionFaction) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, existing := range f.factions {
+		if existing.FactionId == faction.FactionId {
+			f.factions[i] = faction
+			return
+		}
+	}
+	f.factions = append(f.factions, faction)
+}
+
+// SetSimSpeed changes the simulation speed.
+func (f *FakeTorch) SetSimSpeed(simSpeed float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.server.SimSpeed = simSpeed
+}
+
+// Save simulates a world save that took duration.
+func (f *FakeTorch) Save(duration time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.server.SaveDuration = int64(duration / time.Millisecond)
+	f.events = append(f.events, fakeEvent{TorchMetricsEvent{Type: "save", Text: "World saved", Tags: []string{"save"}}, f.clock.Now()})
+}
+
+// Event adds a server event.
+func (f *FakeTorch) Event(event TorchMetricsEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.events = append(f.events, fakeEvent{event, f.clock.Now()})
+}
+
+// GrowMemory increases the memory used by the server process.
+func (f *FakeTorch) GrowMemory(bytes int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.process.PrivateMemorySize64 += bytes
+	f.process.WorkingSet64 += bytes
+	f.process.GCTotalMemory += bytes
+	if f.process.PeakWorkingSet64 < f.process.WorkingSet64 {
+		f.process.PeakWorkingSet64 = f.process.WorkingSet64
+	}
+}
+
+// CollectGarbage counts a garbage collection of the given generation.
+func (f *FakeTorch) CollectGarbage(generation int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch generation {
+	case 2:
+		f.process.GCCollectionCount2++
+		fallthrough
+	case 1:
+		f.process.GCCollectionCount1++
+		fallthrough
+	default:
+		f.process.GCCollectionCount0++
+	}
+}
+
+// Restart simulates a server restart: all endpoints answer 503 for downtime,
+// players are disconnected and all counters start over. Grids and factions
+// are kept as they are part of the world.
+func (f *FakeTorch) Restart(downtime time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.clock.Now()
+	for steamID := range f.online {
+		f.players = append(f.players, fakePlayerEvent{TorchPlayerEvent{Type: PlayerLeft, SteamID: steamID}, now})
+	}
+	f.reset(now.Add(downtime))
+	f.down = now.Add(downtime)
+}
+
+func (f *FakeTorch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.clock.Now()
+	if now.Before(f.down) {
+		http.Error(w, "server is restarting", http.StatusServiceUnavailable)
+		return
+	}
+
+	var v interface{}
+	switch strings.TrimPrefix(r.URL.Path, "/metrics/v1/") {
+	case "server":
+		server := f.server
+		server.TotalTime = int64(now.Sub(f.started) / time.Second)
+		server.Players = int8(len(f.online))
+		for _, grid := range f.grids {
+			server.UsedPCU += grid.PCU
+		}
+		v = server
+	case "load":
+		v = []TorchMetricsLoad{{
+			ServerCPULoad:          100 * (1.2 - f.server.SimSpeed),
+			ServerCPULoadSmooth:    100 * (1.2 - f.server.SimSpeed),
+			ServerSimulationRatio:  f.server.SimSpeed,
+			ServerThreadLoad:       100 * (1.1 - f.server.SimSpeed),
+			ServerThreadLoadSmooth: 100 * (1.1 - f.server.SimSpeed),
+		}}
+	case "process":
+		v = f.process
+	case "events":
+		events := make([]TorchMetricsEvent, 0, len(f.events))
+		for _, e := range f.events {
+			e.event.SecondsInThePast = now.Sub(e.at).Seconds()
+			events = append(events, e.event)
+		}
+		f.events = nil
+		v = events
+	case "players":
+		events := make([]TorchPlayerEvent, 0, len(f.players))
+		for _, e := range f.players {
+			e.event.MillisecondsInThePast = float64(now.Sub(e.at) / time.Millisecond)
+			events = append(events, e.event)
+		}
+		f.players = nil
+		v = events
+	case "session/grids":
+		v = append([]TorchMetricsSessionGrid{}, f.grids...)
+	case "session/asteroids":
+		v = append([]TorchMetricsSessionAsteroidOrPlanet{}, f.asteroids...)
+	case "session/planets":
+		v = append([]TorchMetricsSessionAsteroidOrPlanet{}, f.planets...)
+	case "session/factions":
+		v = append([]TorchMetricsSessionFaction{}, f.factions...)
+	case "session/floatingObjects":
+		v = append([]TorchMetricsSessionFloatingObject{}, f.floating...)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// ScenarioStep is a single scripted change of the fake world.
+type ScenarioStep struct {
+	// At is the offset from the start of the scenario, e.g. "90s".
+	At      string                      `json:"at"`
+	Action  string                      `json:"action"`
+	SteamID uint64                      `json:"steam_id,omitempty"`
+	Value   float64                     `json:"value,omitempty"`
+	Grid    *TorchMetricsSessionGrid    `json:"grid,omitempty"`
+	Faction *TorchMetricsSessionFaction `json:"faction,omitempty"`
+	Event   *TorchMetricsEvent          `json:"event,omitempty"`
+}
+
+// Scenario is a script of changes applied to a FakeTorch over time.
+type Scenario struct {
+	Steps []ScenarioStep `json:"steps"`
+	// Loop restarts the scenario after the last step.
+	Loop bool `json:"loop"`
+}
+
+// ReadScenario reads a scenario from a JSON file.
+func ReadScenario(path string) (*Scenario, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var scenario Scenario
+	if err := json.NewDecoder(f).Decode(&scenario); err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+	for i, step := range scenario.Steps {
+		if _, err := step.offset(); err != nil {
+			return nil, errors.Wrapf(err, "%s step %d", path, i+1)
+		}
+	}
+	return &scenario, nil
+}
+
+func (s ScenarioStep) offset() (time.Duration, error) {
+	if s.At == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s.At)
+}
+
+// Apply performs a single scenario step.
+func (f *FakeTorch) Apply(step ScenarioStep) error {
+	switch step.Action {
+	case "join":
+		f.Join(step.SteamID)
+	case "leave":
+		f.Leave(step.SteamID)
+	case "spawn_grid":
+		if step.Grid == nil {
+			return errors.New("spawn_grid without grid")
+		}
+		f.SpawnGrid(*step.Grid)
+	case "remove_grid":
+		if step.Grid == nil {
+			return errors.New("remove_grid without grid")
+		}
+		f.RemoveGrid(step.Grid.EntityId)
+	case "faction":
+		if step.Faction == nil {
+			return errors.New("faction without faction")
+		}
+		f.AddFaction(*step.Faction)
+	case "sim_speed":
+		f.SetSimSpeed(step.Value)
+	case "save":
+		f.Save(time.Duration(step.Value * float64(time.Second)))
+	case "event":
+		if step.Event == nil {
+			return errors.New("event without event")
+		}
+		f.Event(*step.Event)
+	case "memory":
+		f.GrowMemory(int64(step.Value))
+	case "gc":
+		f.CollectGarbage(int(step.Value))
+	case "restart":
+		f.Restart(time.Duration(step.Value * float64(time.Second)))
+	default:
+		return fmt.Errorf("unknown action %q", step.Action)
+	}
+	return nil
+}
+
+// Play applies the steps of the scenario at their offsets until the scenario
+// ends or ctx is done. A looping scenario must take some time, or it would
+// replay its steps forever without ever waiting.
+func (f *FakeTorch) Play(ctx context.Context, scenario *Scenario) error {
+	if scenario.Loop {
+		var length time.Duration
+		for _, step := range scenario.Steps {
+			offset, err := step.offset()
+			if err != nil {
+				return err
+			}
+			if offset > length {
+				length = offset
+			}
+		}
+		if length <= 0 {
+			return errors.New("looping scenario without steps after 0s")
+		}
+	}
+	for {
+		start := f.clock.Now()
+		for _, step := range scenario.Steps {
+			offset, err := step.offset()
+			if err != nil {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-f.clock.After(start.Add(offset).Sub(f.clock.Now())):
+			}
+			if err := f.Apply(step); err != nil {
+				return err
+			}
+		}
+		if !scenario.Loop {
+			return nil
+		}
+	}
+}
+
+// DemoScenario shows off every action: players joining, grids spawning, the
+// sim speed dropping and a server restart.
+func DemoScenario() *Scenario {
+	return &Scenario{
+		Loop: true,
+		Steps: []ScenarioStep{
+			{At: "5s", Action: "join", SteamID: 76561197960287930},
+			{At: "10s", Action: "spawn_grid", Grid: &TorchMetricsSessionGrid{DisplayName: "Red Ship", EntityId: 1, GridSize: "Large", BlocksCount: 850, Mass: 1.2e6, PCU: 9000, OwnerSteamID: 76561197960287930, OwnerDisplayName: "Alice", IsPowered: true, ConveyorSystemLineCount: 40}},
+			{At: "20s", Action: "join", SteamID: 76561197960287931},
+			{At: "25s", Action: "spawn_grid", Grid: &TorchMetricsSessionGrid{DisplayName: "Base", EntityId: 2, GridSize: "Large", BlocksCount: 5200, Mass: 9.5e6, PCU: 42000, OwnerSteamID: 76561197960287931, OwnerDisplayName: "Bob", IsPowered: true, IsStatic: true, ConveyorSystemLineCount: 310, ConveyorSystemEndpointBlockCount: 120, ConveyorSystemInventoryBlockCount: 95}},
+			{At: "40s", Action: "sim_speed", Value: 0.45},
+			{At: "45s", Action: "save", Value: 7.5},
+			{At: "60s", Action: "sim_speed", Value: 1},
+			{At: "70s", Action: "leave", SteamID: 76561197960287930},
+			{At: "80s", Action: "restart", Value: 15},
+			{At: "100s", Action: "remove_grid", Grid: &TorchMetricsSessionGrid{EntityId: 1}},
+		},
+	}
+}
+
+// fakeTorchCommand runs a standalone fake Torch server. It returns the exit
+// code.
+func fakeTorchCommand(args []string) int {
+	fs := flag.NewFlagSet("faketorch", flag.ExitOnError)
+	addr := fs.String("listen", ":8080", "listen address")
+	path := fs.String("scenario", "", "scenario json file (default: built-in demo)")
+	fs.Parse(args)
+
+	scenario := DemoScenario()
+	if *path != "" {
+		var err error
+		scenario, err = ReadScenario(*path)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	f := NewFakeTorch(RealClock)
+	go func() {
+		if err := f.Play(context.Background(), scenario); err != nil {
+			log.Println(err)
+		}
+	}()
+	log.Printf("fake torch listening on %s", l.Addr())
+	log.Println(http.Serve(l, f))
+	return 1
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// getFakeTorch requests path from f and decodes the JSON response into v.
+// It returns the status code and the raw body.
+func getFakeTorch(t *testing.T, f *FakeTorch, path string, v interface{}) (int, string) {
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/v1/"+path, nil))
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+	return w.Code, w.Body.String()
+}
+
+func TestFakeTorchPlay(t *testing.T) {
+	clock := NewFakeClock(testEpoch)
+	f := NewFakeTorch(clock)
+
+	for _, scenario := range []*Scenario{
+		{Loop: true},
+		{Loop: true, Steps: []ScenarioStep{{At: "0s", Action: "join", SteamID: 1}}},
+	} {
+		if err := f.Play(context.Background(), scenario); err == nil {
+			t.Errorf("looping scenario %+v played", scenario)
+		}
+	}
+	if err := f.Play(context.Background(), &Scenario{}); err != nil {
+		t.Errorf("empty scenario: %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- f.Play(context.Background(), &Scenario{Steps: []ScenarioStep{
+			{At: "0s", Action: "sim_speed", Value: 0.5},
+			{At: "10s", Action: "join", SteamID: 1},
+		}})
+	}()
+	for clock.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(10 * time.Second)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.server.SimSpeed != 0.5 || !f.online[1] {
+		t.Errorf("steps not applied: sim speed %v, online %v", f.server.SimSpeed, f.online)
+	}
+}
+
+func TestFakeTorchEndpoints(t *testing.T) {
+	clock := NewFakeClock(testEpoch)
+	f := NewFakeTorch(clock)
+	f.SpawnGrid(TorchMetricsSessionGrid{EntityId: 1, DisplayName: "Base", PCU: 9000})
+	f.SpawnGrid(TorchMetricsSessionGrid{EntityId: 2, DisplayName: "Rover", PCU: 500})
+	f.SpawnGrid(TorchMetricsSessionGrid{EntityId: 2, DisplayName: "Rover", PCU: 600})
+	f.AddFaction(TorchMetricsSessionFaction{FactionId: 7, Tag: "RED"})
+	f.Join(1)
+	f.Join(2)
+	clock.Advance(30 * time.Second)
+	f.Leave(2)
+	f.Save(7500 * time.Millisecond)
+	f.Event(TorchMetricsEvent{Type: "custom", Text: "Hello"})
+	f.SetSimSpeed(0.5)
+	f.GrowMemory(1 << 30)
+	f.CollectGarbage(2)
+	f.CollectGarbage(0)
+	clock.Advance(60 * time.Second)
+
+	var server TorchMetricServer
+	getFakeTorch(t, f, "server", &server)
+	if server.TotalTime != 90 || server.Players != 1 || server.UsedPCU != 9600 || server.SimSpeed != 0.5 || server.SaveDuration != 7500 || !server.IsReady {
+		t.Errorf("unexpected server %+v", server)
+	}
+	// The load grows as the sim speed drops.
+	var load []TorchMetricsLoad
+	getFakeTorch(t, f, "load", &load)
+	if len(load) != 1 || load[0].ServerSimulationRatio != 0.5 || math.Abs(load[0].ServerCPULoad-70) > 1e-9 || math.Abs(load[0].ServerThreadLoad-60) > 1e-9 {
+		t.Errorf("unexpected load %+v", load)
+	}
+	var process TorchMetricsProcess
+	getFakeTorch(t, f, "process", &process)
+	if process.PrivateMemorySize64 != 3<<30 || process.GCTotalMemory != 2<<30 || process.PeakWorkingSet64 != 3<<30 || process.GCCollectionCount0 != 2 || process.GCCollectionCount1 != 1 || process.GCCollectionCount2 != 1 {
+		t.Errorf("unexpected process %+v", process)
+	}
+
+	// Events are aged by the clock and returned once.
+	var events []TorchMetricsEvent
+	getFakeTorch(t, f, "events", &events)
+	want := []TorchMetricsEvent{
+		{Type: "save", Text: "World saved", Tags: []string{"save"}, SecondsInThePast: 60},
+		{Type: "custom", Text: "Hello", SecondsInThePast: 60},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("got events %+v, want %+v", events, want)
+	}
+	var players []TorchPlayerEvent
+	_, body := getFakeTorch(t, f, "players", &players)
+	wantPlayers := []TorchPlayerEvent{
+		{Type: PlayerJoined, SteamID: 1, MillisecondsInThePast: 90000},
+		{Type: PlayerJoined, SteamID: 2, MillisecondsInThePast: 90000},
+		{Type: PlayerLeft, SteamID: 2, MillisecondsInThePast: 60000},
+	}
+	if !reflect.DeepEqual(players, wantPlayers) || !strings.Contains(body, `"SteamId":1,`) {
+		t.Errorf("got player events %s, want %+v", body, wantPlayers)
+	}
+	for _, path := range []string{"events", "players"} {
+		if _, body := getFakeTorch(t, f, path, &[]interface{}{}); body != "[]\n" {
+			t.Errorf("%s returned again: %s", path, body)
+		}
+	}
+
+	var grids []TorchMetricsSessionGrid
+	getFakeTorch(t, f, "session/grids", &grids)
+	if len(grids) != 2 || grids[1].DisplayName != "Rover" || grids[1].PCU != 600 {
+		t.Errorf("unexpected grids %+v", grids)
+	}
+	var factions []TorchMetricsSessionFaction
+	getFakeTorch(t, f, "session/factions", &factions)
+	if len(factions) != 1 || factions[0].Tag != "RED" {
+		t.Errorf("unexpected factions %+v", factions)
+	}
+	for _, path := range []string{"session/asteroids", "session/planets", "session/floatingObjects"} {
+		if _, body := getFakeTorch(t, f, path, &[]interface{}{}); body != "[]\n" {
+			t.Errorf("%s: got %s, want an empty list", path, body)
+		}
+	}
+	if code, _ := getFakeTorch(t, f, "session/unknown", nil); code != http.StatusNotFound {
+		t.Errorf("got %d for an unknown endpoint, want 404", code)
+	}
+
+	// A restart disconnects everyone and the uptime starts over once the
+	// server is back.
+	f.Restart(15 * time.Second)
+	clock.Advance(10 * time.Second)
+	if code, _ := getFakeTorch(t, f, "server", nil); code != http.StatusServiceUnavailable {
+		t.Errorf("got %d while restarting, want 503", code)
+	}
+	clock.Advance(10 * time.Second)
+	server = TorchMetricServer{}
+	getFakeTorch(t, f, "server", &server)
+	if server.TotalTime != 5 || server.Players != 0 || server.SimSpeed != 1 || server.UsedPCU != 9600 {
+		t.Errorf("unexpected server after a restart %+v", server)
+	}
+	players = nil
+	getFakeTorch(t, f, "players", &players)
+	if len(players) != 1 || players[0].Type != PlayerLeft || players[0].SteamID != 1 || players[0].MillisecondsInThePast != 20000 {
+		t.Errorf("unexpected player events after a restart %+v", players)
+	}
+}
+
+func TestDemoScenario(t *testing.T) {
+	clock := NewFakeClock(testEpoch)
+	f := NewFakeTorch(clock)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- f.Play(ctx, DemoScenario())
+	}()
+
+	// Every step of the demo is due within 100s, the loop starts over
+	// after it.
+	for i := 0; i < 20; i++ {
+		for clock.Waiters() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		clock.Advance(5 * time.Second)
+	}
+	for clock.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("got %v, want the scenario to loop until cancelled", err)
+	}
+
+	// Bob was still online at the restart at 80s, which was over at 95s.
+	var server TorchMetricServer
+	getFakeTorch(t, f, "server", &server)
+	if server.TotalTime != 5 || server.Players != 0 || server.UsedPCU != 42000 || server.SimSpeed != 1 {
+		t.Errorf("unexpected server %+v", server)
+	}
+	var grids []TorchMetricsSessionGrid
+	getFakeTorch(t, f, "session/grids", &grids)
+	if len(grids) != 1 || grids[0].DisplayName != "Base" {
+		t.Errorf("unexpected grids %+v", grids)
+	}
+	var players []TorchPlayerEvent
+	getFakeTorch(t, f, "players", &players)
+	var got []string
+	for _, e := range players {
+		got = append(got, e.Type+" "+time.Duration(e.MillisecondsInThePast*float64(time.Millisecond)).String())
+	}
+	if want := []string{"Joined 1m35s", "Joined 1m20s", "Left 30s", "Left 20s"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got player events %v, want %v", got, want)
+	}
+}
+
+func TestFakeTorchCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "faketorch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	broken := filepath.Join(dir, "broken.json")
+	if err := ioutil.WriteFile(broken, []byte(`{"steps": [{"at": "soon"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code := fakeTorchCommand([]string{"-scenario", filepath.Join(dir, "missing.json")}); code != 1 {
+		t.Errorf("got exit code %d for a missing scenario, want 1", code)
+	}
+	if code := fakeTorchCommand([]string{"-scenario", broken}); code != 1 {
+		t.Errorf("got exit code %d for a broken scenario, want 1", code)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if code := fakeTorchCommand([]string{"-listen", l.Addr().String()}); code != 1 {
+		t.Errorf("got exit code %d for an address in use, want 1", code)
+	}
+}
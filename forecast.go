@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// Forecaster is a processor that fits linear trends over the PCU used on
+// the server and the PCU and blocks of every grid owner within a rolling
+// window, and predicts when they hit the limits of the server: TotalPCU and
+// MaxBlocksPerPlayer. Server points add a "pcu_forecast" point, grids
+// scrapes an "owner_forecast" point per grid owner, both with alerts for
+// limits coming into the horizon.
+//
+// A trend is only reported once its samples span a quarter of the window,
+// so a few noisy scrapes after a start do not raise alerts.
+type Forecaster struct {
+	Window time.Duration
+	// Horizon raises an alert when a limit is projected to be hit within
+	// it, 0 disables alerts.
+	Horizon time.Duration
+	Clock   Clock
+
+	host string
+
+	mu sync.Mutex
+	// blockLimit is the MaxBlocksPerPlayer of the last server point.
+	blockLimit int
+	server     trend
+	owners     map[int64]*ownerTrend
+	alerted    map[string]bool
+}
+
+type ownerTrend struct {
+	name       string
+	factionTag string
+	pcu        trend
+	blocks     trend
+}
+
+func NewForecaster(host string, window, horizon time.Duration, clock Clock) *Forecaster {
+	return &Forecaster{
+		Window:  window,
+		Horizon: horizon,
+		Clock:   clock,
+		host:    host,
+		owners:  make(map[int64]*ownerTrend),
+		alerted: make(map[string]bool),
+	}
+}
+
+func (f *Forecaster) Name() string {
+	return "forecast"
+}
+
+func (f *Forecaster) Process(points []*client.Point) ([]*client.Point, error) {
+	now := f.Clock.Now()
+	var forecasts []*client.Point
+	for _, pt := range points {
+		if pt.Name() != "server" {
+			continue
+		}
+		fields, err := pt.Fields()
+		if err != nil {
+			return nil, err
+		}
+		number := func(field string) int {
+			v, _ := fieldValue(fields[field])
+			return int(v)
+		}
+		ts := pt.Time()
+		if ts.IsZero() {
+			ts = now
+		}
+		server, err := f.ObserveServer(&TorchMetricServer{
+			UsedPCU:            number("used_pcu"),
+			TotalPCU:           number("total_pcu"),
+			MaxBlocksPerPlayer: number("max_blocks_per_player"),
+		}, ts)
+		if err != nil {
+			return nil, err
+		}
+		forecasts = append(forecasts, server...)
+	}
+	grids, ok, err := gridsFromPoints(points)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		owners, err := f.ObserveGrids(grids, now)
+		if err != nil {
+			return nil, err
+		}
+		forecasts = append(forecasts, owners...)
+	}
+	if len(forecasts) == 0 {
+		return points, nil
+	}
+	return append(points[:len(points):len(points)], forecasts...), nil
+}
+
+// ObserveServer records the PCU used on the server at now and returns the
+// server forecast. The MaxBlocksPerPlayer is kept as the limit of the owner
+// forecasts.
+func (f *Forecaster) ObserveServer(info *TorchMetricServer, now time.Time) ([]*client.Point, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var alerts []*Alert
+	f.blockLimit = info.MaxBlocksPerPlayer
+	f.server.add(now, float64(info.UsedPCU), f.Window)
+	fields := map[string]interface{}{
+		"used_pcu":  info.UsedPCU,
+		"total_pcu": info.TotalPCU,
+	}
+	if slope, ok := f.server.slope(f.Window); ok {
+		fields["pcu_per_hour"] = slope * 3600
+		eta, ok := timeToLimit(float64(info.UsedPCU), float64(info.TotalPCU), slope)
+		if ok {
+			fields["time_to_limit"] = eta.Seconds()
+		}
+		alerts = f.alert(alerts, "server", eta, ok, &Alert{
+			Rule:    "pcu_forecast",
+			Message: fmt.Sprintf("PCU limit of %d projected to be reached in %s", info.TotalPCU, eta),
+		})
+	}
+	pt, err := client.NewPoint("pcu_forecast", map[string]string{"host": f.host}, fields, now)
+	if err != nil {
+		return nil, err
+	}
+	return f.alertPoints([]*client.Point{pt}, alerts, now)
+}
+
+// ObserveGrids records the PCU and blocks of every grid owner at now and
+// returns their forecasts.
+func (f *Forecaster) ObserveGrids(grids []TorchMetricsSessionGrid, now time.Time) ([]*client.Point, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var points []*client.Point
+	var alerts []*Alert
+
+	// Sum up the grids of every owner, grids without one are ignored.
+	type total struct {
+		grid   TorchMetricsSessionGrid
+		pcu    int
+		blocks int
+	}
+	totals := make(map[int64]*total)
+	for _, grid := range grids {
+		if grid.OwnerSteamID == 0 {
+			continue
+		}
+		t, ok := totals[grid.OwnerSteamID]
+		if !ok {
+			t = &total{grid: grid}
+			totals[grid.OwnerSteamID] = t
+		}
+		t.pcu += grid.PCU
+		t.blocks += grid.BlocksCount
+	}
+	for id := range f.owners {
+		if totals[id] == nil {
+			delete(f.owners, id)
+			delete(f.alerted, fmt.Sprint(id))
+		}
+	}
+	ids := make([]int64, 0, len(totals))
+	for id := range totals {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		t := totals[id]
+		owner, ok := f.owners[id]
+		if !ok {
+			owner = &ownerTrend{}
+			f.owners[id] = owner
+		}
+		owner.name = t.grid.OwnerDisplayName
+		owner.factionTag = strings.Replace(t.grid.OwnerFactionTag, "\\", "", -1)
+		owner.pcu.add(now, float64(t.pcu), f.Window)
+		owner.blocks.add(now, float64(t.blocks), f.Window)
+
+		tags := map[string]string{
+			"host":               f.host,
+			"owner_steam_id":     fmt.Sprint(id),
+			"owner_display_name": owner.name,
+			"owner_faction_tag":  owner.factionTag,
+		}
+		fields := map[string]interface{}{
+			"pcu":         t.pcu,
+			"blocks":      t.blocks,
+			"block_limit": f.blockLimit,
+		}
+		if slope, ok := owner.pcu.slope(f.Window); ok {
+			fields["pcu_per_hour"] = slope * 3600
+		}
+		if slope, ok := owner.blocks.slope(f.Window); ok {
+			fields["blocks_per_hour"] = slope * 3600
+			eta, ok := timeToLimit(float64(t.blocks), float64(f.blockLimit), slope)
+			if ok {
+				fields["time_to_block_limit"] = eta.Seconds()
+			}
+			alerts = f.alert(alerts, fmt.Sprint(id), eta, ok, &Alert{
+				Rule:    "block_limit_forecast",
+				Message: fmt.Sprintf("%s projected to exceed %d blocks in %s", owner.name, f.blockLimit, eta),
+				Tags: map[string]string{
+					"owner_steam_id":     fmt.Sprint(id),
+					"owner_display_name": owner.name,
+				},
+			})
+		}
+		pt, err := client.NewPoint("owner_forecast", tags, fields, now)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, pt)
+	}
+	return f.alertPoints(points, alerts, now)
+}
+
+// alertPoints logs alerts raised at now and appends them to points.
+func (f *Forecaster) alertPoints(points []*client.Point, alerts []*Alert, now time.Time) ([]*client.Point, error) {
+	for _, alert := range alerts {
+		alert.Time = now
+		alert.Log()
+		pt, err := alert.Point(f.host)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, pt)
+	}
+	return points, nil
+}
+
+// alert appends a to alerts when the limit is projected to be hit within the
+// horizon, ok reporting whether it is at all. Every key alerts once until
+// its projection leaves the horizon again.
+func (f *Forecaster) alert(alerts []*Alert, key string, eta time.Duration, ok bool, a *Alert) []*Alert {
+	if f.Horizon <= 0 {
+		return alerts
+	}
+	if !ok || eta > f.Horizon {
+		delete(f.alerted, key)
+		return alerts
+	}
+	if f.alerted[key] {
+		return alerts
+	}
+	f.alerted[key] = true
+	a.Value = eta.Seconds()
+	a.Threshold = f.Horizon.Seconds()
+	return append(alerts, a)
+}
+
+// timeToLimit returns when a value growing by slope per second reaches
+// limit. Values that are not growing never do.
+func timeToLimit(value, limit, slope float64) (time.Duration, bool) {
+	if limit <= 0 {
+		return 0, false
+	}
+	if value >= limit {
+		return 0, true
+	}
+	if slope <= 0 {
+		return 0, false
+	}
+	return time.Duration((limit - value) / slope * float64(time.Second)).Round(time.Second), true
+}
+
+type trendSample struct {
+	time  time.Time
+	value float64
+}
+
+// trend keeps the samples of a value within a window.
+type trend struct {
+	samples []trendSample
+}
+
+func (t *trend) add(now time.Time, value float64, window time.Duration) {
+	cutoff := now.Add(-window)
+	i := 0
+	for i < len(t.samples) && t.samples[i].time.Before(cutoff) {
+		i++
+	}
+	t.samples = append(t.samples[i:], trendSample{now, value})
+}
+
+// slope returns the growth per second by least squares, once the samples
+// span a quarter of the window.
+func (t *trend) slope(window time.Duration) (float64, bool) {
+	n := len(t.samples)
+	if n < 2 || t.samples[n-1].time.Sub(t.samples[0].time) < window/4 {
+		return 0, false
+	}
+	var sumX, sumY, sumXY, sumXX float64
+	for _, s := range t.samples {
+		x := s.time.Sub(t.samples[0].time).Seconds()
+		sumX += x
+		sumY += s.value
+		sumXY += x * s.value
+		sumXX += x * x
+	}
+	d := float64(n)*sumXX - sumX*sumX
+	if d == 0 {
+		return 0, false
+	}
+	return (float64(n)*sumXY - sumX*sumY) / d, true
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForecaster(t *testing.T) {
+	h, f, clock := newFakeTorchHarness(t)
+	h.exporter.Processors = []Processor{NewForecaster(testHost, 40*time.Minute, time.Hour, clock)}
+
+	// Alice adds 20000 blocks every 10 minutes, Bob keeps his base.
+	f.SpawnGrid(TorchMetricsSessionGrid{EntityId: 100, OwnerSteamID: 2, OwnerDisplayName: "Bob", BlocksCount: 5000, PCU: 100})
+	var scrapes []string
+	for i := 0; i < 4; i++ {
+		f.SpawnGrid(TorchMetricsSessionGrid{EntityId: int64(i + 1), OwnerSteamID: 1, OwnerDisplayName: "Alice", OwnerFactionTag: "R\\ED", BlocksCount: 20000, PCU: 10000})
+		scrapes = append(scrapes, h.collect("server")+h.collect("grids"))
+		clock.Advance(10 * time.Minute)
+	}
+
+	// No trend before the samples span a quarter of the window.
+	if strings.Contains(scrapes[0], "per_hour") || strings.Contains(scrapes[0], "alert") {
+		t.Errorf("first scrape forecasts:\n%s", scrapes[0])
+	}
+	for _, want := range []string{
+		"pcu_forecast,host=http://torch:8080 pcu_per_hour=60000",
+		"time_to_limit=10794,total_pcu=200000i,used_pcu=20100i",
+		"owner_forecast,host=http://torch:8080,owner_display_name=Alice,owner_faction_tag=RED,owner_steam_id=1 block_limit=100000i,blocks=40000i,blocks_per_hour=120000",
+		"time_to_block_limit=1800 ",
+		"owner_forecast,host=http://torch:8080,owner_display_name=Bob,owner_steam_id=2 block_limit=100000i,blocks=5000i,blocks_per_hour=0,pcu=100i,pcu_per_hour=0 ",
+		"alert,host=http://torch:8080,owner_display_name=Alice,owner_steam_id=1,rule=block_limit_forecast message=\"Alice projected to exceed 100000 blocks in 30m0s\",threshold=3600,value=1800 ",
+	} {
+		if !strings.Contains(scrapes[1], want) {
+			t.Errorf("missing %q in:\n%s", want, scrapes[1])
+		}
+	}
+	// The PCU limit is three hours away, beyond the horizon.
+	if strings.Contains(scrapes[1], "rule=pcu_forecast") {
+		t.Errorf("unexpected pcu alert:\n%s", scrapes[1])
+	}
+	// An owner alerts only once.
+	for _, scrape := range scrapes[2:] {
+		if strings.Contains(scrape, "alert,") {
+			t.Errorf("repeated alert:\n%s", scrape)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/pkg/errors"
+)
+
+// DefaultGraphiteTemplate maps a point to
+// spaceengineers.<host>.<measurement>.<remaining tag values>.<field>.
+const DefaultGraphiteTemplate = "spaceengineers.{host}.{measurement}.{tags}.{field}"
+
+var graphiteTemplateVar = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// GraphiteSink writes points to Carbon using the plaintext or the pickle
+// protocol.
+//
+// Every numeric field of a point becomes one metric whose path is rendered
+// from Template: {measurement} and {field} are replaced by the point's name
+// and field key, {<tag>} by the value of that tag and {tags} by the values of
+// all tags not used elsewhere in the template, ordered by tag key. With
+// Tagged set, {tags} stays empty and the remaining tags are sent as Graphite
+// series tags instead.
+type GraphiteSink struct {
+	Address  string
+	Template string
+	Tagged   bool
+	Pickle   bool
+	Timeout  time.Duration
+	Clock    Clock
+
+	mu      sync.Mutex
+	conn    net.Conn
+	backoff time.Duration
+	retry   time.Time
+}
+
+func NewGraphiteSink(address, template string, clock Clock) *GraphiteSink {
+	return &GraphiteSink{
+		Address:  address,
+		Template: template,
+		Timeout:  10 * time.Second,
+		Clock:    clock,
+	}
+}
+
+func (s *GraphiteSink) Name() string {
+	return "graphite"
+}
+
+type graphiteMetric struct {
+	path  string
+	value float64
+	time  int64
+}
+
+func (s *GraphiteSink) Write(points []*client.Point) error {
+	metrics, err := s.metrics(points)
+	if err != nil {
+		return err
+	}
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	var payload []byte
+	if s.Pickle {
+		payload = encodeGraphitePickle(metrics)
+	} else {
+		var b bytes.Buffer
+		for _, m := range metrics {
+			fmt.Fprintf(&b, "%s %s %d\n", m.path, strconv.FormatFloat(m.value, 'f', -1, 64), m.time)
+		}
+		payload = b.Bytes()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A connection that was closed by Carbon is usually only noticed on the
+	// next write, so give a fresh connection a second chance.
+	err = s.send(payload)
+	if err != nil && s.conn == nil && s.retry.IsZero() {
+		err = s.send(payload)
+	}
+	return err
+}
+
+func (s *GraphiteSink) send(payload []byte) error {
+	if s.conn == nil {
+		if err := s.dial(); err != nil {
+			return err
+		}
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(s.Timeout))
+	if _, err := s.conn.Write(payload); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return errors.Wrap(err, "graphite write")
+	}
+	return nil
+}
+
+// dial connects to Carbon, backing off exponentially up to a minute after
+// failed attempts.
+func (s *GraphiteSink) dial() error {
+	now := s.Clock.Now()
+	if now.Before(s.retry) {
+		return errors.Errorf("graphite: not reconnecting before %s", s.retry.Format(time.RFC3339))
+	}
+	conn, err := net.DialTimeout("tcp", s.Address, s.Timeout)
+	if err != nil {
+		if s.backoff == 0 {
+			s.backoff = time.Second
+		} else if s.backoff < time.Minute {
+			s.backoff *= 2
+		}
+		s.retry = now.Add(s.backoff)
+		return errors.Wrap(err, "graphite dial")
+	}
+	s.conn = conn
+	s.backoff = 0
+	s.retry = time.Time{}
+	return nil
+}
+
+// Close closes the connection to Carbon.
+func (s *GraphiteSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func (s *GraphiteSink) metrics(points []*client.Point) ([]graphiteMetric, error) {
+	now := s.Clock.Now().Unix()
+	var metrics []graphiteMetric
+	for _, pt := range points {
+		fields, err := pt.Fields()
+		if err != nil {
+			return nil, err
+		}
+		ts := now
+		if !pt.Time().IsZero() {
+			ts = pt.Time().Unix()
+		}
+		for field, v := range fields {
+			value, ok := fieldValue(v)
+			if !ok {
+				continue
+			}
+			metrics = append(metrics, graphiteMetric{
+				path:  s.path(pt.Name(), field, pt.Tags()),
+				value: value,
+				time:  ts,
+			})
+		}
+	}
+	sort.SliceStable(metrics, func(i, j int) bool { return metrics[i].path < metrics[j].path })
+	return metrics, nil
+}
+
+func (s *GraphiteSink) path(measurement, field string, tags map[string]string) string {
+	used := map[string]bool{}
+	for _, m := range graphiteTemplateVar.FindAllStringSubmatch(s.Template, -1) {
+		used[m[1]] = true
+	}
+	var rest []string
+	for k := range tags {
+		if !used[k] {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+
+	path := graphiteTemplateVar.ReplaceAllStringFunc(s.Template, func(v string) string {
+		switch name := v[1 : len(v)-1]; name {
+		case "measurement":
+			return graphiteNode(measurement)
+		case "field":
+			return graphiteNode(field)
+		case "tags":
+			if s.Tagged {
+				return ""
+			}
+			var values []string
+			for _, k := range rest {
+				if node := graphiteNode(tags[k]); node != "" {
+					values = append(values, node)
+				}
+			}
+			return strings.Join(values, ".")
+		default:
+			return graphiteNode(tags[name])
+		}
+	})
+	path = graphiteJoin(strings.Split(path, "."))
+
+	if s.Tagged {
+		for _, k := range rest {
+			if value := graphiteTagValue(tags[k]); value != "" {
+				path += ";" + graphiteNode(k) + "=" + value
+			}
+		}
+	}
+	return path
+}
+
+var graphiteInvalid = regexp.MustCompile(`[^A-Za-z0-9_\-]+`)
+
+// graphiteNode makes s usable as a single node of a metric path.
+func graphiteNode(s string) string {
+	return strings.Trim(graphiteInvalid.ReplaceAllString(s, "_"), "_")
+}
+
+// graphiteTagValue makes s usable as the value of a series tag.
+func graphiteTagValue(s string) string {
+	return strings.NewReplacer(";", "_", "~", "_", "!", "_", "^", "_", " ", "_").Replace(s)
+}
+
+func graphiteJoin(nodes []string) string {
+	var nonEmpty []string
+	for _, node := range nodes {
+		if node != "" {
+			nonEmpty = append(nonEmpty, node)
+		}
+	}
+	return strings.Join(nonEmpty, ".")
+}
+
+// encodeGraphitePickle encodes metrics as a length prefixed pickle (protocol 2) of
+// [(path, (timestamp, value)), ...] as expected by Carbon's pickle receiver.
+func encodeGraphitePickle(metrics []graphiteMetric) []byte {
+	var w bytes.Buffer
+	w.Write([]byte{0x80, 2}) // PROTO 2
+	w.WriteByte(']')         // EMPTY_LIST
+	w.WriteByte('(')         // MARK
+	for _, m := range metrics {
+		w.WriteByte('X') // BINUNICODE
+		binary.Write(&w, binary.LittleEndian, uint32(len(m.path)))
+		w.WriteString(m.path)
+		w.WriteByte('J') // BININT
+		binary.Write(&w, binary.LittleEndian, int32(m.time))
+		w.WriteByte('G') // BINFLOAT
+		binary.Write(&w, binary.BigEndian, m.value)
+		w.WriteByte(0x86) // TUPLE2
+		w.WriteByte(0x86) // TUPLE2
+	}
+	w.WriteByte('e') // APPENDS
+	w.WriteByte('.') // STOP
+
+	payload := make([]byte, 4, 4+w.Len())
+	binary.BigEndian.PutUint32(payload, uint32(w.Len()))
+	return append(payload, w.Bytes()...)
+}
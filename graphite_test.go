@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+func graphiteTestPoints(t *testing.T) []*client.Point {
+	server, err := client.NewPoint(
+		"server",
+		map[string]string{"host": "http://torch:8080", "server_name": "Fank Server", "world_name": "Star System"},
+		map[string]interface{}{"sim_speed": 0.87, "players": 7, "block_limit": "PER_PLAYER"},
+		testEpoch,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	voxel, err := client.NewPoint(
+		"voxel",
+		map[string]string{"host": "http://torch:8080", "kind": "planet"},
+		map[string]interface{}{"value": 2},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []*client.Point{server, voxel}
+}
+
+func TestGraphiteSink(t *testing.T) {
+	clock := NewFakeClock(testEpoch.Add(5 * time.Second))
+	for _, tc := range []struct {
+		name   string
+		tagged bool
+		want   []string
+	}{
+		{"plaintext", false, []string{
+			"spaceengineers.http_torch_8080.server.Fank_Server.Star_System.players 7 1541332800",
+			"spaceengineers.http_torch_8080.server.Fank_Server.Star_System.sim_speed 0.87 1541332800",
+			"spaceengineers.http_torch_8080.voxel.planet.value 2 1541332805",
+		}},
+		{"tagged", true, []string{
+			"spaceengineers.http_torch_8080.server.players;server_name=Fank_Server;world_name=Star_System 7 1541332800",
+			"spaceengineers.http_torch_8080.server.sim_speed;server_name=Fank_Server;world_name=Star_System 0.87 1541332800",
+			"spaceengineers.http_torch_8080.voxel.value;kind=planet 2 1541332805",
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			lines := make(chan string)
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}()
+
+			s := NewGraphiteSink(l.Addr().String(), DefaultGraphiteTemplate, clock)
+			s.Tagged = tc.tagged
+			defer s.Close()
+			if err := s.Write(graphiteTestPoints(t)); err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tc.want {
+				if got := <-lines; got != want {
+					t.Errorf("got %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGraphiteSinkReconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	clock := NewFakeClock(testEpoch)
+	s := NewGraphiteSink(addr, "{measurement}.{field}", clock)
+	defer s.Close()
+	if err := s.Write(graphiteTestPoints(t)); err == nil {
+		t.Fatal("write without carbon succeeded")
+	}
+	if err := s.Write(graphiteTestPoints(t)); err == nil || !strings.Contains(err.Error(), "not reconnecting") {
+		t.Fatalf("expected backoff, got %v", err)
+	}
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			bufio.NewReader(conn).ReadString('\n')
+		}
+	}()
+	clock.Advance(time.Second)
+	if err := s.Write(graphiteTestPoints(t)); err != nil {
+		t.Fatalf("write after backoff: %v", err)
+	}
+}
+
+// decodeGraphitePickle decodes the opcodes encodeGraphitePickle writes,
+// the way Carbon's unpickler would, into its (path, (timestamp, value))
+// tuples.
+func decodeGraphitePickle(t *testing.T, frame []byte) []graphiteMetric {
+	if len(frame) < 4 || int(binary.BigEndian.Uint32(frame)) != len(frame)-4 {
+		t.Fatalf("bad length prefix of a %d byte frame", len(frame))
+	}
+	r := bytes.NewReader(frame[4:])
+	var stack []interface{}
+	var marks []int
+	pop := func() interface{} {
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v
+	}
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			t.Fatalf("pickle ends without STOP: %v", err)
+		}
+		switch op {
+		case 0x80:
+			if proto, _ := r.ReadByte(); proto != 2 {
+				t.Fatalf("got protocol %d, want 2", proto)
+			}
+		case ']':
+			stack = append(stack, []interface{}{})
+		case '(':
+			marks = append(marks, len(stack))
+		case 'X':
+			var n uint32
+			binary.Read(r, binary.LittleEndian, &n)
+			b := make([]byte, n)
+			if _, err := io.ReadFull(r, b); err != nil {
+				t.Fatal(err)
+			}
+			stack = append(stack, string(b))
+		case 'J':
+			var v int32
+			binary.Read(r, binary.LittleEndian, &v)
+			stack = append(stack, int64(v))
+		case 'G':
+			var bits uint64
+			binary.Read(r, binary.BigEndian, &bits)
+			stack = append(stack, math.Float64frombits(bits))
+		case 0x86:
+			b := pop()
+			a := pop()
+			stack = append(stack, [2]interface{}{a, b})
+		case 'e':
+			mark := marks[len(marks)-1]
+			marks = marks[:len(marks)-1]
+			items := append([]interface{}{}, stack[mark:]...)
+			stack = stack[:mark]
+			stack[len(stack)-1] = append(stack[len(stack)-1].([]interface{}), items...)
+		case '.':
+			if len(stack) != 1 || r.Len() != 0 {
+				t.Fatalf("got %d values and %d trailing bytes at STOP", len(stack), r.Len())
+			}
+			var metrics []graphiteMetric
+			for _, item := range stack[0].([]interface{}) {
+				tuple := item.([2]interface{})
+				sample := tuple[1].([2]interface{})
+				metrics = append(metrics, graphiteMetric{
+					path:  tuple[0].(string),
+					time:  sample[0].(int64),
+					value: sample[1].(float64),
+				})
+			}
+			return metrics
+		default:
+			t.Fatalf("unexpected opcode %#x", op)
+		}
+	}
+}
+
+func TestGraphiteSinkPickle(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	frames := make(chan []byte)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var n uint32
+			if err := binary.Read(conn, binary.BigEndian, &n); err != nil {
+				return
+			}
+			frame := make([]byte, 4+n)
+			binary.BigEndian.PutUint32(frame, n)
+			if _, err := io.ReadFull(conn, frame[4:]); err != nil {
+				return
+			}
+			frames <- frame
+		}
+	}()
+
+	s := NewGraphiteSink(l.Addr().String(), DefaultGraphiteTemplate, NewFakeClock(testEpoch.Add(5*time.Second)))
+	s.Tagged = true
+	s.Pickle = true
+	defer s.Close()
+	if err := s.Write(graphiteTestPoints(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Integer fields are sent as floats like the others.
+	want := []graphiteMetric{
+		{"spaceengineers.http_torch_8080.server.players;server_name=Fank_Server;world_name=Star_System", 7, 1541332800},
+		{"spaceengineers.http_torch_8080.server.sim_speed;server_name=Fank_Server;world_name=Star_System", 0.87, 1541332800},
+		{"spaceengineers.http_torch_8080.voxel.value;kind=planet", 2, 1541332805},
+	}
+	if got := decodeGraphitePickle(t, <-frames); !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%+v\nwant\n%+v", got, want)
+	}
+}
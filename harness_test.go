@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+const testHost = "http://torch:8080"
+
+var testEpoch = time.Date(2018, 11, 4, 12, 0, 0, 0, time.UTC)
+
+// harness runs the collectors against Torch payloads read from a fixture
+// directory or served by a fake Torch, and captures their points in a
+// memory sink.
+type harness struct {
+	t          *testing.T
+	clock      *FakeClock
+	torch      *TorchMetrics
+	server     *httptest.Server
+	sink       *MemorySink
+	exporter   *Exporter
+	collectors map[string]*Collector
+}
+
+func newHarness(t *testing.T, fixtures string) *harness {
+	entries, err := readFixtures(fixtures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torch, err := NewTorchMetrics(testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torch.SetTransport(NewReplayer(entries))
+	return newTorchHarness(t, torch, NewFakeClock(testEpoch))
+}
+
+// newFakeTorchHarness runs the collectors against a fake Torch served until
+// the test ends.
+func newFakeTorchHarness(t *testing.T) (*harness, *FakeTorch, *FakeClock) {
+	clock := NewFakeClock(testEpoch)
+	f := NewFakeTorch(clock)
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	torch, err := NewTorchMetrics(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTorchHarness(t, torch, clock)
+	h.server = srv
+	return h, f, clock
+}
+
+func newTorchHarness(t *testing.T, torch *TorchMetrics, clock *FakeClock) *harness {
+	h := &harness{
+		t:          t,
+		clock:      clock,
+		torch:      torch,
+		sink:       NewMemorySink(),
+		collectors: make(map[string]*Collector),
+	}
+	collectors := NewCollectors(torch, testHost, NewSaveMonitor(24*time.Hour, 5*time.Second), h.clock)
+	for _, c := range collectors {
+		h.collectors[c.Name] = c
+	}
+	h.exporter = &Exporter{
+		Collectors: collectors,
+		Sinks:      []Sink{h.sink},
+		Interval:   10 * time.Second,
+		Stats:      NewStats(),
+		Clock:      h.clock,
+	}
+	return h
+}
+
+// readFixtures turns every <path>.json below dir into a recorded response
+// of /metrics/v1/<path>.
+func readFixtures(dir string) ([]ArchiveEntry, error) {
+	var entries []ArchiveEntry
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(path) != ".json" {
+			return err
+		}
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, strings.TrimSuffix(path, ".json"))
+		if err != nil {
+			return err
+		}
+		entries = append(entries, ArchiveEntry{
+			Path:   "/metrics/v1/" + filepath.ToSlash(rel),
+			Status: 200,
+			Body:   body,
+		})
+		return nil
+	})
+	return entries, err
+}
+
+// collect runs a single collector and returns the line protocol it emitted.
+func (h *harness) collect(name string) string {
+	c, ok := h.collectors[name]
+	if !ok {
+		h.t.Fatalf("unknown collector %q", name)
+	}
+	h.sink.Reset()
+	h.exporter.Collect(c)
+	if stats := h.exporter.Stats.Snapshot().Collectors[name]; stats.LastError != "" {
+		h.t.Fatalf("collector %s: %s", name, stats.LastError)
+	}
+	return h.sink.LineProtocol()
+}
+
+// checkGolden compares got with testdata/golden/<name>.txt, rewriting the
+// file instead when the tests run with -update.
+func checkGolden(t *testing.T, name, got string) {
+	path := filepath.Join("testdata", "golden", name+".txt")
+	if *update {
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("%s: line protocol mismatch\ngot:\n%s\nwant:\n%s", name, got, want)
+	}
+}
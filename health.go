@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Health serves the liveness and readiness endpoints of the exporter.
+//
+// The exporter is ready once Torch answered the server collector and every
+// sink accepted a write within the last Intervals scrape intervals.
+type Health struct {
+	Exporter  *Exporter
+	Intervals int
+	Started   time.Time
+}
+
+type healthCheck struct {
+	OK          bool      `json:"ok"`
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+type healthStatus struct {
+	Status     string                 `json:"status"`
+	Uptime     string                 `json:"uptime"`
+	Collectors map[string]healthCheck `json:"collectors,omitempty"`
+	Sinks      map[string]healthCheck `json:"sinks,omitempty"`
+}
+
+// Register adds /healthz and /readyz to mux.
+func (h *Health) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", h.healthz)
+	mux.HandleFunc("/readyz", h.readyz)
+}
+
+func (h *Health) healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, &healthStatus{
+		Status: "ok",
+		Uptime: h.Exporter.clock().Now().Sub(h.Started).String(),
+	})
+}
+
+func (h *Health) readyz(w http.ResponseWriter, r *http.Request) {
+	status, ready := h.Ready(h.Exporter.clock().Now())
+	code := http.StatusOK
+	if !ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeHealth(w, code, status)
+}
+
+// Ready evaluates the readiness of every collector and sink at now.
+func (h *Health) Ready(now time.Time) (*healthStatus, bool) {
+	snapshot := h.Exporter.Stats.Snapshot()
+	cutoff := now.Add(-time.Duration(h.Intervals) * h.Exporter.Interval)
+
+	status := &healthStatus{
+		Status:     "ok",
+		Uptime:     now.Sub(h.Started).String(),
+		Collectors: make(map[string]healthCheck),
+		Sinks:      make(map[string]healthCheck),
+	}
+	ready := true
+	for _, c := range h.Exporter.Collectors {
+		stats := snapshot.Collectors[c.Name]
+		check := healthCheck{
+			OK:          stats.LastSuccess.After(cutoff),
+			LastSuccess: stats.LastSuccess,
+			LastError:   stats.LastError,
+		}
+		status.Collectors[c.Name] = check
+		if c.Name == "server" && !check.OK {
+			ready = false
+		}
+	}
+	for _, s := range h.Exporter.Sinks {
+		stats := snapshot.Sinks[s.Name()]
+		check := healthCheck{
+			OK:          stats.LastSuccess.After(cutoff),
+			LastSuccess: stats.LastSuccess,
+			LastError:   stats.LastError,
+		}
+		status.Sinks[s.Name()] = check
+		if !check.OK {
+			ready = false
+		}
+	}
+	if !ready {
+		status.Status = "unavailable"
+	}
+	return status, ready
+}
+
+func writeHealth(w http.ResponseWriter, code int, status *healthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
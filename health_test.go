@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestHealth(t *testing.T) {
+	h := newHarness(t, "testdata/torch")
+	failing := &failingSink{}
+	h.exporter.Sinks = append(h.exporter.Sinks, failing)
+	health := &Health{Exporter: h.exporter, Intervals: 3, Started: testEpoch}
+	mux := http.NewServeMux()
+	health.Register(mux)
+
+	get := func(path string) (int, healthStatus) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		var status healthStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, status
+	}
+
+	// Nothing scraped yet.
+	if code, _ := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("got %d before the first scrape, want 503", code)
+	}
+	h.clock.Advance(10 * time.Second)
+	h.exporter.Tick()
+	if code, status := get("/readyz"); code != http.StatusOK || status.Status != "ok" || status.Uptime != "10s" {
+		t.Errorf("got %d %+v after a scrape, want 200", code, status)
+	}
+
+	// A sink failing for longer than the ready intervals.
+	failing.err = errors.New("connection refused")
+	h.clock.Advance(31 * time.Second)
+	h.exporter.Tick()
+	code, status := get("/readyz")
+	if check := status.Sinks["failing"]; code != http.StatusServiceUnavailable || status.Status != "unavailable" || check.OK || check.LastError != "connection refused" {
+		t.Errorf("got %d %+v with a failing sink, want 503", code, status)
+	}
+	if !status.Collectors["server"].OK || !status.Sinks["memory"].OK {
+		t.Errorf("healthy checks failed: %+v", status)
+	}
+	failing.err = nil
+	h.exporter.Tick()
+	if code, _ := get("/readyz"); code != http.StatusOK {
+		t.Errorf("got %d after the sink recovered, want 200", code)
+	}
+
+	// A stale server scrape, other collectors do not count.
+	h.clock.Advance(31 * time.Second)
+	h.exporter.Collect(h.collectors["grids"])
+	code, status = get("/readyz")
+	if code != http.StatusServiceUnavailable || status.Collectors["server"].OK || !status.Collectors["grids"].OK {
+		t.Errorf("got %d %+v with a stale server scrape, want 503", code, status)
+	}
+
+	// Liveness does not depend on any of it.
+	if code, status := get("/healthz"); code != http.StatusOK || status.Status != "ok" || status.Uptime != "1m12s" {
+		t.Errorf("got %d %+v from /healthz, want 200", code, status)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/pkg/errors"
+)
+
+// Signals a lag report is triggered by.
+const (
+	LagSimSpeed        = "sim_speed"
+	LagSimulationRatio = "server_simulation_ratio"
+)
+
+// lagRankings are the orders grids are ranked by in a lag report.
+var lagRankings = map[string]func(g *LagGrid) float64{
+	"mass":      func(g *LagGrid) float64 { return g.Mass },
+	"speed":     func(g *LagGrid) float64 { return g.LinearSpeed },
+	"blocks":    func(g *LagGrid) float64 { return float64(g.BlocksCount) },
+	"conveyors": func(g *LagGrid) float64 { return g.Conveyors },
+}
+
+// LagAnalyzer attributes sim speed drops to grids. As a sink it watches the
+// sim speed of the server and the simulation ratio of the load points, and
+// when either drops below Threshold it takes the latest grids scraped by
+// the grids collector and ranks the Top grids by mass, speed, block count
+// and conveyor complexity scored by Conveyors, and lists the grids spawned
+// since the snapshot before. Concealed grids are not simulated and left
+// out.
+//
+// Every report is written to Dir as lag-<time>.json, if set, and emitted
+// as a "lag" point by the collector. A new report is only made once all
+// signals recovered.
+type LagAnalyzer struct {
+	Threshold float64
+	Top       int
+	Dir       string
+	Conveyors ConveyorWeights
+	Clock     Clock
+	// Grids returns the grids the grid points of a batch were made of,
+	// usually TorchMetrics.LastSessionGrids. Without it no reports are
+	// made.
+	Grids func() []TorchMetricsSessionGrid
+
+	host    string
+	mu      sync.Mutex
+	low     map[string]bool
+	pending []*LagReport
+	// seen are the entity IDs of the latest grids, spawned the ones not
+	// in the snapshot before.
+	seen    map[int64]bool
+	spawned map[int64]bool
+	// deferred is a drop seen before the first grids were scraped.
+	deferred *LagReport
+}
+
+// LagReport is the JSON artifact of a sim speed drop.
+type LagReport struct {
+	Time      time.Time            `json:"time"`
+	Signal    string               `json:"signal"`
+	Value     float64              `json:"value"`
+	Threshold float64              `json:"threshold"`
+	Grids     int                  `json:"grids"`
+	Top       map[string][]LagGrid `json:"top"`
+	Spawned   []LagGrid            `json:"spawned"`
+	File      string               `json:"-"`
+}
+
+// LagGrid is a grid in a lag report.
+type LagGrid struct {
+	EntityID         int64   `json:"entity_id"`
+	DisplayName      string  `json:"display_name"`
+	OwnerSteamID     int64   `json:"owner_steam_id"`
+	OwnerDisplayName string  `json:"owner_display_name"`
+	OwnerFactionTag  string  `json:"owner_faction_tag"`
+	GridSize         string  `json:"grid_size"`
+	IsStatic         bool    `json:"is_static"`
+	BlocksCount      int     `json:"blocks_count"`
+	PCU              int     `json:"pcu"`
+	Mass             float64 `json:"mass"`
+	LinearSpeed      float64 `json:"linear_speed"`
+	Conveyors        float64 `json:"conveyors"`
+	Spawned          bool    `json:"spawned"`
+}
+
+func NewLagAnalyzer(host string, threshold float64, clock Clock) *LagAnalyzer {
+	return &LagAnalyzer{
+		Threshold: threshold,
+		Top:       5,
+		Conveyors: DefaultConveyorWeights,
+		Clock:     clock,
+		host:      host,
+		low:       make(map[string]bool),
+	}
+}
+
+func (a *LagAnalyzer) Name() string {
+	return "lag"
+}
+
+func (a *LagAnalyzer) Write(points []*client.Point) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, pt := range points {
+		if pt.Name() == "grid" && a.Grids != nil {
+			a.observeGrids()
+			if d := a.deferred; d != nil {
+				a.deferred = nil
+				a.trigger(d.Signal, d.Value, d.Time)
+			}
+			break
+		}
+	}
+	for _, pt := range points {
+		var signal string
+		switch pt.Name() {
+		case "server":
+			signal = LagSimSpeed
+		case "load":
+			signal = LagSimulationRatio
+		default:
+			continue
+		}
+		fields, err := pt.Fields()
+		if err != nil {
+			return err
+		}
+		value, ok := fieldValue(fields[signal])
+		if !ok {
+			continue
+		}
+		if value >= a.Threshold {
+			delete(a.low, signal)
+			if a.deferred != nil && a.deferred.Signal == signal {
+				a.deferred = nil
+			}
+			continue
+		}
+		ts := pt.Time()
+		if ts.IsZero() {
+			ts = a.Clock.Now()
+		}
+		a.trigger(signal, value, ts)
+	}
+	return nil
+}
+
+// trigger reports a drop of signal unless one is reported already. Without
+// grids scraped yet, the drop is deferred until they are.
+func (a *LagAnalyzer) trigger(signal string, value float64, ts time.Time) {
+	if len(a.low) > 0 {
+		a.low[signal] = true
+		return
+	}
+	report := a.report(signal, value, ts)
+	if report == nil {
+		if a.deferred == nil {
+			a.deferred = &LagReport{Signal: signal, Value: value, Time: ts}
+		}
+		return
+	}
+	a.low[signal] = true
+	a.pending = append(a.pending, report)
+}
+
+// observeGrids notes the grids spawned since the previous snapshot.
+func (a *LagAnalyzer) observeGrids() {
+	grids := a.Grids()
+	seen := make(map[int64]bool, len(grids))
+	spawned := make(map[int64]bool)
+	for _, grid := range grids {
+		seen[grid.EntityId] = true
+		if a.seen != nil && !a.seen[grid.EntityId] {
+			spawned[grid.EntityId] = true
+		}
+	}
+	a.seen, a.spawned = seen, spawned
+}
+
+// report ranks the latest grids and writes the artifact. It returns nil
+// before the first grids were scraped.
+func (a *LagAnalyzer) report(signal string, value float64, now time.Time) *LagReport {
+	if a.seen == nil {
+		return nil
+	}
+	grids := a.Grids()
+	report := &LagReport{
+		Time:      now,
+		Signal:    signal,
+		Value:     value,
+		Threshold: a.Threshold,
+		Top:       make(map[string][]LagGrid),
+		Spawned:   []LagGrid{},
+	}
+	var simulated []LagGrid
+	for _, grid := range grids {
+		if grid.IsConcealed {
+			continue
+		}
+		simulated = append(simulated, LagGrid{
+			EntityID:         grid.EntityId,
+			DisplayName:      grid.DisplayName,
+			OwnerSteamID:     grid.OwnerSteamID,
+			OwnerDisplayName: grid.OwnerDisplayName,
+			OwnerFactionTag:  strings.Replace(grid.OwnerFactionTag, "\\", "", -1),
+			GridSize:         grid.GridSize,
+			IsStatic:         grid.IsStatic,
+			BlocksCount:      grid.BlocksCount,
+			PCU:              grid.PCU,
+			Mass:             grid.Mass,
+			LinearSpeed:      grid.LinearSpeed,
+			Conveyors:        a.Conveyors.Score(grid),
+			Spawned:          a.spawned[grid.EntityId],
+		})
+	}
+	report.Grids = len(simulated)
+	for ranking, key := range lagRankings {
+		ranked := append([]LagGrid(nil), simulated...)
+		sort.SliceStable(ranked, func(i, j int) bool { return key(&ranked[i]) > key(&ranked[j]) })
+		if len(ranked) > a.Top {
+			ranked = ranked[:a.Top]
+		}
+		report.Top[ranking] = ranked
+	}
+	for _, grid := range simulated {
+		if grid.Spawned {
+			report.Spawned = append(report.Spawned, grid)
+		}
+	}
+
+	if a.Dir != "" {
+		report.File = filepath.Join(a.Dir, "lag-"+now.UTC().Format("20060102T150405Z")+".json")
+		if err := report.write(); err != nil {
+			// The report still goes out as a point.
+			log.Printf("lag report: %v", err)
+			report.File = ""
+		}
+	}
+	return report
+}
+
+func (r *LagReport) write() error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Readers never see partial reports.
+	err = writeFileAtomic(r.File, func(w io.Writer) error {
+		_, err := w.Write(append(b, '\n'))
+		return err
+	})
+	return errors.Wrap(err, "lag report")
+}
+
+// Summary names the top grid of every ranking.
+func (r *LagReport) Summary() string {
+	rankings := make([]string, 0, len(lagRankings))
+	for ranking := range lagRankings {
+		rankings = append(rankings, ranking)
+	}
+	sort.Strings(rankings)
+
+	s := fmt.Sprintf("%s %v below %v", r.Signal, r.Value, r.Threshold)
+	var tops []string
+	for _, ranking := range rankings {
+		if top := r.Top[ranking]; len(top) > 0 {
+			tops = append(tops, fmt.Sprintf("%s: %s (%s)", ranking, top[0].DisplayName, top[0].OwnerDisplayName))
+		}
+	}
+	if len(tops) > 0 {
+		s += ", top " + strings.Join(tops, ", ")
+	}
+	if len(r.Spawned) > 0 {
+		s += fmt.Sprintf(", %d grids spawned", len(r.Spawned))
+	}
+	return s
+}
+
+// Collector emits a "lag" point for every report made since its last run.
+func (a *LagAnalyzer) Collector() *Collector {
+	return &Collector{
+		Name: "lag",
+		Collect: func() ([]*client.Point, error) {
+			a.mu.Lock()
+			reports := a.pending
+			a.pending = nil
+			a.mu.Unlock()
+
+			var points []*client.Point
+			for _, r := range reports {
+				pt, err := client.NewPoint(
+					"lag",
+					map[string]string{
+						"host": a.host,
+						"type": r.Signal,
+					},
+					map[string]interface{}{
+						"value":     r.Value,
+						"threshold": r.Threshold,
+						"grids":     r.Grids,
+						"text":      r.Summary(),
+						"file":      r.File,
+					},
+					r.Time,
+				)
+				if err != nil {
+					return nil, err
+				}
+				points = append(points, pt)
+			}
+			return points, nil
+		},
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLagAnalyzer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h, f, clock := newFakeTorchHarness(t)
+	a := NewLagAnalyzer(testHost, 0.8, clock)
+	a.Grids = h.torch.LastSessionGrids
+	a.Top = 2
+	a.Dir = dir
+	h.exporter.Sinks = append(h.exporter.Sinks, a)
+	h.collectors["lag"] = a.Collector()
+
+	// A drop before any grids were scraped is reported with the first ones.
+	f.SpawnGrid(TorchMetricsSessionGrid{EntityId: 4, DisplayName: "Hidden", Mass: 9000000, IsConcealed: true})
+	f.SetSimSpeed(0.5)
+	h.collect("server")
+	if got := h.collect("lag"); got != "" {
+		t.Errorf("lag reported without grids:\n%s", got)
+	}
+	h.collect("grids")
+	if got := h.collect("lag"); !strings.Contains(got, "grids=0i") {
+		t.Errorf("no report after the first grids:\n%s", got)
+	}
+	f.SetSimSpeed(1)
+	h.collect("server")
+
+	f.SpawnGrid(TorchMetricsSessionGrid{EntityId: 1, DisplayName: "Hauler", OwnerDisplayName: "Alice", Mass: 900000, LinearSpeed: 20, BlocksCount: 400, ConveyorSystemLineCount: 50})
+	f.SpawnGrid(TorchMetricsSessionGrid{EntityId: 2, DisplayName: "Racer", OwnerDisplayName: "Bob", Mass: 20000, LinearSpeed: 95, BlocksCount: 80})
+	f.SpawnGrid(TorchMetricsSessionGrid{EntityId: 3, DisplayName: "Base", OwnerDisplayName: "Carol", Mass: 5000000, BlocksCount: 9000, ConveyorSystemLineCount: 300, ConveyorSystemInventoryBlockCount: 40})
+
+	h.collect("grids")
+	h.collect("server")
+	if got := h.collect("lag"); got != "" {
+		t.Errorf("lag reported at full sim speed:\n%s", got)
+	}
+
+	f.SetSimSpeed(0.5)
+	h.collect("server")
+	h.collect("load")
+	got := h.collect("lag")
+	want := "lag,host=http://torch:8080,type=sim_speed file=\"" + filepath.Join(dir, "lag-20181104T120000Z.json") + "\",grids=3i,text=\"sim_speed 0.5 below 0.8, top blocks: Base (Carol), conveyors: Base (Carol), mass: Base (Carol), speed: Racer (Bob), 3 grids spawned\",threshold=0.8,value=0.5 1541332800000000000\n"
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "lag-20181104T120000Z.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report LagReport
+	if err := json.Unmarshal(b, &report); err != nil {
+		t.Fatal(err)
+	}
+	mass := report.Top["mass"]
+	if len(mass) != 2 || mass[0].DisplayName != "Base" || mass[1].DisplayName != "Hauler" {
+		t.Errorf("unexpected mass ranking %+v", mass)
+	}
+	if len(report.Spawned) != 3 || !report.Spawned[0].Spawned {
+		t.Errorf("unexpected spawned grids %+v", report.Spawned)
+	}
+	if c := report.Top["conveyors"][0].Conveyors; c != 340 {
+		t.Errorf("conveyor score %v, want 340", c)
+	}
+
+	// Still lagging: no new report until both signals recovered.
+	clock.Advance(10 * time.Second)
+	h.collect("server")
+	if got := h.collect("lag"); got != "" {
+		t.Errorf("repeated lag report:\n%s", got)
+	}
+	f.SetSimSpeed(1)
+	h.collect("server")
+	h.collect("load")
+	f.SetSimSpeed(0.7)
+	clock.Advance(10 * time.Second)
+	h.collect("load")
+	if got := h.collect("lag"); !strings.Contains(got, "type=server_simulation_ratio") {
+		t.Errorf("no report after recovering:\n%s", got)
+	}
+}
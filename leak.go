@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// leakMinCollections is the number of gen2 collections within the window a
+// leak is reported on at the least.
+const leakMinCollections = 3
+
+// leakFields are the process fields whose floors are tracked, the ones
+// forecast against the limit first.
+var leakFields = []string{"private_memory_size64", "working_set64", "gc_total_memory"}
+
+// LeakDetector is a processor that watches the memory of the dedicated server for leaks. A gen2
+// collection is the most memory the garbage collector reclaims, so the
+// memory reported right after one is the floor the process cannot get
+// below. Floors that keep growing within Window point to a leak: the
+// detector fits a trend over them and forecasts when the floor of the
+// private memory or working set reaches Limit.
+//
+// Every process point adds a "memory_leak" point, plus an alert when the
+// limit comes into the horizon. The floors start over with every server
+// restart, which the falling collection counts give away.
+type LeakDetector struct {
+	Window time.Duration
+	// Limit is the memory in bytes the server must stay below, 0 disables
+	// forecasts and alerts.
+	Limit int64
+	// Horizon raises an alert when the limit is projected to be hit within
+	// it, suggesting a restart before then.
+	Horizon time.Duration
+	Clock   Clock
+
+	host    string
+	mu      sync.Mutex
+	started time.Time
+	last    *TorchMetricsProcess
+	floors  map[string]*trend
+	alerted bool
+}
+
+func NewLeakDetector(host string, window time.Duration, limit int64, horizon time.Duration, clock Clock) *LeakDetector {
+	return &LeakDetector{
+		Window:  window,
+		Limit:   limit,
+		Horizon: horizon,
+		Clock:   clock,
+		host:    host,
+		floors:  make(map[string]*trend),
+	}
+}
+
+func (d *LeakDetector) Name() string {
+	return "leak"
+}
+
+func (d *LeakDetector) Process(points []*client.Point) ([]*client.Point, error) {
+	now := d.Clock.Now()
+	var leaks []*client.Point
+	for _, pt := range points {
+		if pt.Name() != "process" {
+			continue
+		}
+		fields, err := pt.Fields()
+		if err != nil {
+			return nil, err
+		}
+		number := func(field string) int64 {
+			v, _ := fieldValue(fields[field])
+			return int64(v)
+		}
+		ts := pt.Time()
+		if ts.IsZero() {
+			ts = now
+		}
+		leak, err := d.Observe(&TorchMetricsProcess{
+			PrivateMemorySize64: number("private_memory_size64"),
+			WorkingSet64:        number("working_set64"),
+			GCTotalMemory:       number("gc_total_memory"),
+			GCCollectionCount0:  int(number("gc_collection_count0")),
+			GCCollectionCount2:  int(number("gc_collection_count2")),
+		}, ts)
+		if err != nil {
+			return nil, err
+		}
+		leaks = append(leaks, leak...)
+	}
+	if len(leaks) == 0 {
+		return points, nil
+	}
+	return append(points[:len(points):len(points)], leaks...), nil
+}
+
+// Observe records the process memory reported at now and returns the
+// memory floors, their growth and the forecast.
+func (d *LeakDetector) Observe(process *TorchMetricsProcess, now time.Time) ([]*client.Point, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.last != nil && process.GCCollectionCount0 < d.last.GCCollectionCount0 {
+		d.started = time.Time{}
+		d.floors = make(map[string]*trend)
+		d.alerted = false
+	}
+	if d.started.IsZero() {
+		d.started = now
+	}
+	gen2 := d.last != nil && process.GCCollectionCount2 > d.last.GCCollectionCount2
+	d.last = process
+
+	values := map[string]int64{
+		"private_memory_size64": process.PrivateMemorySize64,
+		"working_set64":         process.WorkingSet64,
+		"gc_total_memory":       process.GCTotalMemory,
+	}
+	fields := map[string]interface{}{
+		"tracked": now.Sub(d.started).Seconds(),
+	}
+	var alert *Alert
+	for _, field := range leakFields {
+		floor, ok := d.floors[field]
+		if !ok {
+			floor = &trend{}
+			d.floors[field] = floor
+		}
+		if gen2 {
+			floor.add(now, float64(values[field]), d.Window)
+		}
+		if len(floor.samples) == 0 {
+			continue
+		}
+		fields["collections"] = len(floor.samples)
+		last := floor.samples[len(floor.samples)-1].value
+		fields[field+"_floor"] = last
+		slope, ok := floor.slope(d.Window)
+		if !ok || len(floor.samples) < leakMinCollections {
+			continue
+		}
+		fields[field+"_per_hour"] = slope * 3600
+		if field == "gc_total_memory" {
+			// The managed heap is part of the private memory.
+			continue
+		}
+		eta, ok := timeToLimit(last, float64(d.Limit), slope)
+		if !ok {
+			continue
+		}
+		if current, ok := fields["time_to_limit"].(float64); ok && current <= eta.Seconds() {
+			continue
+		}
+		fields["time_to_limit"] = eta.Seconds()
+		alert = &Alert{
+			Rule: "memory_leak",
+			Message: fmt.Sprintf("%s grows %.0f MiB/h across gen2 collections, limit of %.1f GiB projected in %s: restart before %s",
+				field, slope*3600/(1<<20), float64(d.Limit)/(1<<30), eta, now.Add(eta).UTC().Format(time.RFC3339)),
+			Value:     eta.Seconds(),
+			Threshold: d.Horizon.Seconds(),
+			Tags:      map[string]string{"field": field},
+		}
+	}
+
+	points := make([]*client.Point, 0, 2)
+	pt, err := client.NewPoint("memory_leak", map[string]string{"host": d.host}, fields, now)
+	if err != nil {
+		return nil, err
+	}
+	points = append(points, pt)
+
+	// Alert once until the projection leaves the horizon again.
+	if alert == nil || d.Horizon <= 0 || alert.Value > d.Horizon.Seconds() {
+		d.alerted = false
+		return points, nil
+	}
+	if d.alerted {
+		return points, nil
+	}
+	d.alerted = true
+	alert.Time = now
+	alert.Log()
+	pt, err = alert.Point(d.host)
+	if err != nil {
+		return nil, err
+	}
+	return append(points, pt), nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLeakDetector(t *testing.T) {
+	h, f, clock := newFakeTorchHarness(t)
+	h.exporter.Processors = []Processor{NewLeakDetector(testHost, 2*time.Hour, 8<<30, 6*time.Hour, clock)}
+	h.collect("process")
+
+	// Memory that gen2 collections reclaim is no leak.
+	for i := 0; i < 6; i++ {
+		clock.Advance(10 * time.Minute)
+		f.GrowMemory(512 << 20)
+		f.CollectGarbage(2)
+		f.GrowMemory(-512 << 20)
+		if got := h.collect("process"); strings.Contains(got, "alert") || strings.Contains(got, "time_to_limit") {
+			t.Fatalf("leak reported for reclaimed memory:\n%s", got)
+		}
+	}
+
+	// 256 MiB every 10 minutes survive the collections. Together with the
+	// flat floors before, the trend reaches the limit within the horizon
+	// after an hour.
+	var alerts []string
+	for i := 0; i < 6; i++ {
+		clock.Advance(10 * time.Minute)
+		f.GrowMemory(256 << 20)
+		f.CollectGarbage(2)
+		for _, line := range strings.Split(h.collect("process"), "\n") {
+			if strings.HasPrefix(line, "alert,") {
+				alerts = append(alerts, line)
+			}
+		}
+	}
+	want := "alert,field=private_memory_size64,host=http://torch:8080,rule=memory_leak message=\"private_memory_size64 grows 865 MiB/h across gen2 collections, limit of 8.0 GiB projected in 5h19m45s: restart before 2018-11-04T19:19:45Z\",threshold=21600,value=19185 1541340000000000000"
+	if len(alerts) != 1 || alerts[0] != want {
+		t.Errorf("got alerts\n%s\nwant\n%s", strings.Join(alerts, "\n"), want)
+	}
+
+	// A restart starts over.
+	f.Restart(time.Minute)
+	clock.Advance(10 * time.Minute)
+	if got := h.collect("process"); !strings.HasSuffix(got, "\nmemory_leak,host=http://torch:8080 tracked=0 1541340600000000000\n") {
+		t.Errorf("unexpected point after a restart:\n%s", got)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// MemorySink keeps every point written to it in memory.
+type MemorySink struct {
+	mu     sync.Mutex
+	points []*client.Point
+}
+
+func NewMemorySink() *MemorySink {
+	return &MemorySink{}
+}
+
+func (s *MemorySink) Name() string {
+	return "memory"
+}
+
+func (s *MemorySink) Write(points []*client.Point) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.points = append(s.points, points...)
+	return nil
+}
+
+// Points returns the points written so far.
+func (s *MemorySink) Points() []*client.Point {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*client.Point{}, s.points...)
+}
+
+// Reset drops all points.
+func (s *MemorySink) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.points = nil
+}
+
+// LineProtocol returns the points written so far in Influx line protocol,
+// one point per line.
+func (s *MemorySink) LineProtocol() string {
+	var b strings.Builder
+	for _, pt := range s.Points() {
+		b.WriteString(pt.String())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/pkg/errors"
+)
+
+// MQTT 3.1.1 control packet types.
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttDisconnect = 14
+)
+
+// MQTTSink publishes live server state to an MQTT broker (MQTT 3.1.1):
+//
+//	<prefix>/server           the latest "server" point, retained
+//	<prefix>/players/<type>   every player join and leave
+//	<prefix>/alerts/<rule>    the latest alert of a rule, retained
+//
+// Payloads are JSON objects with the time, measurement, tags and fields of
+// the point. QoS 0 and 1 are supported; with QoS 1 every message is
+// acknowledged before Write returns.
+type MQTTSink struct {
+	Address  string
+	ClientID string
+	// Username and Password authenticate with the broker, MQTT 3.1.1 allows
+	// no password without a username.
+	Username string
+	Password string
+	Prefix   string
+	QoS      byte
+	// Retain keeps the server and alert state on the broker for new
+	// subscribers. Player events are never retained.
+	Retain  bool
+	Timeout time.Duration
+	Clock   Clock
+
+	mu       sync.Mutex
+	conn     net.Conn
+	r        *bufio.Reader
+	packetID uint16
+	backoff  time.Duration
+	retry    time.Time
+}
+
+func NewMQTTSink(address, prefix string, clock Clock) *MQTTSink {
+	return &MQTTSink{
+		Address:  strings.TrimPrefix(address, "tcp://"),
+		ClientID: "spaceengineers-metrics",
+		Prefix:   strings.TrimSuffix(prefix, "/"),
+		Retain:   true,
+		Timeout:  10 * time.Second,
+		Clock:    clock,
+	}
+}
+
+func (s *MQTTSink) Name() string {
+	return "mqtt"
+}
+
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+func (s *MQTTSink) Write(points []*client.Point) error {
+	messages, err := s.messages(points)
+	if err != nil {
+		return err
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A connection that was closed by the broker is usually only noticed
+	// on the next write, so give a fresh connection a second chance.
+	err = s.publish(messages)
+	if err != nil && s.conn == nil && s.retry.IsZero() {
+		err = s.publish(messages)
+	}
+	return err
+}
+
+func (s *MQTTSink) messages(points []*client.Point) ([]mqttMessage, error) {
+	now := s.Clock.Now()
+	var messages []mqttMessage
+	for _, pt := range points {
+		var topic string
+		retain := s.Retain
+		switch pt.Name() {
+		case "server":
+			topic = s.Prefix + "/server"
+		case "players":
+			topic = s.Prefix + "/players/" + strings.ToLower(pt.Tags()["type"])
+			retain = false
+		case "alert":
+			topic = s.Prefix + "/alerts/" + pt.Tags()["rule"]
+		default:
+			continue
+		}
+		entry, err := pointEntry(pt, now)
+		if err != nil {
+			return nil, err
+		}
+		payload, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, mqttMessage{topic, payload, retain})
+	}
+	return messages, nil
+}
+
+func (s *MQTTSink) publish(messages []mqttMessage) error {
+	if s.conn == nil {
+		if err := s.dial(); err != nil {
+			return err
+		}
+	}
+	s.conn.SetDeadline(time.Now().Add(s.Timeout))
+
+	var b bytes.Buffer
+	pending := make(map[uint16]bool)
+	for _, m := range messages {
+		var packet mqttPacket
+		packet.string(m.topic)
+		flags := s.QoS << 1
+		if m.retain {
+			flags |= 1
+		}
+		if s.QoS > 0 {
+			s.packetID++
+			if s.packetID == 0 {
+				s.packetID++
+			}
+			pending[s.packetID] = true
+			binary.Write(&packet, binary.BigEndian, s.packetID)
+		}
+		packet.Write(m.payload)
+		packet.writeTo(&b, mqttPublish<<4|flags)
+	}
+	if _, err := s.conn.Write(b.Bytes()); err != nil {
+		s.close()
+		return errors.Wrap(err, "mqtt publish")
+	}
+
+	for len(pending) > 0 {
+		typ, body, err := readMQTTPacket(s.r)
+		if err != nil {
+			s.close()
+			return errors.Wrap(err, "mqtt puback")
+		}
+		if typ>>4 == mqttPuback && len(body) == 2 {
+			delete(pending, binary.BigEndian.Uint16(body))
+		}
+	}
+	return nil
+}
+
+// dial connects to the broker, backing off exponentially up to a minute
+// after failed attempts.
+func (s *MQTTSink) dial() error {
+	now := s.Clock.Now()
+	if now.Before(s.retry) {
+		return errors.Errorf("mqtt: not reconnecting before %s", s.retry.Format(time.RFC3339))
+	}
+	err := s.connect()
+	if err != nil {
+		if s.backoff == 0 {
+			s.backoff = time.Second
+		} else if s.backoff < time.Minute {
+			s.backoff *= 2
+		}
+		s.retry = now.Add(s.backoff)
+		return err
+	}
+	s.backoff = 0
+	s.retry = time.Time{}
+	return nil
+}
+
+func (s *MQTTSink) connect() error {
+	if s.Password != "" && s.Username == "" {
+		return errors.New("mqtt password without username")
+	}
+	conn, err := net.DialTimeout("tcp", s.Address, s.Timeout)
+	if err != nil {
+		return errors.Wrap(err, "mqtt dial")
+	}
+	conn.SetDeadline(time.Now().Add(s.Timeout))
+
+	var packet mqttPacket
+	packet.string("MQTT")
+	packet.WriteByte(4) // protocol level 3.1.1
+	flags := byte(0x02) // clean session
+	if s.Username != "" {
+		flags |= 0x80
+	}
+	if s.Password != "" {
+		flags |= 0x40
+	}
+	packet.WriteByte(flags)
+	binary.Write(&packet, binary.BigEndian, uint16(0)) // no keep alive
+	packet.string(s.ClientID)
+	if s.Username != "" {
+		packet.string(s.Username)
+	}
+	if s.Password != "" {
+		packet.string(s.Password)
+	}
+	var b bytes.Buffer
+	packet.writeTo(&b, mqttConnect<<4)
+	if _, err := conn.Write(b.Bytes()); err != nil {
+		conn.Close()
+		return errors.Wrap(err, "mqtt connect")
+	}
+
+	r := bufio.NewReader(conn)
+	typ, body, err := readMQTTPacket(r)
+	if err != nil {
+		conn.Close()
+		return errors.Wrap(err, "mqtt connack")
+	}
+	if typ>>4 != mqttConnack || len(body) != 2 {
+		conn.Close()
+		return errors.Errorf("mqtt: unexpected packet type %d instead of connack", typ>>4)
+	}
+	if code := body[1]; code != 0 {
+		conn.Close()
+		return errors.Errorf("mqtt: connection refused with return code %d", code)
+	}
+	s.conn = conn
+	s.r = r
+	return nil
+}
+
+func (s *MQTTSink) close() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// Close disconnects from the broker.
+func (s *MQTTSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	s.conn.Write([]byte{mqttDisconnect << 4, 0})
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// mqttPacket is the variable header and payload of a control packet.
+type mqttPacket struct {
+	bytes.Buffer
+}
+
+func (p *mqttPacket) string(s string) {
+	binary.Write(p, binary.BigEndian, uint16(len(s)))
+	p.WriteString(s)
+}
+
+// writeTo writes the packet to w, preceded by its fixed header.
+func (p *mqttPacket) writeTo(w *bytes.Buffer, header byte) {
+	w.WriteByte(header)
+	n := p.Len()
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		w.WriteByte(digit)
+		if n == 0 {
+			break
+		}
+	}
+	w.Write(p.Bytes())
+}
+
+// readMQTTPacket reads a control packet and returns the first byte of its
+// fixed header and the rest of the packet.
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
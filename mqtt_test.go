@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+type brokerMessage struct {
+	topic   string
+	payload string
+	qos     byte
+	retain  bool
+}
+
+// testBroker is a minimal MQTT 3.1.1 broker that accepts every client and
+// records what is published to it.
+type testBroker struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	conns    []net.Conn
+	clients  []string
+	messages []brokerMessage
+	retained map[string]string
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{listener: l, retained: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.conns = append(b.conns, conn)
+			b.mu.Unlock()
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *testBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		header, body, err := readMQTTPacket(r)
+		if err != nil {
+			return
+		}
+		switch header >> 4 {
+		case mqttConnect:
+			// Skip protocol name, level, flags and keep alive.
+			idLen := int(binary.BigEndian.Uint16(body[10:]))
+			b.mu.Lock()
+			b.clients = append(b.clients, string(body[12:12+idLen]))
+			b.mu.Unlock()
+			conn.Write([]byte{mqttConnack << 4, 2, 0, 0})
+		case mqttPublish:
+			m := brokerMessage{qos: header >> 1 & 3, retain: header&1 == 1}
+			topicLen := int(binary.BigEndian.Uint16(body))
+			m.topic = string(body[2 : 2+topicLen])
+			body = body[2+topicLen:]
+			if m.qos > 0 {
+				conn.Write([]byte{mqttPuback << 4, 2, body[0], body[1]})
+				body = body[2:]
+			}
+			m.payload = string(body)
+			b.mu.Lock()
+			b.messages = append(b.messages, m)
+			if m.retain {
+				b.retained[m.topic] = m.payload
+			}
+			b.mu.Unlock()
+		case mqttDisconnect:
+			return
+		}
+	}
+}
+
+// drop closes all client connections.
+func (b *testBroker) drop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, conn := range b.conns {
+		conn.Close()
+	}
+	b.conns = nil
+}
+
+func (b *testBroker) published() []brokerMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]brokerMessage(nil), b.messages...)
+}
+
+func TestMQTTSink(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.listener.Close()
+
+	h := newHarness(t, "testdata/torch")
+	var points []*client.Point
+	for _, name := range []string{"server", "players", "load"} {
+		h.collect(name)
+		points = append(points, h.sink.Points()...)
+	}
+	alert := &Alert{Rule: "save_duration", Message: "world save took 7.5s", Value: 7.5, Threshold: 5, Time: testEpoch}
+	pt, err := alert.Point(testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	points = append(points, pt)
+
+	s := NewMQTTSink("tcp://"+broker.listener.Addr().String(), "se/fank", h.clock)
+	s.QoS = 1
+	defer s.Close()
+	if err := s.Write(points); err != nil {
+		t.Fatal(err)
+	}
+
+	got := broker.published()
+	want := []brokerMessage{
+		{topic: "se/fank/server", qos: 1, retain: true},
+		{topic: "se/fank/players/joined", qos: 1},
+		{topic: "se/fank/players/left", qos: 1},
+		{topic: "se/fank/alerts/save_duration", qos: 1, retain: true},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d messages, want %d: %v", len(got), len(want), got)
+	}
+	for i, m := range got {
+		if m.topic != want[i].topic || m.qos != want[i].qos || m.retain != want[i].retain {
+			t.Errorf("got %s qos %d retain %v, want %s qos %d retain %v", m.topic, m.qos, m.retain, want[i].topic, want[i].qos, want[i].retain)
+		}
+	}
+
+	broker.mu.Lock()
+	retained := broker.retained["se/fank/server"]
+	broker.mu.Unlock()
+	var server map[string]interface{}
+	if err := json.Unmarshal([]byte(retained), &server); err != nil {
+		t.Fatal(err)
+	}
+	if server["server_name"] != "Fankserver" || server["sim_speed"] != 0.87 || server["time"] != "2018-11-04T12:00:00Z" {
+		t.Errorf("unexpected server snapshot %v", server)
+	}
+
+	// The sink reconnects after losing the connection.
+	broker.drop()
+	if err := s.Write(points[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(broker.published()); n != len(want)+1 {
+		t.Errorf("got %d messages after reconnecting, want %d", n, len(want)+1)
+	}
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if len(broker.clients) != 2 || broker.clients[1] != "spaceengineers-metrics" {
+		t.Errorf("unexpected clients %v", broker.clients)
+	}
+}
+
+func TestMQTTSinkBackoff(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	clock := NewFakeClock(testEpoch)
+	s := NewMQTTSink(addr, "se", clock)
+	s.Timeout = time.Second
+	server, err := client.NewPoint("server", map[string]string{"host": testHost}, map[string]interface{}{"players": 1}, testEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write([]*client.Point{server}); err == nil {
+		t.Fatal("expected dial error")
+	}
+	if err := s.Write([]*client.Point{server}); err == nil || s.retry.Sub(testEpoch) != time.Second {
+		t.Errorf("expected backoff of a second, got %v until %s", err, s.retry)
+	}
+}
+
+func TestMQTTSinkPasswordWithoutUsername(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s := NewMQTTSink(l.Addr().String(), "se", NewFakeClock(testEpoch))
+	s.Password = "secret"
+	server, err := client.NewPoint("server", map[string]string{"host": testHost}, map[string]interface{}{"players": 1}, testEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write([]*client.Point{server}); err == nil || !strings.Contains(err.Error(), "password without username") {
+		t.Errorf("got %v, want the password to be rejected", err)
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+)
+
+const otlpGRPCPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+// otlpCounters are the fields exported as monotonic cumulative sums, all
+// other numeric fields are gauges.
+var otlpCounters = map[string]bool{
+	"server.total_time":                true,
+	"process.gc_collection_count0":     true,
+	"process.gc_collection_count1":     true,
+	"process.gc_collection_count2":     true,
+	"exporter_collector.scrapes":       true,
+	"exporter_collector.errors":        true,
+	"exporter_collector.decode_errors": true,
+	"exporter_collector.skipped_ticks": true,
+	"exporter_collector.points":        true,
+	"exporter_sink.writes":             true,
+	"exporter_sink.failures":           true,
+	"exporter_sink.points":             true,
+}
+
+// otlpResourceTags describe the game server rather than a single point and
+// are moved to the resource.
+var otlpResourceTags = map[string]string{
+	"host":        "service.instance.id",
+	"server_name": "spaceengineers.server_name",
+	"world_name":  "spaceengineers.world_name",
+	"version":     "service.version",
+}
+
+// OTLPSink exports points as OpenTelemetry metrics over OTLP, either
+// HTTP/protobuf or gRPC.
+//
+// Numeric fields become metrics named spaceengineers.<measurement>.<field>.
+// Occurrences (player events, server events, saves and alerts) are counted
+// into delta sums named spaceengineers.<measurement>. The server name, world
+// name and version of the last "server" point are exported as resource
+// attributes, the host from the start.
+//
+// A cumulative sum that decreased was reset, e.g. by a server restart, and
+// its series starts over at the time of the previous data point.
+type OTLPSink struct {
+	// Endpoint is the collector base url, e.g. http://localhost:4318 for
+	// HTTP or http://localhost:4317 for gRPC. https enables TLS.
+	Endpoint string
+	GRPC     bool
+	Headers  map[string]string
+	Clock    Clock
+
+	client *http.Client
+	start  time.Time
+
+	mu         sync.Mutex
+	resource   map[string]string
+	lastExport time.Time
+	series     map[string]otlpSeries
+}
+
+// otlpSeries is the last data point of a cumulative sum and when the sum
+// started.
+type otlpSeries struct {
+	start time.Time
+	time  time.Time
+	value float64
+}
+
+func NewOTLPSink(endpoint, host string, grpc bool, clock Clock) *OTLPSink {
+	s := &OTLPSink{
+		Endpoint: strings.TrimSuffix(endpoint, "/"),
+		GRPC:     grpc,
+		Clock:    clock,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		start:    clock.Now(),
+		resource: map[string]string{
+			"service.name":        "spaceengineers",
+			"service.instance.id": host,
+		},
+		lastExport: clock.Now(),
+		series:     make(map[string]otlpSeries),
+	}
+	if grpc && strings.HasPrefix(endpoint, "http://") {
+		// gRPC without TLS needs HTTP/2 with prior knowledge (h2c).
+		s.client.Transport = &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		}
+	} else if grpc {
+		s.client.Transport = &http2.Transport{}
+	}
+	return s
+}
+
+func (s *OTLPSink) Name() string {
+	return "otlp"
+}
+
+type otlpMetric struct {
+	name        string
+	unit        string
+	sum         bool
+	delta       bool
+	dataPoints  []otlpDataPoint
+	occurrences map[string]*otlpDataPoint
+}
+
+type otlpDataPoint struct {
+	attributes map[string]string
+	start      time.Time
+	time       time.Time
+	value      float64
+}
+
+func (s *OTLPSink) Write(points []*client.Point) error {
+	s.mu.Lock()
+	now := s.Clock.Now()
+	for _, pt := range points {
+		if pt.Name() != "server" {
+			continue
+		}
+		for tag, attribute := range otlpResourceTags {
+			if value := pt.Tags()[tag]; value != "" {
+				s.resource[attribute] = value
+			}
+		}
+	}
+	resource := make(map[string]string, len(s.resource))
+	for k, v := range s.resource {
+		resource[k] = v
+	}
+	since := s.lastExport
+	s.lastExport = now
+	metrics, err := s.metrics(points, since, now)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if len(metrics) == 0 {
+		return nil
+	}
+	return s.export(encodeOTLPRequest(resource, metrics))
+}
+
+func (s *OTLPSink) metrics(points []*client.Point, since, now time.Time) ([]*otlpMetric, error) {
+	byName := make(map[string]*otlpMetric)
+	metric := func(name string) *otlpMetric {
+		m, ok := byName[name]
+		if !ok {
+			m = &otlpMetric{name: name}
+			byName[name] = m
+		}
+		return m
+	}
+
+	for _, pt := range points {
+		attributes := make(map[string]string)
+		for k, v := range pt.Tags() {
+			if _, ok := otlpResourceTags[k]; !ok && v != "" {
+				attributes[k] = v
+			}
+		}
+
+		if occurrences[pt.Name()] {
+			m := metric("spaceengineers." + pt.Name())
+			m.sum, m.delta = true, true
+			if m.occurrences == nil {
+				m.occurrences = make(map[string]*otlpDataPoint)
+			}
+			// Only the type of an occurrence is kept, everything else
+			// would make every data point unique.
+			key := attributes["type"] + "\x00" + attributes["rule"]
+			dp, ok := m.occurrences[key]
+			if !ok {
+				dp = &otlpDataPoint{attributes: map[string]string{}, start: since, time: now}
+				for _, k := range []string{"type", "rule"} {
+					if v := attributes[k]; v != "" {
+						dp.attributes[k] = v
+					}
+				}
+				m.occurrences[key] = dp
+			}
+			dp.value++
+			continue
+		}
+
+		fields, err := pt.Fields()
+		if err != nil {
+			return nil, err
+		}
+		ts := pt.Time()
+		if ts.IsZero() {
+			ts = now
+		}
+		for field, v := range fields {
+			value, ok := fieldValue(v)
+			if !ok {
+				continue
+			}
+			key := pt.Name() + "." + field
+			m := metric("spaceengineers." + key)
+			m.sum = otlpCounters[key]
+			m.unit = otlpUnit(pt.Name(), field)
+			start := s.start
+			if key == "server.total_time" {
+				// The uptime starts over with every server restart.
+				start = ts.Add(-time.Duration(value) * time.Second)
+			} else if m.sum {
+				start = s.cumulativeStart(storeKey(pt.Name(), field, pt.Tags()), ts, value)
+			}
+			m.dataPoints = append(m.dataPoints, otlpDataPoint{
+				attributes: attributes,
+				start:      start,
+				time:       ts,
+				value:      value,
+			})
+		}
+	}
+
+	metrics := make([]*otlpMetric, 0, len(byName))
+	for _, m := range byName {
+		for _, dp := range m.occurrences {
+			m.dataPoints = append(m.dataPoints, *dp)
+		}
+		metrics = append(metrics, m)
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name < metrics[j].name })
+	return metrics, nil
+}
+
+// cumulativeStart records value of the cumulative series key at ts and
+// returns when the series started.
+func (s *OTLPSink) cumulativeStart(key string, ts time.Time, value float64) time.Time {
+	series, ok := s.series[key]
+	if !ok {
+		series.start = s.start
+	} else if value < series.value {
+		series.start = series.time
+	}
+	series.time, series.value = ts, value
+	s.series[key] = series
+	return series.start
+}
+
+func otlpUnit(measurement, field string) string {
+	switch {
+	case measurement == "process" && (strings.HasSuffix(field, "64") || field == "gc_total_memory"):
+		return "By"
+	case field == "save_duration":
+		return "ms"
+	case field == "total_time" || strings.HasSuffix(field, "duration"):
+		return "s"
+	case measurement == "save_stats" && field != "count":
+		return "s"
+	case strings.Contains(field, "load"):
+		return "%"
+	default:
+		return "1"
+	}
+}
+
+func (s *OTLPSink) export(body []byte) error {
+	url := s.Endpoint + "/v1/metrics"
+	contentType := "application/x-protobuf"
+	if s.GRPC {
+		url = s.Endpoint + otlpGRPCPath
+		contentType = "application/grpc"
+		framed := make([]byte, 5, 5+len(body))
+		binary.BigEndian.PutUint32(framed[1:], uint32(len(body)))
+		body = append(framed, body...)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if s.GRPC {
+		req.Header.Set("TE", "trailers")
+	}
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "otlp")
+	}
+	defer res.Body.Close()
+	response, _ := ioutil.ReadAll(res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("otlp: %s: %s", res.Status, bytes.TrimSpace(response))
+	}
+	if s.GRPC {
+		status := res.Trailer.Get("Grpc-Status")
+		if status == "" {
+			status = res.Header.Get("Grpc-Status")
+		}
+		if status != "0" {
+			return errors.Errorf("otlp: grpc status %s: %s", status, res.Trailer.Get("Grpc-Message"))
+		}
+	}
+	return nil
+}
+
+// encodeOTLPRequest encodes an ExportMetricsServiceRequest with a single
+// resource and scope.
+func encodeOTLPRequest(resource map[string]string, metrics []*otlpMetric) []byte {
+	var res protoBuffer
+	for _, k := range sortedStrings(resource) {
+		res.message(1, keyValue(k, resource[k]))
+	}
+
+	var scope protoBuffer
+	scope.string(1, "spaceengineers-metrics")
+
+	var scopeMetrics protoBuffer
+	scopeMetrics.message(1, &scope)
+	for _, m := range metrics {
+		var dataPoints protoBuffer
+		for _, dp := range m.dataPoints {
+			var p protoBuffer
+			if m.sum {
+				p.fixed64(2, uint64(dp.start.UnixNano()))
+			}
+			p.fixed64(3, uint64(dp.time.UnixNano()))
+			p.double(4, dp.value)
+			for _, k := range sortedStrings(dp.attributes) {
+				p.message(7, keyValue(k, dp.attributes[k]))
+			}
+			dataPoints.message(1, &p)
+		}
+
+		var metric protoBuffer
+		metric.string(1, m.name)
+		if m.unit != "" {
+			metric.string(3, m.unit)
+		}
+		if m.sum {
+			temporality := uint64(2) // CUMULATIVE
+			if m.delta {
+				temporality = 1 // DELTA
+			}
+			dataPoints.varint(2, temporality)
+			dataPoints.varint(3, 1) // is_monotonic
+			metric.message(7, &dataPoints)
+		} else {
+			metric.message(5, &dataPoints)
+		}
+		scopeMetrics.message(2, &metric)
+	}
+
+	var resourceMetrics protoBuffer
+	resourceMetrics.message(1, &res)
+	resourceMetrics.message(2, &scopeMetrics)
+
+	var request protoBuffer
+	request.message(1, &resourceMetrics)
+	return request.Bytes()
+}
+
+func keyValue(key, value string) *protoBuffer {
+	var anyValue protoBuffer
+	anyValue.string(1, value)
+
+	var kv protoBuffer
+	kv.string(1, key)
+	kv.message(2, &anyValue)
+	return &kv
+}
+
+func sortedStrings(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// protoBuffer writes the protobuf wire format, just enough of it for the
+// OTLP messages above.
+type protoBuffer struct {
+	bytes.Buffer
+}
+
+func (b *protoBuffer) tag(field int, wireType uint64) {
+	b.uvarint(uint64(field)<<3 | wireType)
+}
+
+func (b *protoBuffer) uvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func (b *protoBuffer) varint(field int, v uint64) {
+	b.tag(field, 0)
+	b.uvarint(v)
+}
+
+func (b *protoBuffer) fixed64(field int, v uint64) {
+	b.tag(field, 1)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	b.Write(buf[:])
+}
+
+func (b *protoBuffer) double(field int, v float64) {
+	b.fixed64(field, math.Float64bits(v))
+}
+
+func (b *protoBuffer) raw(field int, p []byte) {
+	b.tag(field, 2)
+	b.uvarint(uint64(len(p)))
+	b.Write(p)
+}
+
+func (b *protoBuffer) string(field int, s string) {
+	b.raw(field, []byte(s))
+}
+
+func (b *protoBuffer) message(field int, m *protoBuffer) {
+	b.raw(field, m.Bytes())
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// protoFields splits a protobuf message into its fields by number. Varints
+// and fixed64 values are returned as their raw bytes.
+func protoFields(t *testing.T, b []byte) map[int][][]byte {
+	fields := make(map[int][][]byte)
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatal("bad protobuf field key")
+		}
+		b = b[n:]
+		var value []byte
+		switch key & 7 {
+		case 0:
+			_, n := binary.Uvarint(b)
+			value, b = b[:n], b[n:]
+		case 1:
+			value, b = b[:8], b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			value, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+		fields[int(key>>3)] = append(fields[int(key>>3)], value)
+	}
+	return fields
+}
+
+// otlpSummary renders an ExportMetricsServiceRequest as sorted lines of
+// "resource <key>=<value>" and "<gauge|sum|delta> <name> <value> <attributes>".
+func otlpSummary(t *testing.T, body []byte) []string {
+	keyValues := func(kvs [][]byte) string {
+		var pairs []string
+		for _, kv := range kvs {
+			f := protoFields(t, kv)
+			pairs = append(pairs, fmt.Sprintf("%s=%s", f[1][0], protoFields(t, f[2][0])[1][0]))
+		}
+		return strings.Join(pairs, ",")
+	}
+
+	var lines []string
+	for _, rm := range protoFields(t, body)[1] {
+		rmFields := protoFields(t, rm)
+		for _, kv := range protoFields(t, rmFields[1][0])[1] {
+			lines = append(lines, "resource "+keyValues([][]byte{kv}))
+		}
+		for _, m := range protoFields(t, rmFields[2][0])[2] {
+			f := protoFields(t, m)
+			kind, data := "gauge", f[5]
+			if data == nil {
+				kind, data = "sum", f[7]
+				if temporality, _ := binary.Uvarint(protoFields(t, data[0])[2][0]); temporality == 1 {
+					kind = "delta"
+				}
+			}
+			for _, dp := range protoFields(t, data[0])[1] {
+				dpFields := protoFields(t, dp)
+				value := math.Float64frombits(binary.LittleEndian.Uint64(dpFields[4][0]))
+				lines = append(lines, fmt.Sprintf("%s %s %g %s", kind, f[1][0], value, keyValues(dpFields[7])))
+			}
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func otlpTestPoints(t *testing.T) []*client.Point {
+	server, err := client.NewPoint("server", map[string]string{"host": "h", "server_name": "Fank", "world_name": "Star System", "version": "1.188"}, map[string]interface{}{"sim_speed": 0.87, "total_time": 3600, "block_limit": "PER_PLAYER"}, testEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	joined, err := client.NewPoint("players", map[string]string{"host": "h", "type": PlayerJoined, "steam_id": "1"}, map[string]interface{}{"value": 1}, testEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := client.NewPoint("players", map[string]string{"host": "h", "type": PlayerJoined, "steam_id": "2"}, map[string]interface{}{"value": 1}, testEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grid, err := client.NewPoint("grid", map[string]string{"host": "h", "name": "Rover"}, map[string]interface{}{"pcu": 10}, testEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []*client.Point{server, joined, second, grid}
+}
+
+var otlpTestWant = []string{
+	"delta spaceengineers.players 2 type=Joined",
+	"gauge spaceengineers.grid.pcu 10 name=Rover",
+	"gauge spaceengineers.server.sim_speed 0.87 ",
+	"resource service.instance.id=h",
+	"resource service.name=spaceengineers",
+	"resource service.version=1.188",
+	"resource spaceengineers.server_name=Fank",
+	"resource spaceengineers.world_name=Star System",
+	"sum spaceengineers.server.total_time 3600 ",
+}
+
+func TestOTLPSinkHTTP(t *testing.T) {
+	var got []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("unexpected %s request with %q", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("missing configured header")
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		got = otlpSummary(t, body)
+	}))
+	defer collector.Close()
+
+	s := NewOTLPSink(collector.URL+"/", "h", false, NewFakeClock(testEpoch))
+	s.Headers = map[string]string{"Authorization": "Bearer token"}
+	if err := s.Write(otlpTestPoints(t)); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, "\n") != strings.Join(otlpTestWant, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(otlpTestWant, "\n"))
+	}
+}
+
+func TestOTLPSinkGRPC(t *testing.T) {
+	var got []string
+	status := "0"
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != otlpGRPCPath || r.ProtoMajor != 2 {
+			t.Errorf("unexpected %s %s request", r.Proto, r.URL.Path)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if len(body) < 5 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+			t.Fatalf("bad grpc frame of %d bytes", len(body))
+		}
+		got = otlpSummary(t, body[5:])
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Write([]byte{0, 0, 0, 0, 0})
+		w.Header().Set("Grpc-Status", status)
+		w.Header().Set("Grpc-Message", "overloaded")
+	})
+	collector := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer collector.Close()
+
+	s := NewOTLPSink(collector.URL, "h", true, NewFakeClock(testEpoch))
+	if err := s.Write(otlpTestPoints(t)); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, "\n") != strings.Join(otlpTestWant, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(otlpTestWant, "\n"))
+	}
+
+	status = "14"
+	if err := s.Write(otlpTestPoints(t)); err == nil || !strings.Contains(err.Error(), "grpc status 14") {
+		t.Errorf("expected grpc status error, got %v", err)
+	}
+}
+
+func TestOTLPSinkResourceBeforeServer(t *testing.T) {
+	var got []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		got = otlpSummary(t, body)
+	}))
+	defer collector.Close()
+
+	s := NewOTLPSink(collector.URL, "h", false, NewFakeClock(testEpoch))
+	if err := s.Write(otlpTestPoints(t)[1:2]); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"delta spaceengineers.players 1 type=Joined",
+		"resource service.instance.id=h",
+		"resource service.name=spaceengineers",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestOTLPSinkCounterReset(t *testing.T) {
+	clock := NewFakeClock(testEpoch)
+	s := NewOTLPSink("http://localhost:4318", "h", false, clock)
+	start := func(count int) time.Time {
+		clock.Advance(time.Minute)
+		pt, err := client.NewPoint("process", map[string]string{"host": "h"}, map[string]interface{}{"gc_collection_count0": count}, clock.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		metrics, err := s.metrics([]*client.Point{pt}, testEpoch, clock.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(metrics) != 1 || !metrics[0].sum || len(metrics[0].dataPoints) != 1 {
+			t.Fatalf("unexpected metrics %+v", metrics)
+		}
+		return metrics[0].dataPoints[0].start
+	}
+
+	for _, count := range []int{5, 7} {
+		if got := start(count); !got.Equal(testEpoch) {
+			t.Errorf("count %d started at %s, want %s", count, got, testEpoch)
+		}
+	}
+	// A restart resets the count, the series starts over after the last
+	// data point before it.
+	for _, count := range []int{2, 3} {
+		if got := start(count); !got.Equal(testEpoch.Add(2 * time.Minute)) {
+			t.Errorf("count %d started at %s after the reset, want %s", count, got, testEpoch.Add(2*time.Minute))
+		}
+	}
+}
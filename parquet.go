@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"reflect"
+	"time"
+)
+
+// Parquet enums, see parquet.thrift.
+const (
+	parquetBoolean   = 0
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+
+	parquetRequired = 0
+
+	parquetPlain = 0
+	parquetRLE   = 3
+
+	parquetUncompressed = 0
+	parquetDataPage     = 0
+)
+
+// writeParquet writes t as a Parquet file with a single row group and a
+// single uncompressed, PLAIN encoded data page per column. All columns are
+// required, so the pages carry no repetition or definition levels.
+func writeParquet(w io.Writer, t *dumpTable) error {
+	var file bytes.Buffer
+	file.WriteString("PAR1")
+
+	var chunks thriftCompact
+	var rowGroupSize int64
+	for i, column := range t.columns {
+		var values bytes.Buffer
+		var bits byte
+		for n, row := range t.rows {
+			switch v := row[i].(type) {
+			case time.Time:
+				binary.Write(&values, binary.LittleEndian, v.UnixNano()/int64(time.Millisecond))
+			case string:
+				binary.Write(&values, binary.LittleEndian, uint32(len(v)))
+				values.WriteString(v)
+			case int64:
+				binary.Write(&values, binary.LittleEndian, v)
+			case float64:
+				binary.Write(&values, binary.LittleEndian, math.Float64bits(v))
+			case bool:
+				// Booleans are bit packed, least significant bit first.
+				if v {
+					bits |= 1 << uint(n%8)
+				}
+				if n%8 == 7 || n == len(t.rows)-1 {
+					values.WriteByte(bits)
+					bits = 0
+				}
+			}
+		}
+
+		var header thriftCompact
+		header.i32(1, parquetDataPage)
+		header.i32(2, int32(values.Len()))
+		header.i32(3, int32(values.Len()))
+		header.structBegin(5)
+		header.i32(1, int32(len(t.rows)))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE)
+		header.i32(4, parquetRLE)
+		header.structEnd()
+		header.stop()
+
+		offset := int64(file.Len())
+		size := int64(header.Len() + values.Len())
+		rowGroupSize += size
+		file.Write(header.Bytes())
+		file.Write(values.Bytes())
+
+		// ColumnChunk
+		chunks.i64(2, offset)
+		chunks.structBegin(3)
+		chunks.i32(1, parquetType(column.kind))
+		chunks.listBegin(2, 2, thriftI32)
+		chunks.zigzag(parquetPlain)
+		chunks.zigzag(parquetRLE)
+		chunks.listEnd()
+		chunks.listBegin(3, 1, thriftBinary)
+		chunks.binary(column.name)
+		chunks.listEnd()
+		chunks.i32(4, parquetUncompressed)
+		chunks.i64(5, int64(len(t.rows)))
+		chunks.i64(6, size)
+		chunks.i64(7, size)
+		chunks.i64(9, offset)
+		chunks.structEnd()
+		chunks.elemEnd()
+	}
+
+	// FileMetaData
+	var meta thriftCompact
+	meta.i32(1, 1)
+	meta.listBegin(2, len(t.columns)+1, thriftStruct)
+	meta.string(4, "schema")
+	meta.i32(5, int32(len(t.columns)))
+	meta.elemEnd()
+	for _, column := range t.columns {
+		meta.i32(1, parquetType(column.kind))
+		meta.i32(3, parquetRequired)
+		meta.string(4, column.name)
+		switch column.kind {
+		case reflect.String:
+			meta.i32(6, parquetUTF8)
+		case reflect.Struct:
+			meta.i32(6, parquetTimestampMillis)
+		}
+		meta.elemEnd()
+	}
+	meta.listEnd()
+	meta.i64(3, int64(len(t.rows)))
+	meta.listBegin(4, 1, thriftStruct)
+	// RowGroup
+	meta.listBegin(1, len(t.columns), thriftStruct)
+	meta.Write(chunks.Bytes())
+	meta.listEnd()
+	meta.i64(2, rowGroupSize)
+	meta.i64(3, int64(len(t.rows)))
+	meta.elemEnd()
+	meta.listEnd()
+	meta.string(6, "spaceengineers-metrics")
+	meta.stop()
+
+	file.Write(meta.Bytes())
+	binary.Write(&file, binary.LittleEndian, uint32(meta.Len()))
+	file.WriteString("PAR1")
+	_, err := w.Write(file.Bytes())
+	return err
+}
+
+func parquetType(kind reflect.Kind) int32 {
+	switch kind {
+	case reflect.String:
+		return parquetByteArray
+	case reflect.Float64:
+		return parquetDouble
+	case reflect.Bool:
+		return parquetBoolean
+	default:
+		return parquetInt64
+	}
+}
+
+// Thrift compact protocol types.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftCompact writes the Thrift compact protocol, just enough of it for
+// the Parquet metadata above. Fields of a struct have to be written in
+// ascending order.
+type thriftCompact struct {
+	bytes.Buffer
+	last  int
+	stack []int
+}
+
+func (t *thriftCompact) fieldHeader(id int, typ byte) {
+	if delta := id - t.last; delta > 0 && delta <= 15 {
+		t.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.WriteByte(typ)
+		t.zigzag(int64(id))
+	}
+	t.last = id
+}
+
+func (t *thriftCompact) uvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	t.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func (t *thriftCompact) zigzag(v int64) {
+	t.uvarint(uint64(v<<1) ^ uint64(v>>63))
+}
+
+func (t *thriftCompact) i32(id int, v int32) {
+	t.fieldHeader(id, thriftI32)
+	t.zigzag(int64(v))
+}
+
+func (t *thriftCompact) i64(id int, v int64) {
+	t.fieldHeader(id, thriftI64)
+	t.zigzag(v)
+}
+
+func (t *thriftCompact) binary(s string) {
+	t.uvarint(uint64(len(s)))
+	t.WriteString(s)
+}
+
+func (t *thriftCompact) string(id int, s string) {
+	t.fieldHeader(id, thriftBinary)
+	t.binary(s)
+}
+
+// listBegin starts a list field of size elements. Struct elements are
+// written as their fields followed by elemEnd.
+func (t *thriftCompact) listBegin(id, size int, typ byte) {
+	t.fieldHeader(id, thriftList)
+	if size < 15 {
+		t.WriteByte(byte(size)<<4 | typ)
+	} else {
+		t.WriteByte(0xf0 | typ)
+		t.uvarint(uint64(size))
+	}
+	t.stack = append(t.stack, t.last)
+	t.last = 0
+}
+
+func (t *thriftCompact) elemEnd() {
+	t.WriteByte(0)
+	t.last = 0
+}
+
+func (t *thriftCompact) listEnd() {
+	t.last = t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+}
+
+func (t *thriftCompact) structBegin(id int) {
+	t.fieldHeader(id, thriftStruct)
+	t.stack = append(t.stack, t.last)
+	t.last = 0
+}
+
+func (t *thriftCompact) structEnd() {
+	t.WriteByte(0)
+	t.last = t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+}
+
+// stop ends the top level struct.
+func (t *thriftCompact) stop() {
+	t.WriteByte(0)
+}
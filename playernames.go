@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/pkg/errors"
+)
+
+// PlayerNames is a processor that resolves Steam IDs to display names. It
+// learns names from every point that carries both, grid owners in the first
+// place, and adds a "player_name" tag to points that only carry a steam_id,
+// such as player events. Torch reports joins and leaves by Steam ID alone.
+//
+// A player changing their name emits a "player_names" point and keeps the
+// previous names in the history. The names are saved to Path, if set, at
+// most once a minute, so they are known right after a restart.
+type PlayerNames struct {
+	Path  string
+	Clock Clock
+
+	mu    sync.Mutex
+	names map[string]*PlayerName
+	dirty bool
+	saved time.Time
+}
+
+// PlayerName is the current and previous names of a player.
+type PlayerName struct {
+	Name     string               `json:"name"`
+	Seen     time.Time            `json:"seen"`
+	Previous []PreviousPlayerName `json:"previous,omitempty"`
+}
+
+// PreviousPlayerName is a name a player used until Changed.
+type PreviousPlayerName struct {
+	Name    string    `json:"name"`
+	Changed time.Time `json:"changed"`
+}
+
+// NewPlayerNames loads the names saved at path, if any.
+func NewPlayerNames(path string, clock Clock) (*PlayerNames, error) {
+	n := &PlayerNames{
+		Path:  path,
+		Clock: clock,
+		names: make(map[string]*PlayerName),
+	}
+	if path == "" {
+		return n, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return n, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &n.names); err != nil {
+		return nil, errors.Wrapf(err, "player names %s", path)
+	}
+	return n, nil
+}
+
+func (n *PlayerNames) Name() string {
+	return "playernames"
+}
+
+// Lookup returns the current name of the player with the given Steam ID.
+func (n *PlayerNames) Lookup(id string) (PlayerName, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	name, ok := n.names[id]
+	if !ok {
+		return PlayerName{}, false
+	}
+	current := *name
+	current.Previous = append([]PreviousPlayerName(nil), name.Previous...)
+	return current, true
+}
+
+// learn records that the player with the given Steam ID was called name at
+// the given time. It returns the previous name if the name changed.
+func (n *PlayerNames) learn(id, name string, at time.Time) (string, bool) {
+	known, ok := n.names[id]
+	if !ok {
+		n.names[id] = &PlayerName{Name: name, Seen: at}
+		n.dirty = true
+		return "", false
+	}
+	if at.After(known.Seen) {
+		known.Seen = at
+		n.dirty = true
+	}
+	if known.Name == name {
+		return "", false
+	}
+	previous := known.Name
+	known.Previous = append(known.Previous, PreviousPlayerName{Name: previous, Changed: at})
+	known.Name = name
+	n.dirty = true
+	return previous, true
+}
+
+func (n *PlayerNames) Process(points []*client.Point) ([]*client.Point, error) {
+	now := n.Clock.Now()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	processed := make([]*client.Point, len(points))
+	copy(processed, points)
+	var renamed []*client.Point
+	for i, pt := range points {
+		tags := pt.Tags()
+		if id, name := tags["owner_steam_id"], tags["owner_display_name"]; id != "" && id != "0" && name != "" {
+			if previous, changed := n.learn(id, name, now); changed {
+				log.Printf("player %s renamed from %q to %q", id, previous, name)
+				pt, err := client.NewPoint(
+					"player_names",
+					map[string]string{
+						"host":        tags["host"],
+						"steam_id":    id,
+						"player_name": name,
+					},
+					map[string]interface{}{
+						"previous_name": previous,
+						"text":          previous + " is now known as " + name,
+					},
+					now,
+				)
+				if err != nil {
+					return nil, err
+				}
+				renamed = append(renamed, pt)
+			}
+		}
+
+		id := tags["steam_id"]
+		if id == "" || tags["player_name"] != "" {
+			continue
+		}
+		known, ok := n.names[id]
+		if !ok {
+			continue
+		}
+		fields, err := pt.Fields()
+		if err != nil {
+			return nil, err
+		}
+		tags["player_name"] = known.Name
+		enriched, err := client.NewPoint(pt.Name(), tags, fields, pt.Time())
+		if err != nil {
+			return nil, err
+		}
+		processed[i] = enriched
+	}
+
+	if n.Path != "" && n.dirty && now.Sub(n.saved) >= time.Minute {
+		// The names stay in memory and are saved with the next batch.
+		if err := n.save(); err != nil {
+			log.Printf("save player names: %v", err)
+		} else {
+			n.dirty = false
+			n.saved = now
+		}
+	}
+	return append(processed, renamed...), nil
+}
+
+// save writes the names atomically, so a crash never leaves a truncated
+// file behind.
+func (n *PlayerNames) save() error {
+	b, err := json.Marshal(n.names)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(n.Path, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+	return errors.Wrap(err, "player names")
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlayerNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "playernames")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "names.json")
+
+	h, f, clock := newFakeTorchHarness(t)
+	names, err := NewPlayerNames(path, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.exporter.Processors = []Processor{names}
+
+	// Unknown players stay unnamed until they own a grid.
+	f.Join(1)
+	if got := h.collect("players"); strings.Contains(got, "player_name") {
+		t.Errorf("unknown player got a name:\n%s", got)
+	}
+	f.SpawnGrid(TorchMetricsSessionGrid{EntityId: 1, OwnerSteamID: 1, OwnerDisplayName: "Alice"})
+	f.SpawnGrid(TorchMetricsSessionGrid{EntityId: 2, DisplayName: "Derelict"})
+	if got := h.collect("grids"); strings.Contains(got, "player_names") {
+		t.Errorf("first sight reported as a rename:\n%s", got)
+	}
+	f.Leave(1)
+	want := "players,host=http://torch:8080,player_name=Alice,steam_id=1,type=Left value=1i\n"
+	if got := h.collect("players"); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	clock.Advance(time.Hour)
+	f.SpawnGrid(TorchMetricsSessionGrid{EntityId: 1, OwnerSteamID: 1, OwnerDisplayName: "Alicia"})
+	got := h.collect("grids")
+	want = "player_names,host=http://torch:8080,player_name=Alicia,steam_id=1 previous_name=\"Alice\",text=\"Alice is now known as Alicia\" 1541336400000000000\n"
+	if !strings.HasSuffix(got, want) {
+		t.Errorf("got\n%s\nwant suffix\n%s", got, want)
+	}
+
+	// The cache and its history survive a restart.
+	saved, err := NewPlayerNames(path, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, ok := saved.Lookup("1")
+	if !ok || name.Name != "Alicia" || len(name.Previous) != 1 || name.Previous[0].Name != "Alice" || !name.Previous[0].Changed.Equal(testEpoch.Add(time.Hour)) {
+		t.Errorf("unexpected saved name %+v", name)
+	}
+}
+
+func TestPlayerNamesSaveError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "playernames")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := NewPlayerNames(filepath.Join(dir, "names.json"), NewFakeClock(testEpoch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(dir)
+	points, err := gridPoints(testHost, []TorchMetricsSessionGrid{{EntityId: 1, OwnerSteamID: 1, OwnerDisplayName: "Alice"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A name cache that cannot be saved still names the points.
+	processed, err := names.Process(points)
+	if err != nil || len(processed) != len(points) {
+		t.Fatalf("got %d points and %v, want %d points", len(processed), err, len(points))
+	}
+	if name, ok := names.Lookup("1"); !ok || name.Name != "Alice" {
+		t.Errorf("unexpected name %+v", name)
+	}
+}
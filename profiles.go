@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/pkg/errors"
+)
+
+// profileActive is how recently a player must have been seen to count as
+// active in the aggregate metrics.
+const profileActive = 24 * time.Hour
+
+// Profiles is a sink that assembles a profile of every player from their
+// joins and leaves and the grids they own: when they were last seen, how
+// long they played, their PCU, grids and faction. Players are known by
+// Steam ID, either from player events or as grid owners.
+//
+// The profiles are saved to Path, if set, at most once a minute, so the
+// playtime adds up across restarts of the exporter. Sessions in progress
+// are saved up to then; the players are offline after a restart until they
+// join again.
+type Profiles struct {
+	Path  string
+	Clock Clock
+
+	mu      sync.Mutex
+	players map[string]*PlayerProfile
+	joined  map[string]time.Time
+	saved   time.Time
+}
+
+// PlayerProfile is the footprint of a player on the server.
+type PlayerProfile struct {
+	SteamID       string    `json:"steam_id"`
+	Name          string    `json:"name"`
+	PreviousNames []string  `json:"previous_names,omitempty"`
+	Online        bool      `json:"online"`
+	FirstSeen     time.Time `json:"first_seen"`
+	LastSeen      time.Time `json:"last_seen"`
+	Sessions      int       `json:"sessions"`
+	Playtime      float64   `json:"playtime_seconds"`
+	Grids         int       `json:"grids"`
+	Blocks        int64     `json:"blocks"`
+	PCU           int64     `json:"pcu"`
+	FactionTag    string    `json:"faction_tag"`
+	FactionName   string    `json:"faction_name"`
+}
+
+// NewProfiles loads the profiles saved at path, if any.
+func NewProfiles(path string, clock Clock) (*Profiles, error) {
+	p := &Profiles{
+		Path:    path,
+		Clock:   clock,
+		players: make(map[string]*PlayerProfile),
+		joined:  make(map[string]time.Time),
+	}
+	if path == "" {
+		return p, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved []*PlayerProfile
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return nil, errors.Wrapf(err, "profiles %s", path)
+	}
+	for _, profile := range saved {
+		profile.Online = false
+		p.players[profile.SteamID] = profile
+	}
+	return p, nil
+}
+
+func (p *Profiles) Name() string {
+	return "profiles"
+}
+
+func (p *Profiles) profile(id string, now time.Time) *PlayerProfile {
+	profile, ok := p.players[id]
+	if !ok {
+		profile = &PlayerProfile{SteamID: id, FirstSeen: now}
+		p.players[id] = profile
+	}
+	return profile
+}
+
+func (p *Profiles) Write(points []*client.Point) error {
+	now := p.Clock.Now()
+	var owners map[string]*PlayerProfile
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, pt := range points {
+		tags := pt.Tags()
+		switch pt.Name() {
+		case "players":
+			ts := pt.Time()
+			if ts.IsZero() {
+				ts = now
+			}
+			id := tags["steam_id"]
+			profile := p.profile(id, ts)
+			if ts.After(profile.LastSeen) {
+				profile.LastSeen = ts
+			}
+			if name := tags["player_name"]; name != "" {
+				profile.Name = name
+			}
+			switch tags["type"] {
+			case PlayerJoined:
+				if !profile.Online {
+					profile.Sessions++
+				}
+				profile.Online = true
+				p.joined[id] = ts
+			case PlayerLeft:
+				if joined, ok := p.joined[id]; ok && ts.After(joined) {
+					profile.Playtime += ts.Sub(joined).Seconds()
+				}
+				profile.Online = false
+				delete(p.joined, id)
+			}
+		case "player_names":
+			fields, err := pt.Fields()
+			if err != nil {
+				return err
+			}
+			profile := p.profile(tags["steam_id"], now)
+			profile.Name = tags["player_name"]
+			if previous, ok := fields["previous_name"].(string); ok {
+				profile.PreviousNames = append(profile.PreviousNames, previous)
+			}
+		case "grid":
+			id := tags["owner_steam_id"]
+			if id == "" || id == "0" {
+				continue
+			}
+			if owners == nil {
+				owners = make(map[string]*PlayerProfile)
+			}
+			owner, ok := owners[id]
+			if !ok {
+				// Grid totals are counted from scratch for every snapshot.
+				owner = &PlayerProfile{
+					Name:        tags["owner_display_name"],
+					FactionTag:  tags["owner_faction_tag"],
+					FactionName: tags["owner_faction_name"],
+				}
+				owners[id] = owner
+			}
+			fields, err := pt.Fields()
+			if err != nil {
+				return err
+			}
+			blocks, _ := fieldValue(fields["blocks_count"])
+			pcu, _ := fieldValue(fields["pcu"])
+			owner.Grids++
+			owner.Blocks += int64(blocks)
+			owner.PCU += int64(pcu)
+		}
+	}
+	if owners != nil {
+		// Every run of the grids collector reports all of them.
+		for id, profile := range p.players {
+			if owners[id] == nil {
+				profile.Grids, profile.Blocks, profile.PCU = 0, 0, 0
+			}
+		}
+		for id, owner := range owners {
+			profile := p.profile(id, now)
+			profile.Name = owner.Name
+			profile.FactionTag = owner.FactionTag
+			profile.FactionName = owner.FactionName
+			profile.Grids = owner.Grids
+			profile.Blocks = owner.Blocks
+			profile.PCU = owner.PCU
+		}
+	}
+
+	if p.Path != "" && now.Sub(p.saved) >= time.Minute {
+		if err := p.save(now); err != nil {
+			return err
+		}
+		p.saved = now
+	}
+	return nil
+}
+
+// save writes the profiles as of now atomically, so a crash never leaves a
+// partial file behind.
+func (p *Profiles) save(now time.Time) error {
+	b, err := json.Marshal(p.list(now))
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(p.Path, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+	return errors.Wrap(err, "profiles")
+}
+
+// List returns all profiles, the most recently seen first. The playtime of
+// online players includes their current session.
+func (p *Profiles) List() []PlayerProfile {
+	now := p.Clock.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.list(now)
+}
+
+func (p *Profiles) list(now time.Time) []PlayerProfile {
+	list := make([]PlayerProfile, 0, len(p.players))
+	for id, profile := range p.players {
+		current := *profile
+		current.PreviousNames = append([]string(nil), profile.PreviousNames...)
+		if joined, ok := p.joined[id]; ok && now.After(joined) {
+			current.Playtime += now.Sub(joined).Seconds()
+			current.LastSeen = now
+		}
+		list = append(list, current)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].LastSeen.Equal(list[j].LastSeen) {
+			return list[i].LastSeen.After(list[j].LastSeen)
+		}
+		return list[i].SteamID < list[j].SteamID
+	})
+	return list
+}
+
+// Register serves the profiles as JSON at /api/v1/players, a single one at
+// /api/v1/players/<steam id>.
+func (p *Profiles) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/players", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"players": p.List()})
+	})
+	mux.HandleFunc("/api/v1/players/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/api/v1/players/")
+		for _, profile := range p.List() {
+			if profile.SteamID == id {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(profile)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+}
+
+// Collector emits a "player_profiles" point aggregating all profiles.
+func (p *Profiles) Collector(host string) *Collector {
+	return &Collector{
+		Name: "profiles",
+		Collect: func() ([]*client.Point, error) {
+			now := p.Clock.Now()
+			var online, active, withGrids int
+			var playtime, maxPlaytime float64
+			var pcu, maxPCU int64
+			list := p.List()
+			for _, profile := range list {
+				if profile.Online {
+					online++
+				}
+				if now.Sub(profile.LastSeen) <= profileActive {
+					active++
+				}
+				if profile.Grids > 0 {
+					withGrids++
+				}
+				playtime += profile.Playtime
+				if profile.Playtime > maxPlaytime {
+					maxPlaytime = profile.Playtime
+				}
+				pcu += profile.PCU
+				if profile.PCU > maxPCU {
+					maxPCU = profile.PCU
+				}
+			}
+			fields := map[string]interface{}{
+				"known":      len(list),
+				"online":     online,
+				"active_24h": active,
+				"with_grids": withGrids,
+				"playtime":   playtime,
+				"pcu":        pcu,
+				"max_pcu":    maxPCU,
+			}
+			if len(list) > 0 {
+				fields["avg_playtime"] = playtime / float64(len(list))
+				fields["max_playtime"] = maxPlaytime
+			}
+			if withGrids > 0 {
+				fields["avg_pcu"] = float64(pcu) / float64(withGrids)
+			}
+			pt, err := client.NewPoint("player_profiles", map[string]string{"host": host}, fields, now)
+			if err != nil {
+				return nil, err
+			}
+			return []*client.Point{pt}, nil
+		},
+	}
+}
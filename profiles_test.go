@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProfiles(t *testing.T) {
+	h, f, clock := newFakeTorchHarness(t)
+	p, err := NewProfiles("", clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.exporter.Sinks = append(h.exporter.Sinks, p)
+	h.collectors["profiles"] = p.Collector(testHost)
+
+	f.SpawnGrid(TorchMetricsSessionGrid{EntityId: 1, OwnerSteamID: 1, OwnerDisplayName: "Alice", OwnerFactionTag: "R\\ED", OwnerFactionName: "Red Dawn", BlocksCount: 800, PCU: 9000})
+	f.SpawnGrid(TorchMetricsSessionGrid{EntityId: 2, OwnerSteamID: 2, OwnerDisplayName: "Bob", PCU: 300})
+	f.SpawnGrid(TorchMetricsSessionGrid{EntityId: 3, OwnerSteamID: 3, OwnerDisplayName: "Carol", PCU: 100})
+	f.Join(1)
+	f.Join(2)
+	h.exporter.Tick()
+
+	clock.Advance(30 * time.Minute)
+	f.Leave(2)
+	f.RemoveGrid(2)
+	h.exporter.Tick()
+	clock.Advance(30 * time.Minute)
+	h.exporter.Tick()
+
+	mux := http.NewServeMux()
+	p.Register(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/players", nil))
+	var body struct {
+		Players []PlayerProfile
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Players) != 3 {
+		t.Fatalf("got %d profiles, want 3: %+v", len(body.Players), body.Players)
+	}
+	alice, bob, carol := body.Players[0], body.Players[1], body.Players[2]
+	if alice.Name != "Alice" || !alice.Online || alice.Sessions != 1 || alice.Playtime != 3600 || alice.Grids != 1 || alice.PCU != 9000 || alice.FactionTag != "RED" || !alice.LastSeen.Equal(testEpoch.Add(time.Hour)) {
+		t.Errorf("unexpected profile %+v", alice)
+	}
+	if bob.Name != "Bob" || bob.Online || bob.Playtime != 1800 || bob.Grids != 0 || bob.PCU != 0 || !bob.LastSeen.Equal(testEpoch.Add(30*time.Minute)) {
+		t.Errorf("unexpected profile %+v", bob)
+	}
+	if carol.Name != "Carol" || carol.Sessions != 0 || carol.Grids != 1 || !carol.LastSeen.IsZero() {
+		t.Errorf("unexpected profile %+v", carol)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/players/2", nil))
+	var profile PlayerProfile
+	if err := json.Unmarshal(w.Body.Bytes(), &profile); err != nil || profile.Name != "Bob" {
+		t.Errorf("unexpected profile %s: %v", w.Body, err)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/players/4", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got status %d for an unknown player", w.Code)
+	}
+
+	want := "player_profiles,host=http://torch:8080 active_24h=2i,avg_pcu=4550,avg_playtime=1800,known=3i,max_pcu=9000i,max_playtime=3600,online=1i,pcu=9100i,playtime=5400,with_grids=2i 1541336400000000000\n"
+	if got := h.collect("profiles"); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestProfilesState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "profiles.json")
+
+	h, f, clock := newFakeTorchHarness(t)
+	p, err := NewProfiles(path, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.exporter.Sinks = append(h.exporter.Sinks, p)
+
+	f.SpawnGrid(TorchMetricsSessionGrid{EntityId: 1, OwnerSteamID: 1, OwnerDisplayName: "Alice", PCU: 9000})
+	f.Join(1)
+	h.exporter.Tick()
+	clock.Advance(30 * time.Minute)
+	h.exporter.Tick()
+	// Not saved again within a minute.
+	clock.Advance(30 * time.Second)
+	h.exporter.Tick()
+
+	// The session in progress counts up to the last save, the player is
+	// offline until they join again.
+	restarted, err := NewProfiles(path, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := restarted.List()
+	if len(list) != 1 {
+		t.Fatalf("got %d profiles, want 1: %+v", len(list), list)
+	}
+	alice := list[0]
+	if alice.Name != "Alice" || alice.Online || alice.Sessions != 1 || alice.Playtime != 1800 || alice.PCU != 9000 || !alice.LastSeen.Equal(testEpoch.Add(30*time.Minute)) {
+		t.Errorf("unexpected restored profile %+v", alice)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewProfiles(path, clock); err == nil {
+		t.Error("expected an error for a corrupt state file")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Save is a single world save detected from the server metrics.
+type Save struct {
+	Duration time.Duration
+	Time     time.Time
+}
+
+// SaveMonitor detects world saves from consecutive SaveDuration readings of
+// /metrics/v1/server and keeps the durations seen within a rolling window.
+//
+// Torch only reports the duration of the last save, so a save is recognized
+// by that value changing between two scrapes.
+type SaveMonitor struct {
+	Window    time.Duration
+	Threshold time.Duration
+
+	last  int64
+	seen  bool
+	saves []Save
+}
+
+func NewSaveMonitor(window, threshold time.Duration) *SaveMonitor {
+	return &SaveMonitor{
+		Window:    window,
+		Threshold: threshold,
+	}
+}
+
+// Observe records a SaveDuration reading (milliseconds) and returns the save
+// it represents, or nil if no new save happened since the last reading.
+func (s *SaveMonitor) Observe(saveDuration int64, now time.Time) *Save {
+	s.expire(now)
+
+	previous, seen := s.last, s.seen
+	s.last, s.seen = saveDuration, true
+	if !seen || saveDuration == previous || saveDuration <= 0 {
+		return nil
+	}
+
+	save := Save{
+		Duration: time.Duration(saveDuration) * time.Millisecond,
+		Time:     now,
+	}
+	s.saves = append(s.saves, save)
+	return &save
+}
+
+func (s *SaveMonitor) expire(now time.Time) {
+	if s.Window <= 0 {
+		return
+	}
+	cutoff := now.Add(-s.Window)
+	i := 0
+	for i < len(s.saves) && s.saves[i].Time.Before(cutoff) {
+		i++
+	}
+	s.saves = s.saves[i:]
+}
+
+// Count returns the number of saves within the window.
+func (s *SaveMonitor) Count() int {
+	return len(s.saves)
+}
+
+// Percentile returns the p-th percentile (0-100) of the save durations within
+// the window using the nearest-rank method.
+func (s *SaveMonitor) Percentile(p float64) time.Duration {
+	if len(s.saves) == 0 {
+		return 0
+	}
+	durations := make([]time.Duration, len(s.saves))
+	for i, save := range s.saves {
+		durations[i] = save.Duration
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+	// The nearest rank is the smallest one covering p percent of the saves.
+	rank := int(math.Ceil(p/100*float64(len(durations)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(durations) {
+		rank = len(durations) - 1
+	}
+	return durations[rank]
+}
+
+// Alert returns an alert if the save took longer than the threshold.
+func (s *SaveMonitor) Alert(save *Save) *Alert {
+	if s.Threshold <= 0 || save.Duration <= s.Threshold {
+		return nil
+	}
+	return &Alert{
+		Rule:      "save_duration",
+		Message:   fmt.Sprintf("world save took %s", save.Duration),
+		Value:     save.Duration.Seconds(),
+		Threshold: s.Threshold.Seconds(),
+		Time:      save.Time,
+	}
+}
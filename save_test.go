@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSaveMonitor(t *testing.T) {
+	s := NewSaveMonitor(time.Hour, 5*time.Second)
+	now := testEpoch
+
+	if save := s.Observe(3000, now); save != nil {
+		t.Errorf("first reading reported save %v", save)
+	}
+	for i, ms := range []int64{3000, 2000, 2000, 9000, 4000} {
+		now = now.Add(10 * time.Minute)
+		save := s.Observe(ms, now)
+		changed := i == 1 || i == 3 || i == 4
+		if (save != nil) != changed {
+			t.Fatalf("reading %d (%dms): save %v, want %v", i, ms, save, changed)
+		}
+	}
+	if s.Count() != 3 {
+		t.Errorf("count %d, want 3", s.Count())
+	}
+	if p := s.Percentile(50); p != 4*time.Second {
+		t.Errorf("p50 %s, want 4s", p)
+	}
+	if p := s.Percentile(95); p != 9*time.Second {
+		t.Errorf("p95 %s, want 9s", p)
+	}
+	if alert := s.Alert(&Save{Duration: 9 * time.Second}); alert == nil {
+		t.Error("no alert for a 9s save")
+	}
+	if alert := s.Alert(&Save{Duration: 4 * time.Second}); alert != nil {
+		t.Errorf("unexpected alert %v", alert)
+	}
+
+	s.Observe(4000, now.Add(55*time.Minute))
+	if s.Count() != 1 {
+		t.Errorf("count %d after the window moved on, want 1", s.Count())
+	}
+}
+
+func TestSaveMonitorPercentile(t *testing.T) {
+	s := NewSaveMonitor(time.Hour, 0)
+	if p := s.Percentile(50); p != 0 {
+		t.Errorf("p50 of no saves %s, want 0", p)
+	}
+
+	// Saves of 1s to 10s, every one a change from the reading before.
+	now := testEpoch
+	s.Observe(500, now)
+	for ms := int64(1000); ms <= 10000; ms += 1000 {
+		now = now.Add(time.Minute)
+		s.Observe(ms, now)
+	}
+	for _, tt := range []struct {
+		p    float64
+		want time.Duration
+	}{
+		{0, time.Second},
+		{10, time.Second},
+		{14, 2 * time.Second},
+		{50, 5 * time.Second},
+		{51, 6 * time.Second},
+		{90, 9 * time.Second},
+		{95, 10 * time.Second},
+		{100, 10 * time.Second},
+		{150, 10 * time.Second},
+	} {
+		if got := s.Percentile(tt.p); got != tt.want {
+			t.Errorf("p%v %s, want %s", tt.p, got, tt.want)
+		}
+	}
+}
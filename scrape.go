@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// scrapeResult holds the decoded response of every Torch endpoint.
+type scrapeResult struct {
+	Server          *TorchMetricServer                    `json:"server,omitempty"`
+	Load            []TorchMetricsLoad                    `json:"load,omitempty"`
+	Process         *TorchMetricsProcess                  `json:"process,omitempty"`
+	Events          []TorchMetricsEvent                   `json:"events,omitempty"`
+	Players         []TorchPlayerEvent                    `json:"players,omitempty"`
+	Grids           []TorchMetricsSessionGrid             `json:"grids,omitempty"`
+	Asteroids       []TorchMetricsSessionAsteroidOrPlanet `json:"asteroids,omitempty"`
+	Planets         []TorchMetricsSessionAsteroidOrPlanet `json:"planets,omitempty"`
+	Factions        []TorchMetricsSessionFaction          `json:"factions,omitempty"`
+	FloatingObjects []TorchMetricsSessionFloatingObject   `json:"floating_objects,omitempty"`
+	Errors          map[string]string                     `json:"errors,omitempty"`
+}
+
+// scrapeCommand queries every Torch endpoint once and prints the result
+// instead of writing it to a sink. It returns the exit code.
+func scrapeCommand(t *TorchMetrics, host string, args []string) int {
+	fs := flag.NewFlagSet("scrape", flag.ExitOnError)
+	format := fs.String("format", "json", "output format: json or line (influx line protocol)")
+	fs.Parse(args)
+
+	var err error
+	switch *format {
+	case "json":
+		err = scrapeJSON(os.Stdout, t)
+	case "line":
+		err = scrapeLine(os.Stdout, t, host)
+	default:
+		err = fmt.Errorf("unknown format %q", *format)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func scrapeJSON(w io.Writer, t *TorchMetrics) error {
+	result := scrapeResult{Errors: make(map[string]string)}
+	record := func(name string, err error) {
+		if err != nil {
+			result.Errors[name] = err.Error()
+		}
+	}
+
+	var err error
+	result.Server, err = t.Server()
+	record("server", err)
+	result.Load, err = t.Load()
+	record("load", err)
+	result.Process, err = t.Process()
+	record("process", err)
+	result.Events, err = t.Events()
+	record("events", err)
+	result.Players, err = t.PlayerEvents()
+	record("players", err)
+	result.Grids, err = t.SessionGrids()
+	record("grids", err)
+	result.Asteroids, err = t.SessionAsteroids()
+	record("asteroids", err)
+	result.Planets, err = t.SessionPlanets()
+	record("planets", err)
+	result.Factions, err = t.SessionFactions()
+	record("factions", err)
+	result.FloatingObjects, err = t.SessionFloatingObjects()
+	record("floating_objects", err)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(result); err != nil {
+		return err
+	}
+	if len(result.Errors) > 0 {
+		return fmt.Errorf("%d endpoints failed", len(result.Errors))
+	}
+	return nil
+}
+
+func scrapeLine(w io.Writer, t *TorchMetrics, host string) error {
+	failed := 0
+	for _, c := range NewCollectors(t, host, NewSaveMonitor(24*time.Hour, 0), RealClock) {
+		points, err := c.Collect()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "collector %s: %v\n", c.Name, err)
+			failed++
+			continue
+		}
+		for _, pt := range points {
+			fmt.Fprintln(w, pt.String())
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d collectors failed", failed)
+	}
+	return nil
+}
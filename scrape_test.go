@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestScrapeJSON(t *testing.T) {
+	h, f, _ := newFakeTorchHarness(t)
+	torch := h.torch
+	f.SpawnGrid(TorchMetricsSessionGrid{EntityId: 1, DisplayName: "Base", OwnerSteamID: 1, OwnerDisplayName: "Alice"})
+	f.Join(1)
+
+	var out bytes.Buffer
+	if err := scrapeJSON(&out, torch); err != nil {
+		t.Fatal(err)
+	}
+	var result scrapeResult
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Server == nil || result.Server.ServerName != "Fake Server" || result.Process == nil {
+		t.Errorf("unexpected server %+v and process %+v", result.Server, result.Process)
+	}
+	if len(result.Grids) != 1 || result.Grids[0].DisplayName != "Base" || len(result.Players) != 1 || result.Players[0].Type != PlayerJoined {
+		t.Errorf("unexpected grids %+v and players %+v", result.Grids, result.Players)
+	}
+	if len(result.Errors) != 0 {
+		t.Errorf("unexpected errors %v", result.Errors)
+	}
+
+	// A Torch that is gone fails every endpoint, the output still lists
+	// them.
+	h.server.Close()
+	out.Reset()
+	if err := scrapeJSON(&out, torch); err == nil || err.Error() != "10 endpoints failed" {
+		t.Errorf("got %v, want 10 endpoints failed", err)
+	}
+	result = scrapeResult{}
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Errors) != 10 || result.Errors["grids"] == "" {
+		t.Errorf("unexpected errors %v", result.Errors)
+	}
+}
+
+func TestScrapeLine(t *testing.T) {
+	h, f, _ := newFakeTorchHarness(t)
+	torch := h.torch
+	f.SpawnGrid(TorchMetricsSessionGrid{EntityId: 1, DisplayName: "Base", OwnerSteamID: 1, OwnerDisplayName: "Alice"})
+	f.SpawnGrid(TorchMetricsSessionGrid{EntityId: 2, DisplayName: "Rover", OwnerSteamID: 1, OwnerDisplayName: "Alice"})
+
+	var out bytes.Buffer
+	if err := scrapeLine(&out, torch, testHost); err != nil {
+		t.Fatal(err)
+	}
+	measurements := make(map[string]int)
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		measurement := strings.SplitN(line, ",", 2)[0]
+		measurements[measurement]++
+		if !strings.Contains(line, "host="+testHost) {
+			t.Errorf("line without host: %s", line)
+		}
+	}
+	for measurement, want := range map[string]int{"server": 1, "process": 1, "grid": 2} {
+		if got := measurements[measurement]; got != want {
+			t.Errorf("got %d %s lines, want %d in:\n%s", got, measurement, want, out.String())
+		}
+	}
+	if !strings.Contains(out.String(), "grid,display_name=Rover,") {
+		t.Errorf("missing the Rover grid in:\n%s", out.String())
+	}
+
+	h.server.Close()
+	// The failing collectors are reported on stderr.
+	if err := scrapeLine(ioutil.Discard, torch, testHost); err == nil || err.Error() != "10 collectors failed" {
+		t.Errorf("got %v, want 10 collectors failed", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// Sink receives the points of every collector run.
+type Sink interface {
+	Name() string
+	Write(points []*client.Point) error
+}
+
+// DroppingSink is a sink that drops samples beyond its limits instead of
+// failing the write. Dropped returns their total count.
+type DroppingSink interface {
+	Sink
+	Dropped() int64
+}
+
+// InfluxSink writes points to an InfluxDB database.
+type InfluxSink struct {
+	client   client.Client
+	database string
+}
+
+func NewInfluxSink(c client.Client, database string) *InfluxSink {
+	return &InfluxSink{
+		client:   c,
+		database: database,
+	}
+}
+
+func (s *InfluxSink) Name() string {
+	return "influxdb"
+}
+
+func (s *InfluxSink) Write(points []*client.Point) error {
+	// Create a new point batch
+	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
+		Database:  s.database,
+		Precision: "s",
+	})
+	if err != nil {
+		return err
+	}
+	bp.AddPoints(points)
+
+	// Write the batch
+	return s.client.Write(bp)
+}
+
+// occurrences are measurements whose points each record something that
+// happened rather than a reading.
+var occurrences = map[string]bool{
+	"players":      true,
+	"events":       true,
+	"save":         true,
+	"alert":        true,
+	"lag":          true,
+	"player_names": true,
+}
+
+// fieldValue converts a numeric or boolean field value to a float.
+func fieldValue(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, !math.IsNaN(v) && !math.IsInf(v, 0)
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
-	"fmt"
 	"log"
 	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"flag"
@@ -12,16 +15,71 @@ import (
 	"context"
 
 	"github.com/influxdata/influxdb/client/v2"
-	"golang.org/x/sync/errgroup"
 )
 
 var (
 	host = flag.String("host", "http://localhost:8080", "host url of the rcon server")
 	//key        = flag.String("key", "", "rcon key")
-	influxhost = flag.String("influxhost", "http://localhost:8086", "influxdb host")
-	influxdb   = flag.String("influxdb", "spaceengineers", "influxdb database")
-	influxuser = flag.String("influxuser", "", "influx username")
-	influxpass = flag.String("influxpass", "", "influx password")
+	influxhost         = flag.String("influxhost", "http://localhost:8086", "influxdb host (empty disables)")
+	influxdb           = flag.String("influxdb", "spaceengineers", "influxdb database")
+	influxuser         = flag.String("influxuser", "", "influx username")
+	influxpass         = flag.String("influxpass", "", "influx password")
+	graphite           = flag.String("graphite", "", "carbon address, e.g. localhost:2003 (empty disables)")
+	graphiteTemplate   = flag.String("graphitetemplate", DefaultGraphiteTemplate, "graphite metric path template")
+	graphiteTagged     = flag.Bool("graphitetagged", false, "send remaining tags as graphite series tags")
+	graphitePickle     = flag.Bool("graphitepickle", false, "use the carbon pickle protocol instead of plaintext")
+	statsd             = flag.String("statsd", "", "statsd address, e.g. localhost:8125 (empty disables)")
+	statsdPrefix       = flag.String("statsdprefix", "spaceengineers", "statsd metric name prefix")
+	statsdTags         = flag.Bool("statsdtags", true, "attach tags dogstatsd style")
+	statsdMeasurements = flag.String("statsdmeasurements", DefaultStatsdMeasurements, "comma separated measurements sent to statsd")
+	otlp               = flag.String("otlp", "", "opentelemetry collector url, e.g. http://localhost:4318 (empty disables)")
+	otlpGRPC           = flag.Bool("otlpgrpc", false, "export otlp over grpc instead of http/protobuf")
+	otlpHeaders        = flag.String("otlpheaders", "", "comma separated key=value headers sent to the otlp endpoint")
+	eventLog           = flag.String("eventlog", "", "write events, player joins and leaves, saves and alerts as json lines to this file, - for stdout")
+	loki               = flag.String("loki", "", "loki url events are pushed to, e.g. http://localhost:3100 (empty disables)")
+	sqliteArchive      = flag.String("sqlite", "", "archive players, sessions, grids, factions and events in this sqlite database (empty disables)")
+	sqliteRaw          = flag.Duration("sqliteraw", 7*24*time.Hour, "keep raw grid snapshots this long before downsampling them to hourly averages")
+	sqliteRetention    = flag.Duration("sqliteretention", 0, "delete archived history older than this (0 keeps it forever)")
+	dumpDir            = flag.String("dump", "", "directory grid and faction snapshots are dumped to (empty disables)")
+	dumpFormat         = flag.String("dumpformat", DumpCSV, "format of the dumps, csv or parquet")
+	dumpEvery          = flag.Duration("dumpevery", time.Hour, "minimum time between two dumps (0 dumps every scrape)")
+	dumpKeep           = flag.Int("dumpkeep", 0, "number of dumps kept per table (0 keeps all)")
+	mqtt               = flag.String("mqtt", "", "mqtt broker address server state is published to, e.g. localhost:1883 (empty disables)")
+	mqttTopic          = flag.String("mqtttopic", "spaceengineers", "mqtt topic prefix")
+	mqttQoS            = flag.Int("mqttqos", 0, "mqtt qos level, 0 or 1")
+	mqttRetain         = flag.Bool("mqttretain", true, "retain the server and alert state on the mqtt broker")
+	mqttUser           = flag.String("mqttuser", "", "mqtt username")
+	mqttPass           = flag.String("mqttpass", "", "mqtt password")
+	dashboard          = flag.Bool("dashboard", false, "serve a live web dashboard at /dashboard of -listen")
+	storeRetention     = flag.Duration("storeretention", time.Hour, "history kept in memory for the query api and dashboard of -listen")
+	storeMaxSeries     = flag.Int("storeseries", 10000, "maximum number of series kept in memory")
+	forecastWindow     = flag.Duration("forecast", 0, "fit pcu and block trends over this window to forecast when limits are hit (0 disables)")
+	forecastHorizon    = flag.Duration("forecasthorizon", 24*time.Hour, "alert when a limit is forecast to be hit within this (0 disables)")
+	cleanupPath        = flag.String("cleanupstate", "", "state file tracking grids and when players were last seen for the cleanup report (empty disables)")
+	cleanupAfter       = flag.Duration("cleanupafter", 7*24*time.Hour, "report grids unpowered for this long as cleanup candidates")
+	cleanupAbsent      = flag.Duration("cleanupabsent", 30*24*time.Hour, "report grids of players absent for this long as cleanup candidates")
+	profiles           = flag.Bool("profiles", false, "keep player profiles, served at /api/v1/players of -listen, and emit aggregate player metrics")
+	profilesPath       = flag.String("profilesstate", "", "state file the player profiles are saved to (empty keeps them in memory)")
+	conveyorTop        = flag.Int("conveyortop", 0, "number of grids, owners and factions ranked by conveyor complexity (0 disables the rankings)")
+	conveyorWeights    = flag.String("conveyorweights", DefaultConveyorWeights.String(), "weights of the conveyor counts in the conveyor complexity score")
+	conveyorAlert      = flag.Float64("conveyoralert", 0, "alert when a grid's conveyor score exceeds this (0 disables)")
+	conveyorOwnerAlert = flag.Float64("conveyorowneralert", 0, "alert when the conveyor score of a player's grids exceeds this (0 disables)")
+	lagThreshold       = flag.Float64("lagthreshold", 0, "report the biggest grids when sim speed drops below this, e.g. 0.8 (0 disables)")
+	lagDir             = flag.String("lagdir", "", "directory lag reports are written to as json (empty disables)")
+	lagTop             = flag.Int("lagtop", 5, "number of grids per ranking in a lag report")
+	leakWindow         = flag.Duration("leakwindow", 0, "fit memory trends after gen2 collections over this window to detect leaks (0 disables)")
+	leakLimit          = flag.Float64("leaklimit", 0, "memory in GiB the server must stay below, forecast from the leak trends (0 disables alerts)")
+	leakHorizon        = flag.Duration("leakhorizon", 6*time.Hour, "alert when the leak limit is projected to be hit within this")
+	counters           = flag.String("counters", "", "comma separated measurement.field counters to add _delta and _rate fields for, e.g. "+TorchCounters+" (empty disables)")
+	playerNamesPath    = flag.String("playernames", "", "state file the steam id to player name cache is saved to (empty keeps it in memory)")
+	interval           = flag.Duration("interval", 10*time.Second, "scrape interval")
+	listen             = flag.String("listen", "", "listen address of the exporter http endpoints, e.g. :9100 (empty disables)")
+	readyAfter         = flag.Int("readyintervals", 3, "number of scrape intervals without a successful scrape or write before /readyz fails")
+	record             = flag.String("record", "", "record all torch responses to this archive file (.gz compresses)")
+	replay             = flag.String("replay", "", "answer torch requests from this archive file instead of -host")
+	replayPace         = flag.Bool("replaypace", false, "delay replayed responses by their recorded duration")
+	saveWindow         = flag.Duration("savewindow", 24*time.Hour, "window for world save duration percentiles")
+	saveAlert          = flag.Duration("savealert", 0, "alert when a world save takes longer than this (0 disables)")
 )
 
 func main() {
@@ -33,695 +91,269 @@ func main() {
 		log.Fatal(err)
 	}
 
-	c, err := client.NewHTTPClient(client.HTTPConfig{
-		Addr:     *influxhost,
-		Username: *influxuser,
-		Password: *influxpass,
-	})
-	if err != nil {
-		log.Fatal(err)
+	if *record != "" && *replay != "" {
+		log.Fatal("-record and -replay cannot be combined")
 	}
-	defer c.Close()
-
-	errWg, gCtx := errgroup.WithContext(context.Background())
-	errWg.Go(func() error {
-		running := false
-		ticker := time.NewTicker(10 * time.Second)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-gCtx.Done():
-				return gCtx.Err()
-			case <-ticker.C:
-				if running {
-					continue
-				}
-				running = true
-				info, err := t.Server()
-				if err != nil {
-					return err
-				}
-
-				// Create a new point batch
-				bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-					Database:  *influxdb,
-					Precision: "s",
-				})
-				if err != nil {
-					return err
-				}
-
-				ready := 0
-				if info.IsReady {
-					ready++
-				}
-				pt, err := client.NewPoint(
-					"server",
-					map[string]string{
-						"host":        *host,
-						"server_name": info.ServerName,
-						"version":     info.Version,
-						"world_name":  info.WorldName,
-						"block_limit": info.BlockLimitEnabled,
-					},
-					map[string]interface{}{
-						"sim_speed":             info.SimSpeed,
-						"players":               info.Players,
-						"sim_cpu_load":          info.SimulationCpuLoad,
-						"total_time":            info.TotalTime,
-						"used_pcu":              info.UsedPCU,
-						"ready":                 ready,
-						"max_blocks_per_player": info.MaxBlocksPerPlayer,
-						"max_factions_count":    info.MaxFactionsCount,
-						"max_floating_objects":  info.MaxFloatingObjects,
-						"max_grid_size":         info.MaxGridSize,
-						"max_players":           info.MaxPlayers,
-						"block_limit":           info.BlockLimitEnabled,
-						"total_pcu":             info.TotalPCU,
-						"mod_count":             info.ModCount,
-						"save_duration":         info.SaveDuration,
-					},
-					time.Now(),
-				)
-				if err != nil {
-					return err
-				}
-				bp.AddPoint(pt)
-
-				// Write the batch
-				if err := c.Write(bp); err != nil {
-					return err
-				}
-				running = false
-			}
+	if *replay != "" {
+		entries, err := ReadArchive(*replay)
+		if err != nil {
+			log.Fatal(err)
 		}
-
-		return nil
-	})
-	errWg.Go(func() error {
-		running := false
-		ticker := time.NewTicker(10 * time.Second)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-gCtx.Done():
-				return gCtx.Err()
-			case <-ticker.C:
-				if running {
-					continue
-				}
-				running = true
-
-				loads, err := t.Load()
-				if err != nil {
-					return err
-				}
-
-				// Create a new point batch
-				bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-					Database:  *influxdb,
-					Precision: "s",
-				})
-				if err != nil {
-					return err
-				}
-
-				for _, load := range loads {
-					var occurred time.Time
-					if load.MillisecondsInThePast > 0 {
-						occurred = time.Now().Add(time.Millisecond * time.Duration(load.MillisecondsInThePast) * -1)
-					}
-					pt, err := client.NewPoint(
-						"load",
-						map[string]string{
-							"host": *host,
-						},
-						map[string]interface{}{
-							"server_cpu_load":           load.ServerCPULoad,
-							"server_cpu_load_smooth":    load.ServerCPULoadSmooth,
-							"server_simulation_ratio":   load.ServerSimulationRatio,
-							"server_thread_load":        load.ServerThreadLoad,
-							"server_thread_load_smooth": load.ServerThreadLoadSmooth,
-						},
-						occurred,
-					)
-					if err != nil {
-						return err
-					}
-					bp.AddPoint(pt)
-				}
-
-				// Write the batch
-				if err := c.Write(bp); err != nil {
-					return err
-				}
-				running = false
-			}
+		replayer := NewReplayer(entries)
+		replayer.Pace = *replayPace
+		t.SetTransport(replayer)
+	}
+	var recorder *Recorder
+	if *record != "" {
+		recorder, err = NewRecorder(*record, http.DefaultTransport)
+		if err != nil {
+			log.Fatal(err)
 		}
+		defer recorder.Close()
+		t.SetTransport(recorder)
+	}
 
-		return nil
-	})
-	errWg.Go(func() error {
-		running := false
-		ticker := time.NewTicker(10 * time.Second)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-gCtx.Done():
-				return gCtx.Err()
-			case <-ticker.C:
-				if running {
-					continue
-				}
-				running = true
-				process, err := t.Process()
-				if err != nil {
-					return err
-				}
-
-				// Create a new point batch
-				bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-					Database:  *influxdb,
-					Precision: "s",
-				})
-				if err != nil {
-					return err
-				}
-
-				pt, err := client.NewPoint(
-					"process",
-					map[string]string{
-						"host": *host,
-					},
-					map[string]interface{}{
-						"private_memory_size64":         process.PrivateMemorySize64,
-						"virtual_memory_size64":         process.VirtualMemorySize64,
-						"working_set64":                 process.WorkingSet64,
-						"nonpaged_system_memory_size64": process.NonpagedSystemMemorySize64,
-						"paged_memory_size64":           process.PagedMemorySize64,
-						"paged_system_memory_size64":    process.PagedSystemMemorySize64,
-						"peak_paged_memory_size64":      process.PeakPagedMemorySize64,
-						"peak_virtual_memory_size64":    process.PeakVirtualMemorySize64,
-						"peak_working_set64":            process.PeakWorkingSet64,
-						"gc_latency_mode":               process.GCLatencyMode,
-						"gc_total_memory":               process.GCTotalMemory,
-						"gc_max_generation":             process.GCMaxGeneration,
-						"gc_collection_count0":          process.GCCollectionCount0,
-						"gc_collection_count1":          process.GCCollectionCount1,
-						"gc_collection_count2":          process.GCCollectionCount2,
-					},
-					time.Now(),
-				)
-				if err != nil {
-					return err
-				}
-				bp.AddPoint(pt)
-
-				// Write the batch
-				if err := c.Write(bp); err != nil {
-					return err
-				}
-				running = false
-			}
+	switch flag.Arg(0) {
+	case "":
+	case "scrape":
+		code := scrapeCommand(t, *host, flag.Args()[1:])
+		if recorder != nil {
+			recorder.Close()
 		}
-
-		return nil
-	})
-	errWg.Go(func() error {
-		running := false
-		ticker := time.NewTicker(10 * time.Second)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-gCtx.Done():
-				return gCtx.Err()
-			case <-ticker.C:
-				if running {
-					continue
-				}
-				running = true
-
-				events, err := t.Events()
-				if err != nil {
-					return err
-				}
-
-				// Create a new point batch
-				bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-					Database:  *influxdb,
-					Precision: "s",
-				})
-				if err != nil {
-					return err
-				}
-
-				for _, event := range events {
-					var occurred time.Time
-					if event.SecondsInThePast > 0 {
-						occurred = time.Now().Add(time.Second * time.Duration(event.SecondsInThePast) * -1)
-					}
-					pt, err := client.NewPoint(
-						"events",
-						map[string]string{
-							"host": *host,
-							"type": event.Type,
-						},
-						map[string]interface{}{
-							"text": event.Text,
-							"tags": strings.Join(event.Tags, ","),
-						},
-						occurred,
-					)
-					if err != nil {
-						return err
-					}
-					bp.AddPoint(pt)
-				}
-
-				// Write the batch
-				if err := c.Write(bp); err != nil {
-					return err
-				}
-				running = false
-			}
+		os.Exit(code)
+	case "faketorch":
+		os.Exit(fakeTorchCommand(flag.Args()[1:]))
+	case "cleanup":
+		if *cleanupPath == "" {
+			log.Fatal("the cleanup command needs -cleanupstate")
 		}
-
-		return nil
-	})
-	errWg.Go(func() error {
-		running := false
-		ticker := time.NewTicker(10 * time.Second)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-gCtx.Done():
-				return gCtx.Err()
-			case <-ticker.C:
-				if running {
-					continue
-				}
-				running = true
-
-				events, err := t.PlayerEvents()
-				if err != nil {
-					return err
-				}
-
-				// Create a new point batch
-				bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-					Database:  *influxdb,
-					Precision: "s",
-				})
-				if err != nil {
-					return err
-				}
-
-				for _, event := range events {
-					var occurred time.Time
-					if event.MillisecondsInThePast > 0 {
-						occurred = time.Now().Add(time.Millisecond * time.Duration(event.MillisecondsInThePast) * -1)
-					}
-					pt, err := client.NewPoint(
-						"players",
-						map[string]string{
-							"host":     *host,
-							"type":     event.Type,
-							"steam_id": fmt.Sprint(event.SteamID),
-						},
-						map[string]interface{}{
-							"value": 1,
-						},
-						occurred,
-					)
-					if err != nil {
-						return err
-					}
-					bp.AddPoint(pt)
-				}
-
-				// Write the batch
-				if err := c.Write(bp); err != nil {
-					return err
-				}
-				running = false
-			}
+		c, err := NewCleanupTracker(*cleanupPath, *cleanupAfter, *cleanupAbsent, RealClock)
+		if err != nil {
+			log.Fatal(err)
 		}
+		os.Exit(cleanupCommand(c, flag.Args()[1:]))
+	default:
+		log.Fatalf("unknown command %q", flag.Arg(0))
+	}
 
-		return nil
-	})
-	errWg.Go(func() error {
-		running := false
-		ticker := time.NewTicker(10 * time.Second)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-gCtx.Done():
-				return gCtx.Err()
-			case <-ticker.C:
-				if running {
-					continue
-				}
-				running = true
-
-				grids, err := t.SessionGrids()
-				if err != nil {
-					return err
-				}
-
-				// Create a new point batch
-				bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-					Database:  *influxdb,
-					Precision: "s",
-				})
-				if err != nil {
-					return err
-				}
-
-				for _, grid := range grids {
-					powered := 0
-					concealed := 0
-					dampenersEnabled := 0
-					isStatic := 0
-					if grid.IsPowered {
-						powered++
-					}
-					if grid.IsConcealed {
-						concealed++
-					}
-					if grid.DampenersEnabled {
-						dampenersEnabled++
-					}
-					if grid.IsStatic {
-						isStatic++
-					}
-					pt, err := client.NewPoint(
-						"grid",
-						map[string]string{
-							"host":                *host,
-							"owner_steam_id":      fmt.Sprint(grid.OwnerSteamID),
-							"owner_display_name":  grid.OwnerDisplayName,
-							"owner_faction_tag":   strings.Replace(grid.OwnerFactionTag, "\\", "", -1),
-							"owner_faction_name":  grid.OwnerFactionName,
-							"display_name":        grid.DisplayName,
-							"filter_is_powered":   toStringBool(grid.IsPowered),
-							"grid_size":           grid.GridSize,
-							"filter_is_concealed": toStringBool(grid.IsConcealed),
-							"filter_is_static":    toStringBool(grid.IsStatic),
-						},
-						map[string]interface{}{
-							"blocks_count":                   grid.BlocksCount,
-							"is_powered":                     powered,
-							"linear_speed":                   grid.LinearSpeed,
-							"mass":                           grid.Mass,
-							"pcu":                            grid.PCU,
-							"is_concealed":                   concealed,
-							"dampeners_enabled":              dampenersEnabled,
-							"is_static":                      isStatic,
-							"conveyor_connector_count":       grid.ConveyorSystemConnectorCount,
-							"conveyor_endpoint_block_count":  grid.ConveyorSystemEndpointBlockCount,
-							"conveyor_inventory_block_count": grid.ConveyorSystemInventoryBlockCount,
-							"conveyor_line_count":            grid.ConveyorSystemLineCount,
-						},
-					)
-					if err != nil {
-						return err
-					}
-					bp.AddPoint(pt)
-				}
-
-				// Write the batch
-				if err := c.Write(bp); err != nil {
-					return err
-				}
-				running = false
-			}
+	var sinks []Sink
+	if *influxhost != "" {
+		c, err := client.NewHTTPClient(client.HTTPConfig{
+			Addr:     *influxhost,
+			Username: *influxuser,
+			Password: *influxpass,
+		})
+		if err != nil {
+			log.Fatal(err)
 		}
-
-		return nil
-	})
-	errWg.Go(func() error {
-		running := false
-		ticker := time.NewTicker(10 * time.Second)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-gCtx.Done():
-				return gCtx.Err()
-			case <-ticker.C:
-				if running {
-					continue
-				}
-				running = true
-
-				asteroids, err := t.SessionAsteroids()
-				if err != nil {
-					return err
-				}
-
-				// Create a new point batch
-				bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-					Database:  *influxdb,
-					Precision: "s",
-				})
-				if err != nil {
-					return err
-				}
-
-				pt, err := client.NewPoint(
-					"voxel",
-					map[string]string{
-						"host": *host,
-						"kind": "asteroid",
-					},
-					map[string]interface{}{
-						"value": len(asteroids),
-					},
-				)
-				if err != nil {
-					return err
-				}
-				bp.AddPoint(pt)
-
-				// Write the batch
-				if err := c.Write(bp); err != nil {
-					return err
-				}
-				running = false
+		defer c.Close()
+		sinks = append(sinks, NewInfluxSink(c, *influxdb))
+	}
+	if *graphite != "" {
+		g := NewGraphiteSink(*graphite, *graphiteTemplate, RealClock)
+		g.Tagged = *graphiteTagged
+		g.Pickle = *graphitePickle
+		defer g.Close()
+		sinks = append(sinks, g)
+	}
+	if *otlp != "" {
+		o := NewOTLPSink(*otlp, *host, *otlpGRPC, RealClock)
+		o.Headers = make(map[string]string)
+		for _, header := range strings.Split(*otlpHeaders, ",") {
+			kv := strings.SplitN(header, "=", 2)
+			if len(kv) == 2 {
+				o.Headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
 			}
 		}
-
-		return nil
-	})
-	errWg.Go(func() error {
-		running := false
-		ticker := time.NewTicker(10 * time.Second)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-gCtx.Done():
-				return gCtx.Err()
-			case <-ticker.C:
-				if running {
-					continue
-				}
-				running = true
-
-				planets, err := t.SessionPlanets()
-				if err != nil {
-					return err
-				}
-
-				// Create a new point batch
-				bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-					Database:  *influxdb,
-					Precision: "s",
-				})
-				if err != nil {
-					return err
-				}
-
-				pt, err := client.NewPoint(
-					"voxel",
-					map[string]string{
-						"host": *host,
-						"kind": "planet",
-					},
-					map[string]interface{}{
-						"value": len(planets),
-					},
-				)
-				if err != nil {
-					return err
-				}
-				bp.AddPoint(pt)
-
-				// Write the batch
-				if err := c.Write(bp); err != nil {
-					return err
-				}
-				running = false
-			}
+		sinks = append(sinks, o)
+	}
+	if *statsd != "" {
+		s, err := NewStatsdSink(*statsd, *statsdPrefix, strings.Split(*statsdMeasurements, ","))
+		if err != nil {
+			log.Fatal(err)
 		}
+		s.Tags = *statsdTags
+		defer s.Close()
+		sinks = append(sinks, s)
+	}
 
-		return nil
-	})
-	errWg.Go(func() error {
-		running := false
-		ticker := time.NewTicker(10 * time.Second)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-gCtx.Done():
-				return gCtx.Err()
-			case <-ticker.C:
-				if running {
-					continue
-				}
-				running = true
-
-				factions, err := t.SessionFactions()
-				if err != nil {
-					return err
-				}
-
-				// Create a new point batch
-				bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-					Database:  *influxdb,
-					Precision: "s",
-				})
-				if err != nil {
-					return err
-				}
-
-				for _, faction := range factions {
-					npconly := 0
-					acceptHumans := 0
-					autoAcceptMember := 0
-					autoAcceptPeace := 0
-					enableFriendlyFire := 0
-					if faction.NPCOnly {
-						npconly++
-					}
-					if faction.AcceptHumans {
-						acceptHumans++
-					}
-					if faction.AutoAcceptMember {
-						autoAcceptMember++
-					}
-					if faction.AutoAcceptPeace {
-						autoAcceptPeace++
-					}
-					if faction.EnableFriendlyFire {
-						enableFriendlyFire++
-					}
-					pt, err := client.NewPoint(
-						"faction",
-						map[string]string{
-							"host":                        *host,
-							"faction_id":                  fmt.Sprint(faction.FactionId),
-							"founder_id":                  fmt.Sprint(faction.FounderId),
-							"name":                        faction.Name,
-							"tag":                         strings.Replace(faction.Tag, "\\", "", -1),
-							"filter_accept_humans":        toStringBool(faction.AcceptHumans),
-							"filter_auto_accept_member":   toStringBool(faction.AutoAcceptMember),
-							"filter_auto_accept_peace":    toStringBool(faction.AutoAcceptPeace),
-							"filter_enable_friendly_fire": toStringBool(faction.EnableFriendlyFire),
-							"filter_npc_only":             toStringBool(faction.NPCOnly),
-						},
-						map[string]interface{}{
-							"npc_only":             npconly,
-							"auto_accept_humans":   acceptHumans,
-							"auto_accept_member":   autoAcceptMember,
-							"auto_accept_peace":    autoAcceptPeace,
-							"enable_friendly_fire": enableFriendlyFire,
-							"member_count":         faction.MemberCount,
-						},
-					)
-					if err != nil {
-						return err
-					}
-					bp.AddPoint(pt)
-				}
+	if *eventLog == "-" {
+		sinks = append(sinks, NewEventLogSink(os.Stdout, RealClock))
+	} else if *eventLog != "" {
+		f, err := os.OpenFile(*eventLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		sinks = append(sinks, NewEventLogSink(f, RealClock))
+	}
+	if *loki != "" {
+		sinks = append(sinks, NewLokiSink(*loki, RealClock))
+	}
+	if *mqtt != "" {
+		if *mqttQoS != 0 && *mqttQoS != 1 {
+			log.Fatalf("unsupported mqtt qos %d", *mqttQoS)
+		}
+		if *mqttPass != "" && *mqttUser == "" {
+			log.Fatal("-mqttpass needs -mqttuser")
+		}
+		m := NewMQTTSink(*mqtt, *mqttTopic, RealClock)
+		m.QoS = byte(*mqttQoS)
+		m.Retain = *mqttRetain
+		m.Username = *mqttUser
+		m.Password = *mqttPass
+		defer m.Close()
+		sinks = append(sinks, m)
+	}
+	if *sqliteArchive != "" {
+		s, err := NewSQLiteSink(*sqliteArchive, RealClock)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.RawRetention = *sqliteRaw
+		s.Retention = *sqliteRetention
+		s.Grids = t.LastSessionGrids
+		defer s.Close()
+		sinks = append(sinks, s)
+	}
 
-				// Write the batch
-				if err := c.Write(bp); err != nil {
-					return err
-				}
-				running = false
-			}
+	var store *Store
+	if *listen != "" {
+		store = NewStore(*storeRetention, RealClock)
+		store.MaxSeries = *storeMaxSeries
+		sinks = append(sinks, store)
+	}
+	var dash *Dashboard
+	if *dashboard {
+		if *listen == "" {
+			log.Fatal("the dashboard needs -listen")
+		}
+		dash = NewDashboard(store, RealClock)
+		sinks = append(sinks, dash)
+	}
+	var prof *Profiles
+	if *profiles {
+		prof, err = NewProfiles(*profilesPath, RealClock)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sinks = append(sinks, prof)
+	}
+	var cleanup *CleanupTracker
+	if *cleanupPath != "" {
+		cleanup, err = NewCleanupTracker(*cleanupPath, *cleanupAfter, *cleanupAbsent, RealClock)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cleanup.Grids = t.LastSessionGrids
+		sinks = append(sinks, cleanup)
+	}
+	if *dumpDir != "" {
+		d, err := NewDumper(*dumpDir, *dumpFormat, RealClock)
+		if err != nil {
+			log.Fatal(err)
 		}
+		d.Every = *dumpEvery
+		d.Keep = *dumpKeep
+		d.Grids = t.LastSessionGrids
+		d.Factions = t.LastSessionFactions
+		sinks = append(sinks, d)
+	}
+	weights, err := ParseConveyorWeights(*conveyorWeights)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var lag *LagAnalyzer
+	if *lagThreshold > 0 {
+		lag = NewLagAnalyzer(*host, *lagThreshold, RealClock)
+		lag.Grids = t.LastSessionGrids
+		lag.Top = *lagTop
+		lag.Dir = *lagDir
+		lag.Conveyors = weights
+		sinks = append(sinks, lag)
+	}
 
-		return nil
-	})
-	errWg.Go(func() error {
-		running := false
-		ticker := time.NewTicker(10 * time.Second)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-gCtx.Done():
-				return gCtx.Err()
-			case <-ticker.C:
-				if running {
-					continue
-				}
-				running = true
+	names, err := NewPlayerNames(*playerNamesPath, RealClock)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-				floatingObjects, err := t.SessionFloatingObjects()
-				if err != nil {
-					return err
-				}
+	processors := []Processor{names}
+	counterFields, err := ParseCounters(*counters)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(counterFields) > 0 {
+		processors = append(processors, NewCounterRates(counterFields, RealClock))
+	}
 
-				// Create a new point batch
-				bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-					Database:  *influxdb,
-					Precision: "s",
-				})
-				if err != nil {
-					return err
-				}
+	stats := NewStats()
+	collectors := NewCollectors(t, *host, NewSaveMonitor(*saveWindow, *saveAlert), RealClock)
+	collectors = append(collectors, stats.Collector(*host, RealClock))
+	if lag != nil {
+		collectors = append(collectors, lag.Collector())
+	}
+	if prof != nil {
+		collectors = append(collectors, prof.Collector(*host))
+	}
+	if *conveyorTop > 0 || *conveyorAlert > 0 || *conveyorOwnerAlert > 0 {
+		r := NewConveyorRanker(*host, *conveyorTop, RealClock)
+		r.Weights = weights
+		r.GridThreshold = *conveyorAlert
+		r.OwnerThreshold = *conveyorOwnerAlert
+		processors = append(processors, r)
+	}
+	if *forecastWindow > 0 {
+		processors = append(processors, NewForecaster(*host, *forecastWindow, *forecastHorizon, RealClock))
+	}
+	if *leakWindow > 0 {
+		processors = append(processors, NewLeakDetector(*host, *leakWindow, int64(*leakLimit*(1<<30)), *leakHorizon, RealClock))
+	}
 
-				for _, floatingObject := range floatingObjects {
-					pt, err := client.NewPoint(
-						"floating_object",
-						map[string]string{
-							"host":         *host,
-							"display_name": floatingObject.TypeDisplayName,
-							"kind":         floatingObject.Kind,
-						},
-						map[string]interface{}{
-							"distance_to_player": floatingObject.DistanceToPlayer,
-							"linear_speed":       floatingObject.LinearSpeed,
-							"mass":               floatingObject.Mass,
-						},
-					)
-					if err != nil {
-						return err
-					}
-					bp.AddPoint(pt)
-				}
+	exporter := &Exporter{
+		Collectors: collectors,
+		Processors: processors,
+		Sinks:      sinks,
+		Interval:   *interval,
+		Stats:      stats,
+		Clock:      RealClock,
+	}
 
-				// Write the batch
-				if err := c.Write(bp); err != nil {
-					return err
-				}
-				running = false
-			}
+	if *listen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/metrics", stats)
+		health := &Health{
+			Exporter:  exporter,
+			Intervals: *readyAfter,
+			Started:   RealClock.Now(),
 		}
-
-		return nil
-	})
-	err = errWg.Wait()
-	if err != nil {
-		log.Fatal(err)
+		health.Register(mux)
+		store.Register(mux)
+		if dash != nil {
+			dash.Register(mux)
+		}
+		if cleanup != nil {
+			cleanup.Register(mux)
+		}
+		if prof != nil {
+			prof.Register(mux)
+		}
+		go func() {
+			log.Fatal(http.ListenAndServe(*listen, mux))
+		}()
 	}
-}
 
-func toStringBool(val bool) string {
-	switch val {
-	case true:
-		return "yes"
-	default:
-		return "no"
+	// Stop on SIGINT and SIGTERM so the deferred Close calls finish the
+	// recording and the archive.
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		log.Printf("received %s, stopping", <-signals)
+		cancel()
+	}()
+	err = exporter.Run(ctx)
+	if err != nil && err != context.Canceled {
+		log.Fatal(err)
 	}
 }
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/pkg/errors"
+	_ "modernc.org/sqlite"
+)
+
+const sqliteDriver = "sqlite"
+
+// sqliteMigrations are applied in order to bring an archive up to date; the
+// number of applied migrations is kept in PRAGMA user_version. Released
+// migrations must never change, new ones are appended.
+var sqliteMigrations = []string{
+	`CREATE TABLE servers (
+		id          INTEGER PRIMARY KEY,
+		host        TEXT NOT NULL UNIQUE,
+		server_name TEXT NOT NULL DEFAULT '',
+		world_name  TEXT NOT NULL DEFAULT '',
+		version     TEXT NOT NULL DEFAULT '',
+		first_seen  INTEGER NOT NULL,
+		last_seen   INTEGER NOT NULL
+	);
+	CREATE TABLE players (
+		id           INTEGER PRIMARY KEY,
+		server_id    INTEGER NOT NULL REFERENCES servers(id),
+		steam_id     TEXT NOT NULL,
+		display_name TEXT NOT NULL DEFAULT '',
+		first_seen   INTEGER NOT NULL,
+		last_seen    INTEGER NOT NULL,
+		UNIQUE (server_id, steam_id)
+	);
+	CREATE TABLE sessions (
+		id        INTEGER PRIMARY KEY,
+		player_id INTEGER NOT NULL REFERENCES players(id) ON DELETE CASCADE,
+		joined_at INTEGER NOT NULL,
+		left_at   INTEGER,
+		UNIQUE (player_id, joined_at)
+	);
+	CREATE TABLE factions (
+		id           INTEGER PRIMARY KEY,
+		server_id    INTEGER NOT NULL REFERENCES servers(id),
+		faction_id   TEXT NOT NULL,
+		tag          TEXT NOT NULL,
+		name         TEXT NOT NULL,
+		founder_id   TEXT NOT NULL,
+		member_count INTEGER NOT NULL,
+		npc_only     INTEGER NOT NULL,
+		first_seen   INTEGER NOT NULL,
+		last_seen    INTEGER NOT NULL,
+		UNIQUE (server_id, faction_id)
+	);
+	CREATE TABLE grids (
+		id                INTEGER PRIMARY KEY,
+		server_id         INTEGER NOT NULL REFERENCES servers(id),
+		entity_id         TEXT NOT NULL,
+		display_name      TEXT NOT NULL,
+		grid_size         TEXT NOT NULL,
+		owner_steam_id    TEXT NOT NULL,
+		owner_faction_tag TEXT NOT NULL,
+		first_seen        INTEGER NOT NULL,
+		last_seen         INTEGER NOT NULL,
+		UNIQUE (server_id, entity_id)
+	);
+	CREATE TABLE grid_snapshots (
+		grid_id             INTEGER NOT NULL REFERENCES grids(id) ON DELETE CASCADE,
+		time                INTEGER NOT NULL,
+		resolution          INTEGER NOT NULL,
+		samples             INTEGER NOT NULL,
+		blocks_count        REAL NOT NULL,
+		pcu                 REAL NOT NULL,
+		mass                REAL NOT NULL,
+		linear_speed        REAL NOT NULL,
+		is_powered          REAL NOT NULL,
+		is_concealed        REAL NOT NULL,
+		is_static           REAL NOT NULL,
+		conveyor_line_count REAL NOT NULL,
+		PRIMARY KEY (grid_id, resolution, time)
+	);
+	CREATE TABLE events (
+		id        INTEGER PRIMARY KEY,
+		server_id INTEGER NOT NULL REFERENCES servers(id),
+		time      INTEGER NOT NULL,
+		type      TEXT NOT NULL,
+		text      TEXT NOT NULL,
+		tags      TEXT NOT NULL,
+		UNIQUE (server_id, time, type, text)
+	);
+	CREATE INDEX events_time ON events (time);
+	CREATE INDEX grid_snapshots_time ON grid_snapshots (resolution, time);`,
+}
+
+// gridSnapshotColumns are the grid fields kept in grid_snapshots.
+var gridSnapshotColumns = []string{
+	"blocks_count",
+	"pcu",
+	"mass",
+	"linear_speed",
+	"is_powered",
+	"is_concealed",
+	"is_static",
+	"conveyor_line_count",
+}
+
+// gridSnapshotValues returns the gridSnapshotColumns of grid.
+func gridSnapshotValues(grid TorchMetricsSessionGrid) []interface{} {
+	return []interface{}{
+		grid.BlocksCount,
+		grid.PCU,
+		grid.Mass,
+		grid.LinearSpeed,
+		sqliteBool(grid.IsPowered),
+		sqliteBool(grid.IsConcealed),
+		sqliteBool(grid.IsStatic),
+		grid.ConveyorSystemLineCount,
+	}
+}
+
+// SQLiteSink archives servers, players and their sessions, factions, grids
+// and server events into a relational SQLite database for long-term
+// history.
+//
+// Every scrape of the grids collector adds a raw grid snapshot, taken from
+// Grids as the grid points carry no entity IDs to tell grids apart. Raw
+// snapshots older than RawRetention are downsampled into averages per
+// Resolution, and everything older than Retention is deleted; a Retention of
+// 0 keeps the downsampled history forever.
+type SQLiteSink struct {
+	RawRetention time.Duration
+	Retention    time.Duration
+	Resolution   time.Duration
+	Clock        Clock
+	// Grids returns the grids the grid points of a batch were made of,
+	// usually TorchMetrics.LastSessionGrids. Without it grids are not
+	// archived.
+	Grids func() []TorchMetricsSessionGrid
+
+	db *sql.DB
+
+	mu           sync.Mutex
+	servers      map[string]int64
+	lastMaintain time.Time
+}
+
+// NewSQLiteSink opens or creates the archive at path and applies pending
+// migrations.
+func NewSQLiteSink(path string, clock Clock) (*SQLiteSink, error) {
+	db, err := sql.Open(sqliteDriver, path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only supports one writer, and pragmas are per connection.
+	db.SetMaxOpenConns(1)
+	for _, pragma := range []string{"PRAGMA foreign_keys = ON", "PRAGMA journal_mode = WAL", "PRAGMA busy_timeout = 5000"} {
+		if _, err := db.Exec(pragma); err != nil {
+			db.Close()
+			return nil, errors.Wrap(err, pragma)
+		}
+	}
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteSink{
+		RawRetention: 7 * 24 * time.Hour,
+		Resolution:   time.Hour,
+		Clock:        clock,
+		db:           db,
+		servers:      make(map[string]int64),
+		lastMaintain: clock.Now(),
+	}, nil
+}
+
+func migrateSQLite(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(sqliteMigrations) {
+		return errors.Errorf("sqlite: archive schema version %d is newer than this exporter (%d)", version, len(sqliteMigrations))
+	}
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "sqlite: migration %d", i+1)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteSink) Name() string {
+	return "sqlite"
+}
+
+func (s *SQLiteSink) Write(points []*client.Point) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.Clock.Now()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	gridsHost := ""
+	for _, pt := range points {
+		if pt.Name() == "grid" {
+			gridsHost = pt.Tags()["host"]
+			continue
+		}
+		if err := s.write(tx, pt, now); err != nil {
+			tx.Rollback()
+			// The ids of servers inserted by the rolled back transaction
+			// are gone.
+			s.servers = make(map[string]int64)
+			return errors.Wrapf(err, "sqlite: %s", pt.Name())
+		}
+	}
+	if gridsHost != "" && s.Grids != nil {
+		if err := s.writeGrids(tx, gridsHost, s.Grids(), now.Unix()); err != nil {
+			tx.Rollback()
+			s.servers = make(map[string]int64)
+			return errors.Wrap(err, "sqlite: grid")
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if now.Sub(s.lastMaintain) >= s.Resolution {
+		s.lastMaintain = now
+		return s.maintain(now)
+	}
+	return nil
+}
+
+func (s *SQLiteSink) write(tx *sql.Tx, pt *client.Point, now time.Time) error {
+	tags := pt.Tags()
+	fields, err := pt.Fields()
+	if err != nil {
+		return err
+	}
+	ts := pt.Time()
+	if ts.IsZero() {
+		ts = now
+	}
+	unix := ts.Unix()
+
+	switch pt.Name() {
+	case "server", "players", "events", "faction":
+	default:
+		return nil
+	}
+	serverID, err := s.server(tx, tags["host"], unix)
+	if err != nil {
+		return err
+	}
+
+	switch pt.Name() {
+	case "server":
+		_, err = tx.Exec(`UPDATE servers SET server_name = ?, world_name = ?, version = ? WHERE id = ?`,
+			tags["server_name"], tags["world_name"], tags["version"], serverID)
+		return err
+
+	case "players":
+		playerID, err := upsertPlayer(tx, serverID, tags["steam_id"], tags["player_name"], unix)
+		if err != nil {
+			return err
+		}
+		switch tags["type"] {
+		case PlayerJoined:
+			_, err = tx.Exec(`INSERT OR IGNORE INTO sessions (player_id, joined_at) VALUES (?, ?)`, playerID, unix)
+		case PlayerLeft:
+			_, err = tx.Exec(`UPDATE sessions SET left_at = ? WHERE id = (
+				SELECT id FROM sessions WHERE player_id = ? AND left_at IS NULL AND joined_at <= ?
+				ORDER BY joined_at DESC LIMIT 1)`, unix, playerID, unix)
+		}
+		return err
+
+	case "events":
+		_, err = tx.Exec(`INSERT OR IGNORE INTO events (server_id, time, type, text, tags) VALUES (?, ?, ?, ?, ?)`,
+			serverID, unix, tags["type"], fmt.Sprint(fields["text"]), fmt.Sprint(fields["tags"]))
+		return err
+
+	case "faction":
+		_, err = tx.Exec(`INSERT INTO factions (server_id, faction_id, tag, name, founder_id, member_count, npc_only, first_seen, last_seen)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (server_id, faction_id) DO UPDATE SET
+				tag = excluded.tag, name = excluded.name, founder_id = excluded.founder_id,
+				member_count = excluded.member_count, npc_only = excluded.npc_only, last_seen = excluded.last_seen`,
+			serverID, tags["faction_id"], tags["tag"], tags["name"], tags["founder_id"],
+			sqliteNumber(fields["member_count"]), sqliteNumber(fields["npc_only"]), unix, unix)
+		return err
+	}
+	return nil
+}
+
+// writeGrids archives a snapshot of the grids of host, taken at unix.
+func (s *SQLiteSink) writeGrids(tx *sql.Tx, host string, grids []TorchMetricsSessionGrid, unix int64) error {
+	serverID, err := s.server(tx, host, unix)
+	if err != nil {
+		return err
+	}
+	for _, grid := range grids {
+		owner := fmt.Sprint(grid.OwnerSteamID)
+		if grid.OwnerSteamID != 0 {
+			if _, err := upsertPlayer(tx, serverID, owner, grid.OwnerDisplayName, unix); err != nil {
+				return err
+			}
+		}
+		var gridID int64
+		err := tx.QueryRow(`INSERT INTO grids (server_id, entity_id, display_name, grid_size, owner_steam_id, owner_faction_tag, first_seen, last_seen)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (server_id, entity_id) DO UPDATE SET
+				display_name = excluded.display_name, grid_size = excluded.grid_size, owner_steam_id = excluded.owner_steam_id,
+				owner_faction_tag = excluded.owner_faction_tag, last_seen = excluded.last_seen
+			RETURNING id`,
+			serverID, fmt.Sprint(grid.EntityId), grid.DisplayName, grid.GridSize, owner,
+			strings.Replace(grid.OwnerFactionTag, "\\", "", -1), unix, unix,
+		).Scan(&gridID)
+		if err != nil {
+			return err
+		}
+		values := append([]interface{}{gridID, unix}, gridSnapshotValues(grid)...)
+		_, err = tx.Exec(`INSERT OR REPLACE INTO grid_snapshots (grid_id, time, resolution, samples, `+strings.Join(gridSnapshotColumns, ", ")+`)
+			VALUES (?, ?, 0, 1`+strings.Repeat(", ?", len(gridSnapshotColumns))+`)`, values...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// server returns the id of the server row for host, creating it on first
+// sight and bumping last_seen otherwise.
+func (s *SQLiteSink) server(tx *sql.Tx, host string, unix int64) (int64, error) {
+	if id, ok := s.servers[host]; ok {
+		_, err := tx.Exec(`UPDATE servers SET last_seen = max(last_seen, ?) WHERE id = ?`, unix, id)
+		return id, err
+	}
+	var id int64
+	err := tx.QueryRow(`INSERT INTO servers (host, first_seen, last_seen) VALUES (?, ?, ?)
+		ON CONFLICT (host) DO UPDATE SET last_seen = max(last_seen, excluded.last_seen)
+		RETURNING id`, host, unix, unix).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	s.servers[host] = id
+	return id, nil
+}
+
+func upsertPlayer(tx *sql.Tx, serverID int64, steamID, name string, unix int64) (int64, error) {
+	var id int64
+	err := tx.QueryRow(`INSERT INTO players (server_id, steam_id, display_name, first_seen, last_seen) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (server_id, steam_id) DO UPDATE SET
+			display_name = CASE WHEN excluded.display_name = '' THEN display_name ELSE excluded.display_name END,
+			last_seen = max(last_seen, excluded.last_seen)
+		RETURNING id`, serverID, steamID, name, unix, unix).Scan(&id)
+	return id, err
+}
+
+func sqliteBool(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func sqliteNumber(v interface{}) float64 {
+	f, _ := fieldValue(v)
+	return f
+}
+
+// Maintain downsamples and expires the archive immediately instead of
+// waiting for the next hourly run.
+func (s *SQLiteSink) Maintain() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastMaintain = s.Clock.Now()
+	return s.maintain(s.lastMaintain)
+}
+
+func (s *SQLiteSink) maintain(now time.Time) error {
+	resolution := int64(s.Resolution / time.Second)
+	// Only whole buckets are downsampled, so a bucket is never averaged
+	// from part of its raw snapshots.
+	cutoff := now.Add(-s.RawRetention).Unix() / resolution * resolution
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	averages := make([]string, len(gridSnapshotColumns))
+	for i, column := range gridSnapshotColumns {
+		averages[i] = "avg(" + column + ")"
+	}
+	statements := []sqliteStatement{
+		{`INSERT OR REPLACE INTO grid_snapshots (grid_id, time, resolution, samples, ` + strings.Join(gridSnapshotColumns, ", ") + `)
+			SELECT grid_id, time / ? * ?, ?, count(*), ` + strings.Join(averages, ", ") + `
+			FROM grid_snapshots WHERE resolution = 0 AND time < ?
+			GROUP BY grid_id, time / ?`, []interface{}{resolution, resolution, resolution, cutoff, resolution}},
+		{`DELETE FROM grid_snapshots WHERE resolution = 0 AND time < ?`, []interface{}{cutoff}},
+	}
+	if s.Retention > 0 {
+		expired := now.Add(-s.Retention).Unix()
+		statements = append(statements,
+			sqliteStatement{`DELETE FROM grid_snapshots WHERE time < ?`, []interface{}{expired}},
+			sqliteStatement{`DELETE FROM grids WHERE last_seen < ?`, []interface{}{expired}},
+			sqliteStatement{`DELETE FROM events WHERE time < ?`, []interface{}{expired}},
+			sqliteStatement{`DELETE FROM sessions WHERE coalesce(left_at, joined_at) < ?`, []interface{}{expired}},
+			sqliteStatement{`DELETE FROM factions WHERE last_seen < ?`, []interface{}{expired}},
+			sqliteStatement{`DELETE FROM players WHERE last_seen < ?`, []interface{}{expired}},
+		)
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt.query, stmt.args...); err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "sqlite: maintenance")
+		}
+	}
+	return tx.Commit()
+}
+
+type sqliteStatement struct {
+	query string
+	args  []interface{}
+}
+
+// Close closes the database.
+func (s *SQLiteSink) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+func newTestSQLiteSink(t *testing.T, clock Clock) (*SQLiteSink, string) {
+	dir, err := ioutil.TempDir("", "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "archive.db")
+	s, err := NewSQLiteSink(path, clock)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, dir
+}
+
+func queryInt(t *testing.T, db *sql.DB, query string, args ...interface{}) int64 {
+	var n int64
+	if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return n
+}
+
+func TestSQLiteSink(t *testing.T) {
+	h := newHarness(t, "testdata/torch")
+	s, dir := newTestSQLiteSink(t, h.clock)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+	s.Grids = h.torch.LastSessionGrids
+
+	for _, name := range []string{"server", "players", "events", "grids", "factions"} {
+		h.collect(name)
+		if err := s.Write(h.sink.Points()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Every scrape adds a grid snapshot.
+	h.clock.Advance(10 * time.Second)
+	h.collect("grids")
+	if err := s.Write(h.sink.Points()); err != nil {
+		t.Fatal(err)
+	}
+
+	var serverName, worldName string
+	if err := s.db.QueryRow(`SELECT server_name, world_name FROM servers WHERE host = ?`, testHost).Scan(&serverName, &worldName); err != nil {
+		t.Fatal(err)
+	}
+	if serverName != "Fankserver" || worldName != "Star System" {
+		t.Errorf("server %q, world %q", serverName, worldName)
+	}
+
+	for query, want := range map[string]int64{
+		`SELECT count(*) FROM servers`:                                                  1,
+		`SELECT count(*) FROM players`:                                                  2,
+		`SELECT count(*) FROM players WHERE display_name = 'Alice'`:                     1,
+		`SELECT count(*) FROM sessions`:                                                 1,
+		`SELECT count(*) FROM sessions WHERE left_at IS NULL`:                           1,
+		`SELECT count(*) FROM events`:                                                   2,
+		`SELECT count(*) FROM factions`:                                                 2,
+		`SELECT count(*) FROM grids`:                                                    2,
+		`SELECT count(*) FROM grid_snapshots WHERE resolution = 0`:                      4,
+		`SELECT count(*) FROM grids WHERE entity_id = '101' AND last_seen > first_seen`: 1,
+	} {
+		if got := queryInt(t, s.db, query); got != want {
+			t.Errorf("%s = %d, want %d", query, got, want)
+		}
+	}
+}
+
+func TestSQLiteSinkSessions(t *testing.T) {
+	clock := NewFakeClock(testEpoch)
+	s, dir := newTestSQLiteSink(t, clock)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+
+	player := func(typ string, at time.Time) *client.Point {
+		pt, err := client.NewPoint("players", map[string]string{"host": testHost, "type": typ, "steam_id": "1"}, map[string]interface{}{"value": 1}, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pt
+	}
+	err := s.Write([]*client.Point{
+		player(PlayerJoined, testEpoch),
+		player(PlayerLeft, testEpoch.Add(time.Hour)),
+		player(PlayerJoined, testEpoch.Add(2*time.Hour)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	played := queryInt(t, s.db, `SELECT sum(left_at - joined_at) FROM sessions WHERE left_at IS NOT NULL`)
+	if played != 3600 {
+		t.Errorf("played %ds, want 3600s", played)
+	}
+	if open := queryInt(t, s.db, `SELECT count(*) FROM sessions WHERE left_at IS NULL`); open != 1 {
+		t.Errorf("%d open sessions, want 1", open)
+	}
+}
+
+func TestSQLiteSinkDownsampling(t *testing.T) {
+	clock := NewFakeClock(testEpoch)
+	s, dir := newTestSQLiteSink(t, clock)
+	defer os.RemoveAll(dir)
+	s.RawRetention = 2 * time.Hour
+	s.Retention = 24 * time.Hour
+
+	var grids []TorchMetricsSessionGrid
+	s.Grids = func() []TorchMetricsSessionGrid { return grids }
+	grid := func(pcu int) []*client.Point {
+		grids = []TorchMetricsSessionGrid{{EntityId: 101, PCU: pcu}}
+		points, err := gridPoints(testHost, grids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return points
+	}
+	// Four hours of snapshots every 15 minutes, maintenance runs hourly
+	// on the way.
+	for i := 0; i < 16; i++ {
+		if err := s.Write(grid(100 + i)); err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(15 * time.Minute)
+	}
+	if err := s.Maintain(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first two hours are averaged into hourly snapshots, the rest is
+	// still raw.
+	rows, err := s.db.Query(`SELECT time, samples, pcu FROM grid_snapshots WHERE resolution = 3600 ORDER BY time`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hourly []float64
+	for rows.Next() {
+		var ts, samples int64
+		var pcu float64
+		if err := rows.Scan(&ts, &samples, &pcu); err != nil {
+			t.Fatal(err)
+		}
+		if samples != 4 || ts%3600 != 0 {
+			t.Errorf("bucket %d with %d samples", ts, samples)
+		}
+		hourly = append(hourly, pcu)
+	}
+	rows.Close()
+	if len(hourly) != 2 || hourly[0] != 101.5 || hourly[1] != 105.5 {
+		t.Errorf("hourly pcu %v, want [101.5 105.5]", hourly)
+	}
+	if raw := queryInt(t, s.db, `SELECT count(*) FROM grid_snapshots WHERE resolution = 0`); raw != 8 {
+		t.Errorf("%d raw snapshots, want 8", raw)
+	}
+
+	// A day later everything but the grid's last sighting has expired.
+	clock.Advance(25 * time.Hour)
+	if err := s.Maintain(); err != nil {
+		t.Fatal(err)
+	}
+	if n := queryInt(t, s.db, `SELECT count(*) FROM grid_snapshots`); n != 0 {
+		t.Errorf("%d snapshots left after retention", n)
+	}
+	if n := queryInt(t, s.db, `SELECT count(*) FROM grids`); n != 0 {
+		t.Errorf("%d grids left after retention", n)
+	}
+
+	// Reopening the archive keeps its schema version.
+	path := filepath.Join(dir, "archive.db")
+	s.Close()
+	s, err = NewSQLiteSink(path, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v := queryInt(t, s.db, `PRAGMA user_version`); v != int64(len(sqliteMigrations)) {
+		t.Errorf("schema version %d, want %d", v, len(sqliteMigrations))
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/pkg/errors"
+)
+
+// CollectorStats describes the runs of a single collector.
+type CollectorStats struct {
+	Scrapes        int64         `json:"scrapes"`
+	Errors         int64         `json:"errors"`
+	DecodeErrors   int64         `json:"decode_errors"`
+	SkippedTicks   int64         `json:"skipped_ticks"`
+	Points         int64         `json:"points"`
+	ScrapeDuration time.Duration `json:"scrape_duration"`
+	LastSuccess    time.Time     `json:"last_success"`
+	LastError      string        `json:"last_error,omitempty"`
+}
+
+// SinkStats describes the writes to a single sink.
+type SinkStats struct {
+	Writes        int64         `json:"writes"`
+	Failures      int64         `json:"failures"`
+	Points        int64         `json:"points"`
+	Dropped       int64         `json:"dropped"`
+	WriteDuration time.Duration `json:"write_duration"`
+	LastSuccess   time.Time     `json:"last_success"`
+	LastError     string        `json:"last_error,omitempty"`
+}
+
+// Stats holds the self-instrumentation of the exporter.
+type Stats struct {
+	mu         sync.Mutex
+	collectors map[string]*CollectorStats
+	sinks      map[string]*SinkStats
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		collectors: make(map[string]*CollectorStats),
+		sinks:      make(map[string]*SinkStats),
+	}
+}
+
+func (s *Stats) collector(name string) *CollectorStats {
+	c, ok := s.collectors[name]
+	if !ok {
+		c = &CollectorStats{}
+		s.collectors[name] = c
+	}
+	return c
+}
+
+func (s *Stats) sink(name string) *SinkStats {
+	c, ok := s.sinks[name]
+	if !ok {
+		c = &SinkStats{}
+		s.sinks[name] = c
+	}
+	return c
+}
+
+// Scrape records a collector run.
+func (s *Stats) Scrape(name string, duration time.Duration, points int, err error, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.collector(name)
+	c.Scrapes++
+	c.ScrapeDuration = duration
+	if err != nil {
+		c.Errors++
+		if _, ok := errors.Cause(err).(*DecodeError); ok {
+			c.DecodeErrors++
+		}
+		c.LastError = err.Error()
+		return
+	}
+	c.Points += int64(points)
+	c.LastSuccess = now
+	c.LastError = ""
+}
+
+// Skip records a tick on which the previous run of the collector was still
+// in progress.
+func (s *Stats) Skip(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.collector(name).SkippedTicks++
+}
+
+// Write records a write to a sink.
+func (s *Stats) Write(name string, duration time.Duration, points int, err error, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.sink(name)
+	c.Writes++
+	c.WriteDuration = duration
+	if err != nil {
+		c.Failures++
+		c.LastError = err.Error()
+		return
+	}
+	c.Points += int64(points)
+	c.LastSuccess = now
+	c.LastError = ""
+}
+
+// Drop records the total of samples a DroppingSink dropped so far.
+func (s *Stats) Drop(name string, dropped int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sink(name).Dropped = dropped
+}
+
+// StatsSnapshot is a copy of the stats at one point in time.
+type StatsSnapshot struct {
+	Collectors map[string]CollectorStats `json:"collectors"`
+	Sinks      map[string]SinkStats      `json:"sinks"`
+}
+
+func (s *Stats) Snapshot() StatsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := StatsSnapshot{
+		Collectors: make(map[string]CollectorStats, len(s.collectors)),
+		Sinks:      make(map[string]SinkStats, len(s.sinks)),
+	}
+	for name, c := range s.collectors {
+		snapshot.Collectors[name] = *c
+	}
+	for name, c := range s.sinks {
+		snapshot.Sinks[name] = *c
+	}
+	return snapshot
+}
+
+// Collector returns a collector emitting the stats as "exporter_collector"
+// and "exporter_sink" points.
+func (s *Stats) Collector(host string, clock Clock) *Collector {
+	return &Collector{
+		Name: "exporter",
+		Collect: func() ([]*client.Point, error) {
+			return s.points(host, clock.Now())
+		},
+	}
+}
+
+func (s *Stats) points(host string, now time.Time) ([]*client.Point, error) {
+	snapshot := s.Snapshot()
+
+	var points []*client.Point
+	for _, name := range snapshot.collectorNames() {
+		c := snapshot.Collectors[name]
+		pt, err := client.NewPoint(
+			"exporter_collector",
+			map[string]string{
+				"host":      host,
+				"collector": name,
+			},
+			map[string]interface{}{
+				"scrapes":         c.Scrapes,
+				"errors":          c.Errors,
+				"decode_errors":   c.DecodeErrors,
+				"skipped_ticks":   c.SkippedTicks,
+				"points":          c.Points,
+				"scrape_duration": c.ScrapeDuration.Seconds(),
+			},
+			now,
+		)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, pt)
+	}
+	for _, name := range snapshot.sinkNames() {
+		c := snapshot.Sinks[name]
+		pt, err := client.NewPoint(
+			"exporter_sink",
+			map[string]string{
+				"host": host,
+				"sink": name,
+			},
+			map[string]interface{}{
+				"writes":         c.Writes,
+				"failures":       c.Failures,
+				"points":         c.Points,
+				"dropped":        c.Dropped,
+				"write_duration": c.WriteDuration.Seconds(),
+			},
+			now,
+		)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, pt)
+	}
+	return points, nil
+}
+
+// ServeHTTP serves the stats as JSON.
+func (s *Stats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Snapshot())
+}
+
+func (s StatsSnapshot) collectorNames() []string {
+	names := make([]string, 0, len(s.Collectors))
+	for name := range s.Collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s StatsSnapshot) sinkNames() []string {
+	names := make([]string, 0, len(s.Sinks))
+	for name := range s.Sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
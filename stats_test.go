@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/pkg/errors"
+)
+
+// failingSink fails every write while err is set.
+type failingSink struct {
+	err error
+}
+
+func (s *failingSink) Name() string {
+	return "failing"
+}
+
+func (s *failingSink) Write(points []*client.Point) error {
+	return s.err
+}
+
+func TestStats(t *testing.T) {
+	h := newHarness(t, "testdata/torch")
+	failing := &failingSink{err: errors.New("connection refused")}
+	h.exporter.Sinks = append(h.exporter.Sinks, failing)
+	broken := &Collector{Name: "broken", Collect: func() ([]*client.Point, error) {
+		return nil, errors.Wrap(&DecodeError{Path: "broken", Err: errors.New("unexpected EOF")}, "collect")
+	}}
+	h.exporter.Collectors = append(h.exporter.Collectors, broken)
+
+	h.exporter.Tick()
+	h.clock.Advance(10 * time.Second)
+	failing.err = nil
+	h.exporter.Collect(h.collectors["server"])
+
+	snapshot := h.exporter.Stats.Snapshot()
+	server := snapshot.Collectors["server"]
+	if server.Scrapes != 2 || server.Errors != 0 || server.Points == 0 || !server.LastSuccess.Equal(testEpoch.Add(10*time.Second)) {
+		t.Errorf("unexpected server stats %+v", server)
+	}
+	want := CollectorStats{Scrapes: 1, Errors: 1, DecodeErrors: 1, LastError: "collect: decode broken: unexpected EOF"}
+	if got := snapshot.Collectors["broken"]; got != want {
+		t.Errorf("got broken stats %+v, want %+v", got, want)
+	}
+
+	// Both sinks get every batch, only the last one made it to the failing
+	// sink.
+	memory, failed := snapshot.Sinks["memory"], snapshot.Sinks["failing"]
+	if failed.Writes != memory.Writes || failed.Failures != memory.Writes-1 || failed.LastError != "" {
+		t.Errorf("unexpected failing sink stats %+v, memory sink %+v", failed, memory)
+	}
+	if failed.Points != server.Points/2 || memory.Points <= failed.Points {
+		t.Errorf("got %d points written to the failing sink, %d to the memory sink, want %d", failed.Points, memory.Points, server.Points/2)
+	}
+
+	points, err := h.exporter.Stats.points(testHost, h.clock.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, pt := range points {
+		lines = append(lines, pt.String())
+	}
+	got := strings.Join(lines, "\n")
+	for _, want := range []string{
+		"exporter_collector,collector=broken,host=http://torch:8080 decode_errors=1i,errors=1i,points=0i,scrape_duration=0,scrapes=1i,skipped_ticks=0i 1541332810000000000",
+		"exporter_sink,host=http://torch:8080,sink=failing dropped=0i,failures=",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.exporter.Stats.ServeHTTP(w, httptest.NewRequest("GET", "/debug/metrics", nil))
+	var served StatsSnapshot
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(served, snapshot) {
+		t.Errorf("/debug/metrics served\n%+v\nwant\n%+v", served, snapshot)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/pkg/errors"
+)
+
+// DefaultStatsdMeasurements are forwarded to StatsD unless configured
+// otherwise.
+const DefaultStatsdMeasurements = "server,load,process,players"
+
+// StatsdSink sends points to a StatsD agent over UDP. Numeric fields become
+// gauges named <prefix>.<measurement>.<field>. With Tags set, point tags are
+// attached DogStatsD style (|#key:value), otherwise they are dropped.
+type StatsdSink struct {
+	Prefix       string
+	Tags         bool
+	Measurements map[string]bool
+	// MaxPacket is the largest payload sent in a single datagram.
+	MaxPacket int
+
+	conn net.Conn
+}
+
+func NewStatsdSink(address, prefix string, measurements []string) (*StatsdSink, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	s := &StatsdSink{
+		Prefix:       prefix,
+		Measurements: make(map[string]bool),
+		MaxPacket:    1432,
+		conn:         conn,
+	}
+	for _, m := range measurements {
+		if m = strings.TrimSpace(m); m != "" {
+			s.Measurements[m] = true
+		}
+	}
+	return s, nil
+}
+
+func (s *StatsdSink) Name() string {
+	return "statsd"
+}
+
+func (s *StatsdSink) Write(points []*client.Point) error {
+	var lines []string
+	for _, pt := range points {
+		if !s.Measurements[pt.Name()] {
+			continue
+		}
+		pl, err := s.lines(pt)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, pl...)
+	}
+
+	var packet bytes.Buffer
+	flush := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := s.conn.Write(packet.Bytes())
+		packet.Reset()
+		return errors.Wrap(err, "statsd")
+	}
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > s.MaxPacket {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	return flush()
+}
+
+func (s *StatsdSink) lines(pt *client.Point) ([]string, error) {
+	tags := pt.Tags()
+	suffix := ""
+	if s.Tags {
+		suffix = dogstatsdTags(tags)
+	}
+
+	// Occurrences are sent as counters named after their type, e.g.
+	// "spaceengineers.players.joined:1|c".
+	if occurrences[pt.Name()] {
+		name := s.name(pt.Name(), strings.ToLower(tags["type"]))
+		if pt.Name() == "alert" {
+			name = s.name(pt.Name(), tags["rule"])
+		}
+		return []string{name + ":1|c" + suffix}, nil
+	}
+
+	fields, err := pt.Fields()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var lines []string
+	for _, k := range keys {
+		value, ok := fieldValue(fields[k])
+		if !ok {
+			continue
+		}
+		name := s.name(pt.Name(), k)
+		// A signed gauge value is applied as a delta, so negative values
+		// have to be set from zero.
+		if value < 0 {
+			lines = append(lines, name+":0|g"+suffix)
+		}
+		lines = append(lines, name+":"+strconv.FormatFloat(value, 'f', -1, 64)+"|g"+suffix)
+	}
+	return lines, nil
+}
+
+var statsdReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_", "\n", "_")
+
+func (s *StatsdSink) name(nodes ...string) string {
+	parts := []string{}
+	if s.Prefix != "" {
+		parts = append(parts, s.Prefix)
+	}
+	for _, node := range nodes {
+		if node != "" {
+			parts = append(parts, statsdReplacer.Replace(node))
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+func dogstatsdTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return ""
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = statsdReplacer.Replace(k) + ":" + strings.NewReplacer("|", "_", ",", "_", "#", "_", "\n", "_").Replace(tags[k])
+	}
+	return "|#" + strings.Join(pairs, ",")
+}
+
+// Close closes the UDP socket.
+func (s *StatsdSink) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+func TestStatsdSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s, err := NewStatsdSink(conn.LocalAddr().String(), "se", strings.Split(DefaultStatsdMeasurements, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Tags = true
+	s.MaxPacket = 120
+
+	server, err := client.NewPoint("server", map[string]string{"host": "h", "server_name": "Fank|Server"}, map[string]interface{}{"sim_speed": 0.87, "players": 7, "block_limit": "PER_PLAYER"}, testEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	process, err := client.NewPoint("process", map[string]string{"host": "h"}, map[string]interface{}{"working_set64": int64(-1)}, testEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	joined, err := client.NewPoint("players", map[string]string{"host": "h", "type": PlayerJoined, "steam_id": "1"}, map[string]interface{}{"value": 1}, testEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grid, err := client.NewPoint("grid", map[string]string{"host": "h"}, map[string]interface{}{"pcu": 10}, testEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write([]*client.Point{server, process, joined, grid}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	buf := make([]byte, 2048)
+	for len(got) < 5 {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("after %q: %v", got, err)
+		}
+		if n > s.MaxPacket {
+			t.Errorf("packet of %d bytes exceeds %d", n, s.MaxPacket)
+		}
+		got = append(got, strings.Split(string(buf[:n]), "\n")...)
+	}
+	want := []string{
+		"se.server.players:7|g|#host:h,server_name:Fank_Server",
+		"se.server.sim_speed:0.87|g|#host:h,server_name:Fank_Server",
+		"se.process.working_set64:0|g|#host:h",
+		"se.process.working_set64:-1|g|#host:h",
+		"se.players.joined:1|c|#host:h,steam_id:1,type:Joined",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
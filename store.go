@@ -0,0 +1,445 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/pkg/errors"
+)
+
+// Store aggregations.
+const (
+	StoreAvg   = "avg"
+	StoreMin   = "min"
+	StoreMax   = "max"
+	StoreSum   = "sum"
+	StoreCount = "count"
+	StoreLast  = "last"
+	// StoreRate is the per second increase of a counter, resets count from
+	// zero.
+	StoreRate = "rate"
+)
+
+// Store is a sink keeping the recent history of every numeric field in
+// memory, one series per measurement, tag set and field. Samples older
+// than Retention are dropped, a series holds at most MaxSamples and no more
+// than MaxSeries series are kept. The series of single grids are the first
+// to go once full: a further grid series is dropped, any other series takes
+// the place of the grid series that was written to longest ago. This way
+// hundreds of grids never crowd out the server and process series.
+type Store struct {
+	Retention  time.Duration
+	MaxSeries  int
+	MaxSamples int
+	Clock      Clock
+
+	mu      sync.RWMutex
+	series  map[string]*storeSeries
+	dropped int64
+}
+
+type storeSeries struct {
+	measurement string
+	field       string
+	tags        map[string]string
+	samples     []StorePoint
+}
+
+// StorePoint is a single sample or aggregate.
+type StorePoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+func NewStore(retention time.Duration, clock Clock) *Store {
+	return &Store{
+		Retention:  retention,
+		MaxSeries:  10000,
+		MaxSamples: 4096,
+		Clock:      clock,
+		series:     make(map[string]*storeSeries),
+	}
+}
+
+func (s *Store) Name() string {
+	return "store"
+}
+
+func (s *Store) Write(points []*client.Point) error {
+	now := s.Clock.Now()
+	cutoff := now.Add(-s.Retention)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, pt := range points {
+		fields, err := pt.Fields()
+		if err != nil {
+			return err
+		}
+		ts := pt.Time()
+		if ts.IsZero() {
+			ts = now
+		}
+		if ts.Before(cutoff) {
+			continue
+		}
+		tags := pt.Tags()
+		for field, v := range fields {
+			value, ok := fieldValue(v)
+			if !ok {
+				continue
+			}
+			key := storeKey(pt.Name(), field, tags)
+			series, ok := s.series[key]
+			if !ok {
+				if len(s.series) >= s.MaxSeries && (storeGridSeries(pt.Name()) || !s.evictGridSeries()) {
+					s.dropped++
+					continue
+				}
+				series = &storeSeries{measurement: pt.Name(), field: field, tags: tags}
+				s.series[key] = series
+			}
+			series.add(StorePoint{ts, value}, cutoff, s.MaxSamples)
+		}
+	}
+
+	// Forget series that received nothing within the retention.
+	for key, series := range s.series {
+		if len(series.samples) == 0 || series.samples[len(series.samples)-1].Time.Before(cutoff) {
+			delete(s.series, key)
+		}
+	}
+	return nil
+}
+
+// storeGridSeries reports whether series of measurement are per grid.
+func storeGridSeries(measurement string) bool {
+	return measurement == "grid"
+}
+
+// evictGridSeries removes the grid series written to longest ago, its
+// samples count as dropped.
+func (s *Store) evictGridSeries() bool {
+	var evict string
+	var last time.Time
+	for key, series := range s.series {
+		if !storeGridSeries(series.measurement) || len(series.samples) == 0 {
+			continue
+		}
+		t := series.samples[len(series.samples)-1].Time
+		if evict == "" || t.Before(last) || t.Equal(last) && key < evict {
+			evict, last = key, t
+		}
+	}
+	if evict == "" {
+		return false
+	}
+	s.dropped += int64(len(s.series[evict].samples))
+	delete(s.series, evict)
+	return true
+}
+
+func storeKey(measurement, field string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(measurement)
+	for _, k := range keys {
+		b.WriteString("," + k + "=" + tags[k])
+	}
+	b.WriteString(" " + field)
+	return b.String()
+}
+
+// add inserts p in time order, replacing a sample of the same time, and
+// drops samples before cutoff or beyond max.
+func (s *storeSeries) add(p StorePoint, cutoff time.Time, max int) {
+	i := sort.Search(len(s.samples), func(i int) bool { return !s.samples[i].Time.Before(p.Time) })
+	switch {
+	case i < len(s.samples) && s.samples[i].Time.Equal(p.Time):
+		s.samples[i] = p
+	case i == len(s.samples):
+		s.samples = append(s.samples, p)
+	default:
+		s.samples = append(s.samples, StorePoint{})
+		copy(s.samples[i+1:], s.samples[i:])
+		s.samples[i] = p
+	}
+
+	first := sort.Search(len(s.samples), func(i int) bool { return !s.samples[i].Time.Before(cutoff) })
+	if n := len(s.samples) - max; n > first {
+		first = n
+	}
+	if first > 0 {
+		s.samples = append(s.samples[:0], s.samples[first:]...)
+	}
+}
+
+// StoreQuery selects series by measurement, field and tags. Empty values
+// match everything. Without a Step, the samples are returned as is or, with
+// an aggregation, aggregated into a single point per series.
+type StoreQuery struct {
+	Measurement string
+	Field       string
+	Tags        map[string]string
+	Start       time.Time
+	End         time.Time
+	Step        time.Duration
+	Aggregation string
+}
+
+// StoreSeries is a query result.
+type StoreSeries struct {
+	Measurement string            `json:"measurement"`
+	Field       string            `json:"field"`
+	Tags        map[string]string `json:"tags"`
+	Points      []StorePoint      `json:"points"`
+}
+
+// Query returns the matching series ordered by measurement, field and tags.
+func (s *Store) Query(q StoreQuery) ([]StoreSeries, error) {
+	switch q.Aggregation {
+	case "", StoreAvg, StoreMin, StoreMax, StoreSum, StoreCount, StoreLast, StoreRate:
+	default:
+		return nil, errors.Errorf("unknown aggregation %q", q.Aggregation)
+	}
+	if q.Step < 0 {
+		return nil, errors.New("negative step")
+	}
+	if q.End.IsZero() {
+		q.End = s.Clock.Now()
+	}
+	if q.Start.IsZero() {
+		q.Start = q.End.Add(-s.Retention)
+	}
+	if q.Start.After(q.End) {
+		return nil, errors.New("start after end")
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]string, 0, len(s.series))
+	for key, series := range s.series {
+		if series.matches(q) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := make([]StoreSeries, 0, len(keys))
+	for _, key := range keys {
+		series := s.series[key]
+		result = append(result, StoreSeries{
+			Measurement: series.measurement,
+			Field:       series.field,
+			Tags:        series.tags,
+			Points:      series.query(q),
+		})
+	}
+	return result, nil
+}
+
+func (s *storeSeries) matches(q StoreQuery) bool {
+	if q.Measurement != "" && q.Measurement != s.measurement {
+		return false
+	}
+	if q.Field != "" && q.Field != s.field {
+		return false
+	}
+	for k, v := range q.Tags {
+		if s.tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *storeSeries) query(q StoreQuery) []StorePoint {
+	start := sort.Search(len(s.samples), func(i int) bool { return !s.samples[i].Time.Before(q.Start) })
+	end := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].Time.After(q.End) })
+	samples := s.samples[start:end]
+	if q.Aggregation == "" && q.Step == 0 {
+		return append([]StorePoint{}, samples...)
+	}
+	aggregation := q.Aggregation
+	if aggregation == "" {
+		aggregation = StoreAvg
+	}
+	step := q.Step
+	if step == 0 {
+		step = q.End.Sub(q.Start)
+	}
+	if step <= 0 {
+		// A single instant, aggregated over a bucket of a second.
+		step = time.Second
+	}
+
+	points := []StorePoint{}
+	for i := 0; i < len(samples); {
+		// Buckets are aligned to the start of the query.
+		bucket := q.Start.Add(samples[i].Time.Sub(q.Start) / step * step)
+		j := i
+		for j < len(samples) && samples[j].Time.Before(bucket.Add(step)) {
+			j++
+		}
+		var prev *StorePoint
+		if start+i > 0 {
+			prev = &s.samples[start+i-1]
+		}
+		if v, ok := storeAggregate(aggregation, prev, samples[i:j], step); ok {
+			points = append(points, StorePoint{bucket, v})
+		}
+		i = j
+	}
+	return points
+}
+
+// storeAggregate aggregates the samples of a bucket; prev is the sample
+// before the bucket, if any, which rates are computed from.
+func storeAggregate(aggregation string, prev *StorePoint, samples []StorePoint, step time.Duration) (float64, bool) {
+	switch aggregation {
+	case StoreCount:
+		return float64(len(samples)), true
+	case StoreLast:
+		return samples[len(samples)-1].Value, true
+	case StoreRate:
+		var increase float64
+		for i, p := range samples {
+			last := prev
+			if i > 0 {
+				last = &samples[i-1]
+			}
+			if last == nil {
+				continue
+			}
+			if delta := p.Value - last.Value; delta >= 0 {
+				increase += delta
+			} else {
+				increase += p.Value
+			}
+		}
+		return increase / step.Seconds(), true
+	}
+
+	v := samples[0].Value
+	sum := 0.0
+	for _, p := range samples {
+		sum += p.Value
+		switch aggregation {
+		case StoreMin:
+			v = math.Min(v, p.Value)
+		case StoreMax:
+			v = math.Max(v, p.Value)
+		}
+	}
+	switch aggregation {
+	case StoreSum:
+		return sum, true
+	case StoreAvg:
+		return sum / float64(len(samples)), true
+	}
+	return v, true
+}
+
+// Register adds the query API to mux:
+//
+//	/api/v1/series  lists the series matching measurement, field and tag
+//	/api/v1/query   also returns their points between start and end,
+//	                aggregated per step
+//
+// Tags are selected with tag=key:value, repeatable. start and end are RFC
+// 3339 times, unix seconds or durations before now like 15m.
+func (s *Store) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/query", func(w http.ResponseWriter, r *http.Request) {
+		s.serve(w, r, true)
+	})
+	mux.HandleFunc("/api/v1/series", func(w http.ResponseWriter, r *http.Request) {
+		s.serve(w, r, false)
+	})
+}
+
+func (s *Store) serve(w http.ResponseWriter, r *http.Request, points bool) {
+	w.Header().Set("Content-Type", "application/json")
+	q, err := s.parseQuery(r)
+	var series []StoreSeries
+	if err == nil {
+		series, err = s.Query(q)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if !points {
+		for i := range series {
+			series[i].Points = nil
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"series": series})
+}
+
+func (s *Store) parseQuery(r *http.Request) (StoreQuery, error) {
+	params := r.URL.Query()
+	q := StoreQuery{
+		Measurement: params.Get("measurement"),
+		Field:       params.Get("field"),
+		Tags:        make(map[string]string),
+		Aggregation: params.Get("agg"),
+	}
+	for _, tag := range params["tag"] {
+		kv := strings.SplitN(tag, ":", 2)
+		if len(kv) != 2 {
+			return q, errors.Errorf("tag %q is not key:value", tag)
+		}
+		q.Tags[kv[0]] = kv[1]
+	}
+	now := s.Clock.Now()
+	var err error
+	if q.Start, err = parseStoreTime(params.Get("start"), now); err != nil {
+		return q, err
+	}
+	if q.End, err = parseStoreTime(params.Get("end"), now); err != nil {
+		return q, err
+	}
+	if step := params.Get("step"); step != "" {
+		if q.Step, err = time.ParseDuration(step); err != nil {
+			return q, err
+		}
+	}
+	return q, nil
+}
+
+func parseStoreTime(v string, now time.Time) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return now.Add(-d), nil
+	}
+	if unix, err := strconv.ParseFloat(v, 64); err == nil {
+		return time.Unix(0, int64(unix*float64(time.Second))), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	return t, errors.Wrap(err, "time")
+}
+
+// Dropped returns the number of samples dropped for exceeding MaxSeries,
+// including those of evicted grid series.
+func (s *Store) Dropped() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.dropped
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+func storePoint(t *testing.T, host string, ts time.Time, fields map[string]interface{}) *client.Point {
+	pt, err := client.NewPoint("process", map[string]string{"host": host}, fields, ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pt
+}
+
+func storeValues(points []StorePoint) []float64 {
+	values := []float64{}
+	for _, p := range points {
+		values = append(values, p.Value)
+	}
+	return values
+}
+
+func TestStore(t *testing.T) {
+	clock := NewFakeClock(testEpoch)
+	s := NewStore(time.Minute, clock)
+
+	// A counter restarting at 90s, and a second host.
+	counter := []float64{10, 20, 25, 40, 5, 15, 30}
+	for i, v := range counter {
+		if i > 0 {
+			clock.Advance(15 * time.Second)
+		}
+		ts := clock.Now()
+		points := []*client.Point{
+			storePoint(t, "a", ts, map[string]interface{}{"gc_count": v, "version": "1.0"}),
+			storePoint(t, "b", ts, map[string]interface{}{"gc_count": 1}),
+		}
+		if err := s.Write(points); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	series, err := s.Query(StoreQuery{Tags: map[string]string{"host": "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 1 || series[0].Measurement != "process" || series[0].Field != "gc_count" {
+		t.Fatalf("unexpected series %v", series)
+	}
+	// The first two samples are beyond the retention.
+	if got, want := storeValues(series[0].Points), []float64{25, 40, 5, 15, 30}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got samples %v, want %v", got, want)
+	}
+
+	start := testEpoch.Add(30 * time.Second)
+	for _, test := range []struct {
+		aggregation string
+		want        []float64
+	}{
+		{StoreAvg, []float64{32.5, 10, 30}},
+		{StoreMax, []float64{40, 15, 30}},
+		{StoreCount, []float64{2, 2, 1}},
+		// The restart counts from zero: 5+10 in the second bucket.
+		{StoreRate, []float64{0.5, 0.5, 0.5}},
+	} {
+		series, err := s.Query(StoreQuery{
+			Measurement: "process",
+			Field:       "gc_count",
+			Tags:        map[string]string{"host": "a"},
+			Start:       start,
+			Step:        30 * time.Second,
+			Aggregation: test.aggregation,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := storeValues(series[0].Points); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.aggregation, got, test.want)
+		}
+		if !series[0].Points[1].Time.Equal(start.Add(30 * time.Second)) {
+			t.Errorf("%s: bucket at %s, want it aligned to the start", test.aggregation, series[0].Points[1].Time)
+		}
+	}
+
+	if _, err := s.Query(StoreQuery{Aggregation: "median"}); err == nil {
+		t.Error("expected an error for an unknown aggregation")
+	}
+
+	s.MaxSeries = 2
+	if err := s.Write([]*client.Point{storePoint(t, "c", clock.Now(), map[string]interface{}{"gc_count": 1})}); err != nil {
+		t.Fatal(err)
+	}
+	if s.Dropped() != 1 {
+		t.Errorf("dropped %d samples, want 1", s.Dropped())
+	}
+}
+
+func TestStoreGridSeries(t *testing.T) {
+	h := newHarness(t, "testdata/torch")
+	s := NewStore(time.Hour, h.clock)
+	s.MaxSeries = 3
+	h.exporter.Sinks = []Sink{s}
+
+	grid := func(name string) *client.Point {
+		pt, err := client.NewPoint("grid", map[string]string{"host": testHost, "display_name": name}, map[string]interface{}{"pcu": 100}, h.clock.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pt
+	}
+	h.exporter.Write([]*client.Point{grid("Base"), storePoint(t, "a", h.clock.Now(), map[string]interface{}{"gc_count": 1})})
+	h.clock.Advance(time.Minute)
+	h.exporter.Write([]*client.Point{grid("Rover"), grid("Drone")})
+	if s.Dropped() != 1 {
+		t.Errorf("dropped %d samples, want the grid beyond the limit", s.Dropped())
+	}
+
+	// Other series take the place of the grid written to longest ago.
+	h.exporter.Write([]*client.Point{storePoint(t, "b", h.clock.Now(), map[string]interface{}{"gc_count": 1})})
+	series, err := s.Query(StoreQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, series := range series {
+		got = append(got, series.Measurement+" "+series.Tags["display_name"]+series.Tags["host"])
+	}
+	if want := []string{"grid Rover" + testHost, "process a", "process b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got series %v, want %v", got, want)
+	}
+	if s.Dropped() != 2 {
+		t.Errorf("dropped %d samples, want 2", s.Dropped())
+	}
+	if dropped := h.exporter.Stats.Snapshot().Sinks["store"].Dropped; dropped != 2 {
+		t.Errorf("got %d dropped samples in the stats, want 2", dropped)
+	}
+}
+
+func TestStoreAPI(t *testing.T) {
+	clock := NewFakeClock(testEpoch)
+	s := NewStore(time.Hour, clock)
+	for i := 0; i < 4; i++ {
+		clock.Advance(10 * time.Second)
+		points := []*client.Point{
+			storePoint(t, "a", time.Time{}, map[string]interface{}{"gc_count": i, "working_set": 100 * i}),
+		}
+		if err := s.Write(points); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mux := http.NewServeMux()
+	s.Register(mux)
+
+	get := func(url string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		var body map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, body
+	}
+
+	code, body := get("/api/v1/series?tag=host:a")
+	if series, _ := body["series"].([]interface{}); code != http.StatusOK || len(series) != 2 {
+		t.Errorf("got %d %v, want two series", code, body)
+	}
+
+	code, body = get("/api/v1/query?field=working_set&start=25s&step=1m&agg=max")
+	series, _ := body["series"].([]interface{})
+	if code != http.StatusOK || len(series) != 1 {
+		t.Fatalf("got %d %v, want one series", code, body)
+	}
+	points := series[0].(map[string]interface{})["points"].([]interface{})
+	if len(points) != 1 || points[0].(map[string]interface{})["value"] != 300.0 {
+		t.Errorf("unexpected points %v", points)
+	}
+
+	// An instant aggregates the sample at that time.
+	code, body = get("/api/v1/query?field=gc_count&start=1541332830&end=1541332830&agg=rate")
+	series, _ = body["series"].([]interface{})
+	if code != http.StatusOK || len(series) != 1 || len(series[0].(map[string]interface{})["points"].([]interface{})) != 1 {
+		t.Errorf("got %d %v, want one point", code, body)
+	}
+
+	for _, url := range []string{"/api/v1/query?tag=host", "/api/v1/query?start=1m&end=10m"} {
+		code, body = get(url)
+		if code != http.StatusBadRequest || body["error"] == nil {
+			t.Errorf("%s: got %d %v, want a bad request", url, code, body)
+		}
+	}
+}
@@ -13,6 +13,10 @@ type TorchMetrics struct {
 	client     *http.Client
 	clientLock sync.Mutex
 	host       string
+
+	lastLock     sync.Mutex
+	lastGrids    []TorchMetricsSessionGrid
+	lastFactions []TorchMetricsSessionFaction
 }
 
 func NewTorchMetrics(host string) (*TorchMetrics, error) {
@@ -22,6 +26,41 @@ func NewTorchMetrics(host string) (*TorchMetrics, error) {
 	}, nil
 }
 
+// SetTransport replaces the transport used to talk to Torch, e.g. to record
+// or replay its responses.
+func (t *TorchMetrics) SetTransport(rt http.RoundTripper) {
+	t.client.Transport = rt
+}
+
+// DecodeError is returned when a Torch response could not be decoded.
+type DecodeError struct {
+	Path string
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decode %s: %v", e.Path, e.Err)
+}
+
+func (t *TorchMetrics) get(path string, v interface{}) error {
+	res, err := t.client.Get(fmt.Sprintf("%s/metrics/v1/%s", t.host, path))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errors.New(res.Status)
+	}
+
+	err = json.NewDecoder(res.Body).Decode(v)
+	if err != nil {
+		return &DecodeError{Path: path, Err: err}
+	}
+
+	return nil
+}
+
 type TorchMetricServer struct {
 	Version            string
 	ServerName         string
@@ -44,22 +83,10 @@ type TorchMetricServer struct {
 }
 
 func (t *TorchMetrics) Server() (*TorchMetricServer, error) {
-	res, err := t.client.Get(fmt.Sprintf("%s/metrics/v1/server", t.host))
-	if err != nil {
-		return nil, err
-	}
-	defer res.Body.Close()
-
-	if res.StatusCode != http.StatusOK {
-		return nil, errors.New(res.Status)
-	}
-
 	var server TorchMetricServer
-	err = json.NewDecoder(res.Body).Decode(&server)
-	if err != nil {
+	if err := t.get("server", &server); err != nil {
 		return nil, err
 	}
-
 	return &server, nil
 }
 
@@ -91,42 +118,19 @@ type TorchMetricsLoad struct {
 }
 
 func (t *TorchMetrics) Load() ([]TorchMetricsLoad, error) {
-	res, err := t.client.Get(fmt.Sprintf("%s/metrics/v1/load", t.host))
-	if err != nil {
-		return nil, err
-	}
-	defer res.Body.Close()
-
-	if res.StatusCode != http.StatusOK {
-		return nil, errors.New(res.Status)
-	}
 	var loads []TorchMetricsLoad
-	err = json.NewDecoder(res.Body).Decode(&loads)
-	if err != nil {
+	if err := t.get("load", &loads); err != nil {
 		return nil, err
 	}
-
 	return loads, nil
 }
 
 func (t *TorchMetrics) Process() (*TorchMetricsProcess, error) {
-	res, err := t.client.Get(fmt.Sprintf("%s/metrics/v1/process", t.host))
-	if err != nil {
-		return nil, err
-	}
-	defer res.Body.Close()
-
-	if res.StatusCode != http.StatusOK {
-		return nil, errors.New(res.Status)
-	}
-
-	var server TorchMetricsProcess
-	err = json.NewDecoder(res.Body).Decode(&server)
-	if err != nil {
+	var process TorchMetricsProcess
+	if err := t.get("process", &process); err != nil {
 		return nil, err
 	}
-
-	return &server, nil
+	return &process, nil
 }
 
 type TorchMetricsEvent struct {
@@ -137,24 +141,19 @@ type TorchMetricsEvent struct {
 }
 
 func (t *TorchMetrics) Events() ([]TorchMetricsEvent, error) {
-	res, err := t.client.Get(fmt.Sprintf("%s/metrics/v1/events", t.host))
-	if err != nil {
-		return nil, err
-	}
-	defer res.Body.Close()
-
-	if res.StatusCode != http.StatusOK {
-		return nil, errors.New(res.Status)
-	}
 	var events []TorchMetricsEvent
-	err = json.NewDecoder(res.Body).Decode(&events)
-	if err != nil {
+	if err := t.get("events", &events); err != nil {
 		return nil, err
 	}
-
 	return events, nil
 }
 
+// Types of TorchPlayerEvent.
+const (
+	PlayerJoined = "Joined"
+	PlayerLeft   = "Left"
+)
+
 type TorchPlayerEvent struct {
 	Type                  string
 	SteamID               uint64 `json:"SteamId"`
@@ -162,21 +161,10 @@ type TorchPlayerEvent struct {
 }
 
 func (t *TorchMetrics) PlayerEvents() ([]TorchPlayerEvent, error) {
-	res, err := t.client.Get(fmt.Sprintf("%s/metrics/v1/players", t.host))
-	if err != nil {
-		return nil, err
-	}
-	defer res.Body.Close()
-
-	if res.StatusCode != http.StatusOK {
-		return nil, errors.New(res.Status)
-	}
 	var events []TorchPlayerEvent
-	err = json.NewDecoder(res.Body).Decode(&events)
-	if err != nil {
+	if err := t.get("players", &events); err != nil {
 		return nil, err
 	}
-
 	return events, nil
 }
 
@@ -204,65 +192,44 @@ type TorchMetricsSessionGrid struct {
 }
 
 func (t *TorchMetrics) SessionGrids() ([]TorchMetricsSessionGrid, error) {
-	res, err := t.client.Get(fmt.Sprintf("%s/metrics/v1/session/grids", t.host))
-	if err != nil {
-		return nil, err
-	}
-	defer res.Body.Close()
-
-	if res.StatusCode != http.StatusOK {
-		return nil, errors.New(res.Status)
-	}
 	var grids []TorchMetricsSessionGrid
-	err = json.NewDecoder(res.Body).Decode(&grids)
-	if err != nil {
+	if err := t.get("session/grids", &grids); err != nil {
 		return nil, err
 	}
-
+	t.lastLock.Lock()
+	t.lastGrids = grids
+	t.lastLock.Unlock()
 	return grids, nil
 }
 
+// LastSessionGrids returns the grids of the latest SessionGrids call, nil
+// before the first. Sinks use it for what the grid points leave out, such
+// as the entity IDs, without asking Torch again.
+func (t *TorchMetrics) LastSessionGrids() []TorchMetricsSessionGrid {
+	t.lastLock.Lock()
+	defer t.lastLock.Unlock()
+	return t.lastGrids
+}
+
 type TorchMetricsSessionAsteroidOrPlanet struct {
 	DisplayName string
 	EntityId    int64
 }
 
 func (t *TorchMetrics) SessionAsteroids() ([]TorchMetricsSessionAsteroidOrPlanet, error) {
-	res, err := t.client.Get(fmt.Sprintf("%s/metrics/v1/session/asteroids", t.host))
-	if err != nil {
+	var asteroids []TorchMetricsSessionAsteroidOrPlanet
+	if err := t.get("session/asteroids", &asteroids); err != nil {
 		return nil, err
 	}
-	defer res.Body.Close()
-
-	if res.StatusCode != http.StatusOK {
-		return nil, errors.New(res.Status)
-	}
-	var grids []TorchMetricsSessionAsteroidOrPlanet
-	err = json.NewDecoder(res.Body).Decode(&grids)
-	if err != nil {
-		return nil, err
-	}
-
-	return grids, nil
+	return asteroids, nil
 }
 
 func (t *TorchMetrics) SessionPlanets() ([]TorchMetricsSessionAsteroidOrPlanet, error) {
-	res, err := t.client.Get(fmt.Sprintf("%s/metrics/v1/session/planets", t.host))
-	if err != nil {
-		return nil, err
-	}
-	defer res.Body.Close()
-
-	if res.StatusCode != http.StatusOK {
-		return nil, errors.New(res.Status)
-	}
-	var grids []TorchMetricsSessionAsteroidOrPlanet
-	err = json.NewDecoder(res.Body).Decode(&grids)
-	if err != nil {
+	var planets []TorchMetricsSessionAsteroidOrPlanet
+	if err := t.get("session/planets", &planets); err != nil {
 		return nil, err
 	}
-
-	return grids, nil
+	return planets, nil
 }
 
 type TorchMetricsSessionFloatingObject struct {
@@ -276,22 +243,11 @@ type TorchMetricsSessionFloatingObject struct {
 }
 
 func (t *TorchMetrics) SessionFloatingObjects() ([]TorchMetricsSessionFloatingObject, error) {
-	res, err := t.client.Get(fmt.Sprintf("%s/metrics/v1/session/floatingObjects", t.host))
-	if err != nil {
-		return nil, err
-	}
-	defer res.Body.Close()
-
-	if res.StatusCode != http.StatusOK {
-		return nil, errors.New(res.Status)
-	}
-	var grids []TorchMetricsSessionFloatingObject
-	err = json.NewDecoder(res.Body).Decode(&grids)
-	if err != nil {
+	var floatingObjects []TorchMetricsSessionFloatingObject
+	if err := t.get("session/floatingObjects", &floatingObjects); err != nil {
 		return nil, err
 	}
-
-	return grids, nil
+	return floatingObjects, nil
 }
 
 type TorchMetricsSessionFaction struct {
@@ -308,20 +264,20 @@ type TorchMetricsSessionFaction struct {
 }
 
 func (t *TorchMetrics) SessionFactions() ([]TorchMetricsSessionFaction, error) {
-	res, err := t.client.Get(fmt.Sprintf("%s/metrics/v1/session/factions", t.host))
-	if err != nil {
-		return nil, err
-	}
-	defer res.Body.Close()
-
-	if res.StatusCode != http.StatusOK {
-		return nil, errors.New(res.Status)
-	}
-	var grids []TorchMetricsSessionFaction
-	err = json.NewDecoder(res.Body).Decode(&grids)
-	if err != nil {
+	var factions []TorchMetricsSessionFaction
+	if err := t.get("session/factions", &factions); err != nil {
 		return nil, err
 	}
+	t.lastLock.Lock()
+	t.lastFactions = factions
+	t.lastLock.Unlock()
+	return factions, nil
+}
 
-	return grids, nil
+// LastSessionFactions returns the factions of the latest SessionFactions
+// call, nil before the first.
+func (t *TorchMetrics) LastSessionFactions() []TorchMetricsSessionFaction {
+	t.lastLock.Lock()
+	defer t.lastLock.Unlock()
+	return t.lastFactions
 }